@@ -0,0 +1,176 @@
+package articles
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// The articles, comments and favorites of an user are part of its account export and go away with it.
+func init() {
+	users.RegisterAccountDataHandler(users.AccountDataHandler{
+		Export: exportAccountData,
+		Delete: deleteAccountData,
+	})
+}
+
+type ArticleExport struct {
+	Slug        string   `json:"slug"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Body        string   `json:"body"`
+	Tags        []string `json:"tagList"`
+	Status      string   `json:"status"`
+	CreatedAt   string   `json:"createdAt"`
+	UpdatedAt   string   `json:"updatedAt"`
+}
+
+type CommentExport struct {
+	ID        uint   `json:"id"`
+	Article   string `json:"article"`
+	Body      string `json:"body"`
+	CreatedAt string `json:"createdAt"`
+	ParentID  uint   `json:"parentId,omitempty"`
+}
+
+// Unlike GetArticleUserModel, nothing is created for an user who never wrote or favorited anything.
+func findArticleUserModel(db *gorm.DB, userID uint) (ArticleUserModel, error) {
+	var articleUserModel ArticleUserModel
+	err := db.Where(&ArticleUserModel{UserModelID: userID}).First(&articleUserModel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = nil
+	}
+	return articleUserModel, err
+}
+
+func exportAccountData(user users.UserModel) (map[string]interface{}, error) {
+	db := common.GetDB()
+	articles := []ArticleExport{}
+	comments := []CommentExport{}
+	favorites := []string{}
+	sections := map[string]interface{}{
+		"articles":  articles,
+		"comments":  comments,
+		"favorites": favorites,
+	}
+	author, err := findArticleUserModel(db, user.ID)
+	if err != nil || author.ID == 0 {
+		return sections, err
+	}
+
+	var articleModels []ArticleModel
+	if err := db.Where(&ArticleModel{AuthorID: author.ID}).Order("id").Preload("Tags").Find(&articleModels).Error; err != nil {
+		return nil, err
+	}
+	for _, article := range articleModels {
+		tags := []string{}
+		for _, tag := range article.Tags {
+			tags = append(tags, tag.Tag)
+		}
+		articles = append(articles, ArticleExport{
+			Slug:        article.Slug,
+			Title:       article.Title,
+			Description: article.Description,
+			Body:        article.Body,
+			Tags:        tags,
+			Status:      article.Status,
+			CreatedAt:   article.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			UpdatedAt:   article.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		})
+	}
+
+	var commentModels []CommentModel
+	if err := db.Where(&CommentModel{AuthorID: author.ID}).Order("id").Preload("Article").Find(&commentModels).Error; err != nil {
+		return nil, err
+	}
+	for _, comment := range commentModels {
+		comments = append(comments, CommentExport{
+			ID:        comment.ID,
+			Article:   comment.Article.Slug,
+			Body:      comment.Body,
+			CreatedAt: comment.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			ParentID:  comment.ParentID,
+		})
+	}
+
+	err = db.Table("article_models").
+		Joins("JOIN favorite_models ON favorite_models.favorite_id = article_models.id AND favorite_models.deleted_at IS NULL").
+		Where("favorite_models.favorite_by_id = ? AND article_models.deleted_at IS NULL", author.ID).
+		Order("favorite_models.id").
+		Pluck("article_models.slug", &favorites).Error
+	if err != nil {
+		return nil, err
+	}
+
+	sections["articles"] = articles
+	sections["comments"] = comments
+	sections["favorites"] = favorites
+	return sections, nil
+}
+
+// Favorites of the user are always removed. Its articles, comments and revisions move to the placeholder when there
+// is one, otherwise they are removed together with the comments, favorites, tags, revisions and old slugs of the articles.
+// Comments of the user with replies of others stay in their threads as tombstones without an author.
+//
+// Soft deleted rows are covered as well, they still point to the user.
+func deleteAccountData(tx *gorm.DB, user users.UserModel, placeholder users.UserModel) error {
+	author, err := findArticleUserModel(tx, user.ID)
+	if err != nil || author.ID == 0 {
+		return err
+	}
+	if err := tx.Unscoped().Where("favorite_by_id = ?", author.ID).Delete(FavoriteModel{}).Error; err != nil {
+		return err
+	}
+
+	if placeholder.ID != 0 {
+		var keeper ArticleUserModel
+		if err := tx.Where(&ArticleUserModel{UserModelID: placeholder.ID}).FirstOrCreate(&keeper).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{&ArticleModel{}, &CommentModel{}, &ArticleRevisionModel{}} {
+			err := tx.Unscoped().Model(model).Where("author_id = ?", author.ID).UpdateColumn("author_id", keeper.ID).Error
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		var articleIDs []uint
+		if err := tx.Unscoped().Model(&ArticleModel{}).Where("author_id = ?", author.ID).Pluck("id", &articleIDs).Error; err != nil {
+			return err
+		}
+		if err := purgeArticles(tx, articleIDs); err != nil {
+			return err
+		}
+		if err := removeComments(tx, author.ID); err != nil {
+			return err
+		}
+		// The revisions of the articles of others stay in their history without an author
+		if err := tx.Model(&ArticleRevisionModel{}).Where("author_id = ?", author.ID).UpdateColumn("author_id", 0).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Unscoped().Delete(&author).Error
+}
+
+// Like purgeComments, the comments without replies go first until only the ones holding a thread together are left.
+func removeComments(tx *gorm.DB, authorID uint) error {
+	for {
+		replied := tx.Unscoped().Model(&CommentModel{}).Select("parent_id").Where("parent_id <> 0").SubQuery()
+		result := tx.Unscoped().Where("author_id = ? AND id NOT IN (?)", authorID, replied).Delete(CommentModel{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			break
+		}
+	}
+	return tx.Unscoped().Model(&CommentModel{}).Where("author_id = ?", authorID).UpdateColumns(map[string]interface{}{
+		"body":       "",
+		"body_html":  nil,
+		"author_id":  0,
+		"deleted_at": gorm.Expr("COALESCE(deleted_at, ?)", time.Now()),
+	}).Error
+}
@@ -8,5 +8,23 @@ routers.go: router binding and core logic
 serializers.go: definition the schema of return data
 
 validators.go: definition the validator of form data
+
+policies.go: who is allowed to read and mutate articles and comments
+
+scheduler.go: the background jobs, publishing the scheduled articles
+
+revisions.go: the history of the content of the articles and the diffs between two revisions
+
+markdown.go: the bodies of the articles and comments rendered to HTML
+
+slugs.go: unique slugs, the old slugs of renamed articles and the redirects from them
+
+search.go: the full text search of the articles, FTS5 when the SQLite driver has it and LIKE otherwise
+
+threads.go: the replies to comments, their depth and the tombstones of the deleted ones
+
+trash.go: the deleted articles and comments of an user, their restore and the purge of the expired ones
+
+account.go: articles, comments and favorites in the export and the deletion of an account
 */
 package articles
@@ -0,0 +1,40 @@
+package articles
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+// The body of an article is rendered once per revision and stored with it, a comment is rendered
+// when it is written. The rows from before the rendering get their HTML at the migration.
+func migrateRenderedHTML(db *gorm.DB) {
+	var revisions []ArticleRevisionModel
+	db.Where("body_html IS NULL").Find(&revisions)
+	for _, revision := range revisions {
+		db.Model(&revision).UpdateColumn("body_html", common.RenderMarkdown(revision.Body))
+	}
+	var comments []CommentModel
+	db.Unscoped().Where("body_html IS NULL").Find(&comments)
+	for _, comment := range comments {
+		db.Unscoped().Model(&comment).UpdateColumn("body_html", common.RenderMarkdown(comment.Body))
+	}
+}
+
+// Whether the client asked for the rendered bodies with ?html=true
+func wantsHTML(c *gin.Context) bool {
+	html, _ := strconv.ParseBool(c.Query("html"))
+	return html
+}
+
+// The HTML of the current body, the one of the latest revision
+func (article ArticleModel) bodyHTML() string {
+	revision, err := article.findRevision(0)
+	if err != nil || revision.BodyHTML == nil || revision.Body != article.Body {
+		return common.RenderMarkdown(article.Body)
+	}
+	return *revision.BodyHTML
+}
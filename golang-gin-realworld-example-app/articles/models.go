@@ -5,10 +5,19 @@ import (
 	"realworld-backend/common"
 	"realworld-backend/users"
 	"strconv"
+	"time"
 
 	"github.com/jinzhu/gorm"
 )
 
+// The states of an article. Drafts are only seen by their author, scheduled articles go live at
+// their PublishedAt, see scheduler.go.
+const (
+	ArticleStatusDraft     = "draft"
+	ArticleStatusScheduled = "scheduled"
+	ArticleStatusPublished = "published"
+)
+
 type ArticleModel struct {
 	gorm.Model
 	Slug        string `gorm:"unique_index"`
@@ -19,6 +28,9 @@ type ArticleModel struct {
 	AuthorID    uint           `gorm:"index"` // Added index for faster author lookups
 	Tags        []TagModel     `gorm:"many2many:article_tags;"`
 	Comments    []CommentModel `gorm:"ForeignKey:ArticleID"`
+	Status      string         `gorm:"column:status;size:16;index;default:'published'"`
+	// When the article went or goes live, nil for a draft
+	PublishedAt *time.Time `gorm:"column:published_at;index"`
 }
 
 type ArticleUserModel struct {
@@ -50,6 +62,48 @@ type CommentModel struct {
 	Author    ArticleUserModel
 	AuthorID  uint
 	Body      string `gorm:"size:2048"`
+	// The body rendered by common.RenderMarkdown when the comment is written
+	BodyHTML *string `gorm:"column:body_html;type:text"`
+	// The comment this one replies to, 0 for a comment on the article itself
+	ParentID uint `gorm:"column:parent_id;index;default:0"`
+}
+
+// Migrate the tables of the package. The articles written before the publishing workflow are
+// published since their creation, see migrateArticleRevisions, migrateArticleSlugs,
+// migrateRenderedHTML and migrateArticleSearch for the revisions, the old slugs, the rendered bodies
+// and the search index.
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&ArticleModel{})
+	db.AutoMigrate(&TagModel{})
+	db.AutoMigrate(&FavoriteModel{})
+	db.AutoMigrate(&ArticleUserModel{})
+	db.AutoMigrate(&CommentModel{})
+	db.Model(&ArticleModel{}).Where("status = ? AND published_at IS NULL", ArticleStatusPublished).
+		UpdateColumn("published_at", gorm.Expr("created_at"))
+	migrateArticleRevisions(db)
+	migrateArticleSlugs(db)
+	migrateRenderedHTML(db)
+	migrateArticleSearch(db)
+}
+
+// The condition of the articles anybody could read. A scheduled article is live as soon as its
+// time has come, even before the scheduler flips its status.
+const publishedCondition = "(status = ? OR (status = ? AND published_at <= ?))"
+
+func publishedArticles(db *gorm.DB) *gorm.DB {
+	return db.Where(publishedCondition, ArticleStatusPublished, ArticleStatusScheduled, time.Now())
+}
+
+func (article ArticleModel) isPublished() bool {
+	switch article.Status {
+	case ArticleStatusPublished:
+		return true
+	case ArticleStatusScheduled:
+		return article.PublishedAt != nil && !article.PublishedAt.After(time.Now())
+	}
+	return false
 }
 
 func GetArticleUserModel(userModel users.UserModel) ArticleUserModel {
@@ -118,7 +172,10 @@ func FindOneArticle(condition interface{}) (ArticleModel, error) {
 			tx.Rollback()
 		}
 	}()
-	tx.Where(condition).First(&model)
+	if err := tx.Where(condition).First(&model).Error; err != nil {
+		tx.Rollback()
+		return model, err
+	}
 	tx.Model(&model).Related(&model.Author, "Author")
 	tx.Model(&model.Author).Related(&model.Author.UserModel)
 	tx.Model(&model).Related(&model.Tags, "Tags")
@@ -126,10 +183,32 @@ func FindOneArticle(condition interface{}) (ArticleModel, error) {
 	return model, err
 }
 
-func (self *ArticleModel) getComments() error {
+func FindOneComment(condition interface{}) (CommentModel, error) {
 	db := common.GetDB()
+	var model CommentModel
 	tx := db.Begin()
-	tx.Model(self).Related(&self.Comments, "Comments")
+	if err := tx.Where(condition).First(&model).Error; err != nil {
+		tx.Rollback()
+		return model, err
+	}
+	tx.Model(&model).Related(&model.Author, "Author")
+	tx.Model(&model.Author).Related(&model.Author.UserModel)
+	err := tx.Commit().Error
+	return model, err
+}
+
+// The comments of authors the viewer blocks or mutes are left out. Deleted comments with replies are kept
+// as tombstones, see threadComments.
+func (self *ArticleModel) getComments(viewer users.UserModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	query := tx.Unscoped().Where(&CommentModel{ArticleID: self.ID})
+	if hidden := hiddenAuthorIDs(tx, viewer); len(hidden) > 0 {
+		query = query.Where("author_id NOT IN (?)", hidden)
+	}
+	var models []CommentModel
+	query.Order("id").Find(&models)
+	self.Comments = threadComments(models)
 	for i, _ := range self.Comments {
 		tx.Model(&self.Comments[i]).Related(&self.Comments[i].Author, "Author")
 		tx.Model(&self.Comments[i].Author).Related(&self.Comments[i].Author.UserModel)
@@ -138,6 +217,17 @@ func (self *ArticleModel) getComments() error {
 	return err
 }
 
+// The ArticleUserModel ids of the users the viewer blocks or mutes
+func hiddenAuthorIDs(db *gorm.DB, viewer users.UserModel) []uint {
+	var ids []uint
+	hiddenUserIDs := viewer.HiddenUserIDs()
+	if len(hiddenUserIDs) == 0 {
+		return ids
+	}
+	db.Model(&ArticleUserModel{}).Where("user_model_id IN (?)", hiddenUserIDs).Pluck("id", &ids)
+	return ids
+}
+
 func getAllTags() ([]TagModel, error) {
 	db := common.GetDB()
 	var models []TagModel
@@ -165,8 +255,10 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 		var tagModel TagModel
 		tx.Where(TagModel{Tag: tag}).First(&tagModel)
 		if tagModel.ID != 0 {
-			tx.Model(&tagModel).Offset(offset_int).Limit(limit_int).Related(&models, "ArticleModels")
-			count = tx.Model(&tagModel).Association("ArticleModels").Count()
+			tagged := tx.Table("article_tags").Select("article_model_id").Where("tag_model_id = ?", tagModel.ID).SubQuery()
+			query := publishedArticles(tx.Model(&ArticleModel{})).Where("id IN (?)", tagged)
+			query.Count(&count)
+			query.Offset(offset_int).Limit(limit_int).Find(&models)
 		}
 	} else if author != "" {
 		var userModel users.UserModel
@@ -174,8 +266,9 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 		articleUserModel := GetArticleUserModel(userModel)
 
 		if articleUserModel.ID != 0 {
-			count = tx.Model(&articleUserModel).Association("ArticleModels").Count()
-			tx.Model(&articleUserModel).Offset(offset_int).Limit(limit_int).Related(&models, "ArticleModels")
+			query := publishedArticles(tx.Model(&ArticleModel{})).Where(&ArticleModel{AuthorID: articleUserModel.ID})
+			query.Count(&count)
+			query.Offset(offset_int).Limit(limit_int).Find(&models)
 		}
 	} else if favorited != "" {
 		var userModel users.UserModel
@@ -183,11 +276,13 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 		articleUserModel := GetArticleUserModel(userModel)
 		if articleUserModel.ID != 0 {
 			var favoriteModels []FavoriteModel
-			tx.Where(FavoriteModel{
+			published := publishedArticles(tx.Model(&ArticleModel{})).Select("id").SubQuery()
+			query := tx.Model(&FavoriteModel{}).Where(FavoriteModel{
 				FavoriteByID: articleUserModel.ID,
-			}).Offset(offset_int).Limit(limit_int).Find(&favoriteModels)
+			}).Where("favorite_id IN (?)", published)
+			query.Offset(offset_int).Limit(limit_int).Find(&favoriteModels)
 
-			count = tx.Model(&articleUserModel).Association("FavoriteModels").Count()
+			query.Count(&count)
 			for _, favorite := range favoriteModels {
 				var model ArticleModel
 				tx.Model(&favorite).Related(&model, "Favorite")
@@ -195,8 +290,8 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 			}
 		}
 	} else {
-		db.Model(&models).Count(&count)
-		db.Offset(offset_int).Limit(limit_int).Find(&models)
+		publishedArticles(db.Model(&models)).Count(&count)
+		publishedArticles(db).Offset(offset_int).Limit(limit_int).Find(&models)
 	}
 
 	for i, _ := range models {
@@ -223,14 +318,23 @@ func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleMod
 	}
 
 	tx := db.Begin()
-	followings := self.UserModel.GetFollowings()
-	var articleUserModels []uint
-	for _, following := range followings {
-		articleUserModel := GetArticleUserModel(following)
-		articleUserModels = append(articleUserModels, articleUserModel.ID)
+	// Muted or blocked users stay out of the feed even when they are still followed
+	hidden := map[uint]bool{}
+	for _, id := range self.UserModel.HiddenUserIDs() {
+		hidden[id] = true
+	}
+	var followingIDs []uint
+	for _, following := range self.UserModel.GetFollowings() {
+		if !hidden[following.ID] {
+			followingIDs = append(followingIDs, following.ID)
+		}
 	}
+	var articleUserModels []uint
+	tx.Model(&ArticleUserModel{}).Where("user_model_id IN (?)", followingIDs).Pluck("id", &articleUserModels)
 
-	tx.Where("author_id in (?)", articleUserModels).Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
+	query := publishedArticles(tx.Model(&ArticleModel{})).Where("author_id in (?)", articleUserModels)
+	query.Count(&count)
+	query.Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
 
 	for i, _ := range models {
 		tx.Model(&models[i]).Related(&models[i].Author, "Author")
@@ -241,6 +345,27 @@ func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleMod
 	return models, count, err
 }
 
+// The drafts and scheduled articles of the author, latest change first
+func (self *ArticleUserModel) GetDraftArticles(limit, offset int) ([]ArticleModel, int, error) {
+	db := common.GetDB()
+	var models []ArticleModel
+	var count int
+
+	tx := db.Begin()
+	query := tx.Model(&ArticleModel{}).Where(&ArticleModel{AuthorID: self.ID}).
+		Where("NOT "+publishedCondition, ArticleStatusPublished, ArticleStatusScheduled, time.Now())
+	query.Count(&count)
+	query.Order("updated_at desc").Offset(offset).Limit(limit).Find(&models)
+
+	for i, _ := range models {
+		tx.Model(&models[i]).Related(&models[i].Author, "Author")
+		tx.Model(&models[i].Author).Related(&models[i].Author.UserModel)
+		tx.Model(&models[i]).Related(&models[i].Tags, "Tags")
+	}
+	err := tx.Commit().Error
+	return models, count, err
+}
+
 func (model *ArticleModel) setTags(tags []string) error {
 	db := common.GetDB()
 	var tagList []TagModel
@@ -256,12 +381,21 @@ func (model *ArticleModel) setTags(tags []string) error {
 	return nil
 }
 
-func (model *ArticleModel) Update(data interface{}) error {
-	db := common.GetDB()
+// The db could be a transaction, so that the update is written together with the status, slug and revision.
+func (model *ArticleModel) Update(db *gorm.DB, data interface{}) error {
 	err := db.Model(model).Update(data).Error
 	return err
 }
 
+// Update uses the struct and skips its zero values, a draft needs its published_at set back to NULL.
+func (model *ArticleModel) setStatus(db *gorm.DB, status string, publishedAt *time.Time) error {
+	err := db.Model(model).Updates(map[string]interface{}{
+		"status":       status,
+		"published_at": publishedAt,
+	}).Error
+	return err
+}
+
 func DeleteArticleModel(condition interface{}) error {
 	db := common.GetDB()
 	err := db.Where(condition).Delete(ArticleModel{}).Error
@@ -0,0 +1,67 @@
+package articles
+
+import (
+	"realworld-backend/users"
+)
+
+// Policies decide who may read or mutate an article or a comment.
+//
+// Handlers should ask the policy before touching the database and answer 403 when it refuses:
+//
+//	if !canUpdateArticle(myUserModel, articleModel) { ... }
+//
+// An article the user could not read answers 404 instead, as if it did not exist.
+
+// Published articles are public, drafts and scheduled articles are only seen by their author.
+func canReadArticle(user users.UserModel, article ArticleModel) bool {
+	if article.isPublished() {
+		return true
+	}
+	return user.ID != 0 && article.Author.UserModelID == user.ID
+}
+
+// Only the author of an article, or a role granting articles:update:any, could edit it.
+func canUpdateArticle(user users.UserModel, article ArticleModel) bool {
+	if user.ID == 0 {
+		return false
+	}
+	return article.Author.UserModelID == user.ID || user.HasPermission(users.PermissionArticlesUpdateAny)
+}
+
+// Restoring an old revision is left to the author alone, whatever the roles of the user.
+func canRestoreArticleRevision(user users.UserModel, article ArticleModel) bool {
+	return user.ID != 0 && article.Author.UserModelID == user.ID
+}
+
+// Only the author of an article, or a role granting articles:delete:any, could delete it.
+func canDeleteArticle(user users.UserModel, article ArticleModel) bool {
+	if user.ID == 0 {
+		return false
+	}
+	return article.Author.UserModelID == user.ID || user.HasPermission(users.PermissionArticlesDeleteAny)
+}
+
+// A comment could be deleted by its own author, by the author of the article it belongs to,
+// or by a role granting comments:delete:any.
+func canDeleteComment(user users.UserModel, article ArticleModel, comment CommentModel) bool {
+	if user.ID == 0 {
+		return false
+	}
+	if comment.ArticleID != article.ID {
+		return false
+	}
+	if comment.Author.UserModelID == user.ID || article.Author.UserModelID == user.ID {
+		return true
+	}
+	return user.HasPermission(users.PermissionCommentsDeleteAny)
+}
+
+// Whoever could delete an article could take it out of the trash.
+func canRestoreArticle(user users.UserModel, article ArticleModel) bool {
+	return canDeleteArticle(user, article)
+}
+
+// Whoever could delete a comment could take it out of the trash.
+func canRestoreComment(user users.UserModel, article ArticleModel, comment CommentModel) bool {
+	return canDeleteComment(user, article, comment)
+}
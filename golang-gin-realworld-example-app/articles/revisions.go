@@ -0,0 +1,198 @@
+package articles
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pmezard/go-difflib/difflib"
+
+	"realworld-backend/common"
+)
+
+// A snapshot of the title, description and body of an article. The first one is stored with the article,
+// then one for every change of its content. There is no UpdatedAt or DeletedAt, a revision is never
+// changed: restoring an old revision stores a new one.
+type ArticleRevisionModel struct {
+	ID          uint      `gorm:"primary_key"`
+	CreatedAt   time.Time `gorm:"index"`
+	ArticleID   uint      `gorm:"unique_index:idx_article_revision"`
+	Number      uint      `gorm:"unique_index:idx_article_revision"`
+	Title       string
+	Description string `gorm:"size:2048"`
+	Body        string `gorm:"size:2048"`
+	// The body rendered by common.RenderMarkdown, NULL until the migration renders an older revision
+	BodyHTML *string `gorm:"column:body_html;type:text"`
+	// Who made the change
+	Author   ArticleUserModel
+	AuthorID uint `gorm:"index"`
+	// The number of the revision brought back by a restore, 0 for an edit
+	RestoredFrom uint
+}
+
+// The articles written before the revisions get their current content as revision 1.
+func migrateArticleRevisions(db *gorm.DB) {
+	db.AutoMigrate(&ArticleRevisionModel{})
+	db.Exec(`INSERT INTO article_revision_models (created_at, article_id, number, title, description, body, author_id, restored_from)
+		SELECT updated_at, id, 1, title, description, body, author_id, 0 FROM article_models
+		WHERE id NOT IN (SELECT article_id FROM article_revision_models)`)
+}
+
+// Whether the title, description or body differ, the other fields are not part of a revision
+func (article ArticleModel) sameContent(other ArticleModel) bool {
+	return article.Title == other.Title && article.Description == other.Description && article.Body == other.Body
+}
+
+// You could store the current content of the article as its next revision, in the transaction which
+// changed the content.
+//
+//	revision, err := articleModel.saveRevision(tx, GetArticleUserModel(myUserModel), 0)
+func (article ArticleModel) saveRevision(tx *gorm.DB, author ArticleUserModel, restoredFrom uint) (ArticleRevisionModel, error) {
+	bodyHTML := common.RenderMarkdown(article.Body)
+	revision := ArticleRevisionModel{
+		ArticleID:    article.ID,
+		Title:        article.Title,
+		Description:  article.Description,
+		Body:         article.Body,
+		BodyHTML:     &bodyHTML,
+		AuthorID:     author.ID,
+		RestoredFrom: restoredFrom,
+	}
+	var last struct{ Number uint }
+	tx.Model(&ArticleRevisionModel{}).Where("article_id = ?", article.ID).Select("COALESCE(MAX(number), 0) AS number").Scan(&last)
+	revision.Number = last.Number + 1
+	err := tx.Create(&revision).Error
+	return revision, err
+}
+
+// The revisions of the article, latest first, with the count of all of them
+func (article ArticleModel) getRevisions(limit, offset int) ([]ArticleRevisionModel, int, error) {
+	db := common.GetDB()
+	var models []ArticleRevisionModel
+	var count int
+
+	tx := db.Begin()
+	query := tx.Model(&ArticleRevisionModel{}).Where(&ArticleRevisionModel{ArticleID: article.ID})
+	query.Count(&count)
+	query.Order("number desc").Offset(offset).Limit(limit).Find(&models)
+	for i, _ := range models {
+		tx.Model(&models[i]).Related(&models[i].Author, "Author")
+		tx.Model(&models[i].Author).Related(&models[i].Author.UserModel)
+	}
+	err := tx.Commit().Error
+	return models, count, err
+}
+
+// One revision of the article, 0 is the latest one
+func (article ArticleModel) findRevision(number uint) (ArticleRevisionModel, error) {
+	db := common.GetDB()
+	var model ArticleRevisionModel
+	query := db.Where(&ArticleRevisionModel{ArticleID: article.ID, Number: number})
+	if number == 0 {
+		query = query.Order("number desc")
+	}
+	err := query.First(&model).Error
+	return model, err
+}
+
+// You could bring back the content of an old revision, it is stored again as the latest revision
+// so that the history is never rewritten.
+//
+//	revision, err := articleModel.restoreRevision(oldRevision, GetArticleUserModel(myUserModel))
+func (article *ArticleModel) restoreRevision(old ArticleRevisionModel, author ArticleUserModel) (ArticleRevisionModel, error) {
+	db := common.GetDB()
+	tx := db.Begin()
+	// A map so that an empty description or body is written too
+	err := tx.Model(article).Updates(map[string]interface{}{
+		"title":       old.Title,
+		"description": old.Description,
+		"body":        old.Body,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return ArticleRevisionModel{}, err
+	}
+	revision, err := article.saveRevision(tx, author, old.Number)
+	if err != nil {
+		tx.Rollback()
+		return revision, err
+	}
+	err = tx.Commit().Error
+	return revision, err
+}
+
+// The formats of a diff between two revisions
+const (
+	RevisionDiffUnified = "unified"
+	RevisionDiffWords   = "words"
+)
+
+// One piece of a word diff: "equal", "insert" or "delete" and its text, whitespace included.
+type DiffChange struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// A unified diff of two texts line by line, empty when they are the same
+func unifiedDiff(from, to, fromName, toName string) string {
+	if from == to {
+		return ""
+	}
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        diffLines(from),
+		B:        diffLines(to),
+		FromFile: fromName,
+		ToFile:   toName,
+		Context:  3,
+	})
+	return diff
+}
+
+// The lines of a text, each ending with its newline. Unlike difflib.SplitLines, a text ending with
+// a newline has no extra empty line.
+func diffLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+var diffWords = regexp.MustCompile(`\s+|[^\s]+`)
+
+// The changes from one text to the other word by word. Joining the "equal" and "delete" texts gives
+// back from, the "equal" and "insert" ones give to.
+func wordDiff(from, to string) []DiffChange {
+	a := diffWords.FindAllString(from, -1)
+	b := diffWords.FindAllString(to, -1)
+	changes := []DiffChange{}
+	add := func(op string, words []string) {
+		if len(words) == 0 {
+			return
+		}
+		text := strings.Join(words, "")
+		if last := len(changes) - 1; last >= 0 && changes[last].Op == op {
+			changes[last].Text += text
+			return
+		}
+		changes = append(changes, DiffChange{Op: op, Text: text})
+	}
+	// Without the junk heuristic, common words of a long body would not be matched at all
+	matcher := difflib.NewMatcherWithJunk(a, b, false, nil)
+	for _, code := range matcher.GetOpCodes() {
+		switch code.Tag {
+		case 'e':
+			add("equal", a[code.I1:code.I2])
+		case 'd':
+			add("delete", a[code.I1:code.I2])
+		case 'i':
+			add("insert", b[code.J1:code.J2])
+		case 'r':
+			add("delete", a[code.I1:code.I2])
+			add("insert", b[code.J1:code.J2])
+		}
+	}
+	return changes
+}
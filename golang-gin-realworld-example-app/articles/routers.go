@@ -2,6 +2,8 @@ package articles
 
 import (
 	"errors"
+	"fmt"
+	"realworld-backend/audit"
 	"realworld-backend/common"
 	"realworld-backend/users"
 	"github.com/gin-gonic/gin"
@@ -10,19 +12,26 @@ import (
 )
 
 func ArticlesRegister(router *gin.RouterGroup) {
-	router.POST("/", ArticleCreate)
-	router.PUT("/:slug", ArticleUpdate)
-	router.DELETE("/:slug", ArticleDelete)
-	router.POST("/:slug/favorite", ArticleFavorite)
-	router.DELETE("/:slug/favorite", ArticleUnfavorite)
-	router.POST("/:slug/comments", ArticleCommentCreate)
-	router.DELETE("/:slug/comments/:id", ArticleCommentDelete)
+	router.Use(ArticleSlugRedirect())
+	router.POST("/", users.RequireScopes(users.ScopeArticlesWrite), users.RequireVerifiedEmail(), ArticleCreate)
+	router.PUT("/:slug", users.RequireScopes(users.ScopeArticlesWrite), users.RequireVerifiedEmail(), ArticleUpdate)
+	router.DELETE("/:slug", users.RequireScopes(users.ScopeArticlesWrite), ArticleDelete)
+	router.POST("/:slug/restore", users.RequireScopes(users.ScopeArticlesWrite), ArticleRestore)
+	router.POST("/:slug/favorite", users.RequireScopes(users.ScopeArticlesWrite), ArticleFavorite)
+	router.DELETE("/:slug/favorite", users.RequireScopes(users.ScopeArticlesWrite), ArticleUnfavorite)
+	router.POST("/:slug/comments", users.RequireScopes(users.ScopeCommentsWrite), users.RequireVerifiedEmail(), ArticleCommentCreate)
+	router.DELETE("/:slug/comments/:id", users.RequireScopes(users.ScopeCommentsWrite), ArticleCommentDelete)
+	router.POST("/:slug/comments/:id/restore", users.RequireScopes(users.ScopeCommentsWrite), ArticleCommentRestore)
+	router.POST("/:slug/revisions/:number/restore", users.RequireScopes(users.ScopeArticlesWrite), users.RequireVerifiedEmail(), ArticleRevisionRestore)
 }
 
 func ArticlesAnonymousRegister(router *gin.RouterGroup) {
+	router.Use(ArticleSlugRedirect())
 	router.GET("/", ArticleList)
 	router.GET("/:slug", ArticleRetrieve)
 	router.GET("/:slug/comments", ArticleCommentList)
+	router.GET("/:slug/revisions", ArticleRevisionList)
+	router.GET("/:slug/revisions/diff", ArticleRevisionDiff)
 }
 
 func TagsAnonymousRegister(router *gin.RouterGroup) {
@@ -35,9 +44,31 @@ func ArticleCreate(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
-	//fmt.Println(articleModelValidator.articleModel.Author.UserModel)
+	if err := articleModelValidator.checkSchedule(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("publishedAt", err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	articleModelValidator.articleModel.Author = GetArticleUserModel(myUserModel)
 
-	if err := SaveOne(&articleModelValidator.articleModel); err != nil {
+	slugText := articleModelValidator.Article.Slug
+	if slugText == "" {
+		slugText = articleModelValidator.Article.Title
+	}
+	// The article and its first revision are written together
+	tx := common.GetDB().Begin()
+	articleModelValidator.articleModel.Slug = uniqueSlug(tx, slugText, 0)
+	if err := tx.Save(&articleModelValidator.articleModel).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if _, err := articleModelValidator.articleModel.saveRevision(tx, articleModelValidator.articleModel.Author, 0); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -79,14 +110,92 @@ func ArticleFeed(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount})
 }
 
+// The drafts and scheduled articles of the current user, GET /api/articles/drafts
+func ArticleDraftList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if myUserModel.ID == 0 {
+		c.AbortWithError(http.StatusUnauthorized, errors.New("{error : \"Require auth!\"}"))
+		return
+	}
+	limit, offset := common.Pagination(c)
+	articleUserModel := GetArticleUserModel(myUserModel)
+	articleModels, modelCount, err := articleUserModel.GetDraftArticles(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
+		return
+	}
+	serializer := ArticlesSerializer{c, articleModels}
+	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount})
+}
+
+// The deleted articles and comments of the current user, GET /api/articles/trash. The limit and offset
+// apply to both lists.
+func ArticleTrashList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if myUserModel.ID == 0 {
+		c.AbortWithError(http.StatusUnauthorized, errors.New("{error : \"Require auth!\"}"))
+		return
+	}
+	limit, offset := common.Pagination(c)
+	articleUserModel := GetArticleUserModel(myUserModel)
+	articleModels, articleCount, err := articleUserModel.GetTrashedArticles(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("trash", errors.New("Database error")))
+		return
+	}
+	commentModels, commentCount, err := articleUserModel.GetTrashedComments(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("trash", errors.New("Database error")))
+		return
+	}
+	articlesSerializer := TrashedArticlesSerializer{c, articleModels}
+	commentsSerializer := TrashedCommentsSerializer{c, commentModels}
+	c.JSON(http.StatusOK, gin.H{
+		"articles":      articlesSerializer.Response(),
+		"articlesCount": articleCount,
+		"comments":      commentsSerializer.Response(),
+		"commentsCount": commentCount,
+	})
+}
+
+// The published articles matching all the words of `q`, best match first, GET /api/articles/search?q=
+func ArticleSearch(c *gin.Context) {
+	query := c.Query("q")
+	if len(searchTerms(query)) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("q", errors.New("can't be blank")))
+		return
+	}
+	limit, offset := common.Pagination(c)
+	results, count, err := SearchArticles(query, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("search", err))
+		return
+	}
+	serializer := ArticleSearchResultsSerializer{c, results}
+	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": count})
+}
+
 func ArticleRetrieve(c *gin.Context) {
 	slug := c.Param("slug")
 	if slug == "feed" {
 		ArticleFeed(c)
 		return
 	}
+	if slug == "drafts" {
+		ArticleDraftList(c)
+		return
+	}
+	if slug == "search" {
+		ArticleSearch(c)
+		return
+	}
+	if slug == "trash" {
+		ArticleTrashList(c)
+		return
+	}
 	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err != nil || !canReadArticle(myUserModel, articleModel) {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
@@ -101,14 +210,54 @@ func ArticleUpdate(c *gin.Context) {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	if !canUpdateArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusForbidden, common.NewError("articles", errors.New("You are not the author of this article")))
+		return
+	}
 	articleModelValidator := NewArticleModelValidatorFillWith(articleModel)
 	if err := articleModelValidator.Bind(c); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
+	if err := articleModelValidator.checkSchedule(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("publishedAt", err))
+		return
+	}
 
 	articleModelValidator.articleModel.ID = articleModel.ID
-	if err := articleModel.Update(articleModelValidator.articleModel); err != nil {
+	contentChanged := !articleModel.sameContent(articleModelValidator.articleModel)
+	// The content, status, slug and revision are written together, or not at all
+	tx := common.GetDB().Begin()
+	if err := articleModel.Update(tx, articleModelValidator.articleModel); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if err := articleModel.setStatus(tx, articleModelValidator.articleModel.Status, articleModelValidator.articleModel.PublishedAt); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if articleModelValidator.Article.Slug != "" {
+		if err := articleModel.changeSlug(tx, articleModelValidator.Article.Slug); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	}
+	if contentChanged {
+		if _, err := articleModel.saveRevision(tx, GetArticleUserModel(myUserModel), 0); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -118,14 +267,52 @@ func ArticleUpdate(c *gin.Context) {
 
 func ArticleDelete(c *gin.Context) {
 	slug := c.Param("slug")
-	err := DeleteArticleModel(&ArticleModel{Slug: slug})
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	if !canDeleteArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusForbidden, common.NewError("articles", errors.New("You are not the author of this article")))
+		return
+	}
+	err = DeleteArticleModel(&ArticleModel{Slug: slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
+	audit.Record(c, audit.Event{Action: audit.ActionArticleDelete, TargetType: audit.TargetArticle, TargetID: articleModel.ID,
+		Details: map[string]interface{}{"slug": articleModel.Slug, "title": articleModel.Title, "authorId": articleModel.Author.UserModelID}})
 	c.JSON(http.StatusOK, gin.H{"article": "Delete success"})
 }
 
+// Take a deleted article out of the trash, POST /api/articles/:slug/restore
+func ArticleRestore(c *gin.Context) {
+	articleModel, err := findTrashedArticle(c.Param("slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canRestoreArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusForbidden, common.NewError("articles", errors.New("You are not the author of this article")))
+		return
+	}
+	if err := articleModel.restore(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionArticleRestore, TargetType: audit.TargetArticle, TargetID: articleModel.ID,
+		Details: map[string]interface{}{"slug": articleModel.Slug, "authorId": articleModel.Author.UserModelID}})
+	serializer := ArticleSerializer{c, articleModel}
+	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+}
+
 func ArticleFavorite(c *gin.Context) {
 	slug := c.Param("slug")
 	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
@@ -134,6 +321,10 @@ func ArticleFavorite(c *gin.Context) {
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
 	err = articleModel.favoriteBy(GetArticleUserModel(myUserModel))
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
@@ -147,6 +338,10 @@ func ArticleUnfavorite(c *gin.Context) {
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
 	err = articleModel.unFavoriteBy(GetArticleUserModel(myUserModel))
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
@@ -159,12 +354,35 @@ func ArticleCommentCreate(c *gin.Context) {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
 		return
 	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
+	if articleModel.Author.UserModel.IsBlocking(myUserModel) {
+		c.JSON(http.StatusForbidden, common.NewError("comment", errors.New("You are blocked by the author of this article")))
+		return
+	}
 	commentModelValidator := NewCommentModelValidator()
 	if err := commentModelValidator.Bind(c); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
 	commentModelValidator.commentModel.Article = articleModel
+	if parentID := commentModelValidator.commentModel.ParentID; parentID != 0 {
+		// A reply stays in the thread of its article, under a comment which is not deleted
+		condition := CommentModel{ArticleID: articleModel.ID}
+		condition.ID = parentID
+		parentModel, err := FindOneComment(&condition)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("parentId", errors.New("should be a comment of this article")))
+			return
+		}
+		if !parentModel.canReply(common.GetDB()) {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("parentId", fmt.Errorf("replies could not nest deeper than %d", common.CommentMaxDepth)))
+			return
+		}
+	}
 
 	if err := SaveOne(&commentModelValidator.commentModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
@@ -175,20 +393,84 @@ func ArticleCommentCreate(c *gin.Context) {
 }
 
 func ArticleCommentDelete(c *gin.Context) {
+	slug := c.Param("slug")
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
 	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	id := uint(id64)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
 		return
 	}
-	err = DeleteCommentModel([]uint{id})
+	// The comment has to belong to the article in the path, otherwise any slug could be used to reach it.
+	condition := CommentModel{ArticleID: articleModel.ID}
+	condition.ID = id
+	commentModel, err := FindOneComment(&condition)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
 		return
 	}
+	if !canDeleteComment(myUserModel, articleModel, commentModel) {
+		c.JSON(http.StatusForbidden, common.NewError("comment", errors.New("You are not allowed to delete this comment")))
+		return
+	}
+	err = DeleteCommentModel([]uint{commentModel.ID})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionCommentDelete, TargetType: audit.TargetComment, TargetID: commentModel.ID,
+		Details: map[string]interface{}{"article": articleModel.Slug, "authorId": commentModel.Author.UserModelID}})
 	c.JSON(http.StatusOK, gin.H{"comment": "Delete success"})
 }
 
+// Take a deleted comment out of the trash, POST /api/articles/:slug/comments/:id/restore. The article
+// has to be out of the trash first.
+func ArticleCommentRestore(c *gin.Context) {
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: c.Param("slug")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	commentModel, err := findTrashedComment(articleModel.ID, uint(id64))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	if !canRestoreComment(myUserModel, articleModel, commentModel) {
+		c.JSON(http.StatusForbidden, common.NewError("comment", errors.New("You are not allowed to restore this comment")))
+		return
+	}
+	if err := commentModel.restore(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionCommentRestore, TargetType: audit.TargetComment, TargetID: commentModel.ID,
+		Details: map[string]interface{}{"article": articleModel.Slug, "authorId": commentModel.Author.UserModelID}})
+	serializer := CommentSerializer{c, commentModel}
+	c.JSON(http.StatusOK, gin.H{"comment": serializer.Response()})
+}
+
+// The comments of an article, `format` is "flat" (the default), every comment with the id of its parent,
+// or "tree", the replies nested in their parent. Deleted comments with replies are tombstones.
 func ArticleCommentList(c *gin.Context) {
 	slug := c.Param("slug")
 	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
@@ -196,14 +478,142 @@ func ArticleCommentList(c *gin.Context) {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Invalid slug")))
 		return
 	}
-	err = articleModel.getComments()
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Invalid slug")))
+		return
+	}
+	format := c.DefaultQuery("format", CommentFormatFlat)
+	if format != CommentFormatFlat && format != CommentFormatTree {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("comments", errors.New("format should be flat or tree")))
+		return
+	}
+	err = articleModel.getComments(myUserModel)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Database error")))
 		return
 	}
+	if format == CommentFormatTree {
+		serializer := CommentTreeSerializer{c, articleModel.Comments}
+		c.JSON(http.StatusOK, gin.H{"comments": serializer.Response()})
+		return
+	}
 	serializer := CommentsSerializer{c, articleModel.Comments}
 	c.JSON(http.StatusOK, gin.H{"comments": serializer.Response()})
 }
+
+// The revisions of an article, latest first, as {"revisions": [...], "revisionsCount": n}
+func ArticleRevisionList(c *gin.Context) {
+	slug := c.Param("slug")
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err != nil || !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid slug")))
+		return
+	}
+	limit, offset := common.Pagination(c)
+	revisionModels, count, err := articleModel.getRevisions(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Database error")))
+		return
+	}
+	serializer := RevisionsSerializer{c, revisionModels}
+	c.JSON(http.StatusOK, gin.H{"revisions": serializer.Response(), "revisionsCount": count})
+}
+
+// Read a revision number of the query, 0 when it is not given
+func revisionNumberFromQuery(c *gin.Context, name string) (uint, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || number == 0 {
+		return 0, errors.New(name + " should be a revision number")
+	}
+	return uint(number), nil
+}
+
+// The changes between the revisions `from` and `to` of the query, by default the latest revision and
+// the one before it. `format` is "unified" (the default) or "words".
+func ArticleRevisionDiff(c *gin.Context) {
+	slug := c.Param("slug")
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err != nil || !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid slug")))
+		return
+	}
+	format := c.DefaultQuery("format", RevisionDiffUnified)
+	if format != RevisionDiffUnified && format != RevisionDiffWords {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("revisions", errors.New("format should be unified or words")))
+		return
+	}
+	fromNumber, err := revisionNumberFromQuery(c, "from")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("revisions", err))
+		return
+	}
+	toNumber, err := revisionNumberFromQuery(c, "to")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("revisions", err))
+		return
+	}
+	to, err := articleModel.findRevision(toNumber)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid revision")))
+		return
+	}
+	// The first revision has nothing before it and is compared with itself
+	from := to
+	if fromNumber == 0 && to.Number > 1 {
+		fromNumber = to.Number - 1
+	}
+	if fromNumber != 0 {
+		if from, err = articleModel.findRevision(fromNumber); err != nil {
+			c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid revision")))
+			return
+		}
+	}
+	serializer := RevisionDiffSerializer{from, to, format}
+	c.JSON(http.StatusOK, gin.H{"diff": serializer.Response()})
+}
+
+// Bring back the content of an old revision as a new revision, only the author could do it
+func ArticleRevisionRestore(c *gin.Context) {
+	slug := c.Param("slug")
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid slug")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !canReadArticle(myUserModel, articleModel) {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid slug")))
+		return
+	}
+	if !canRestoreArticleRevision(myUserModel, articleModel) {
+		c.JSON(http.StatusForbidden, common.NewError("revisions", errors.New("You are not the author of this article")))
+		return
+	}
+	number, err := strconv.ParseUint(c.Param("number"), 10, 32)
+	if err != nil || number == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid revision")))
+		return
+	}
+	revisionModel, err := articleModel.findRevision(uint(number))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid revision")))
+		return
+	}
+	if _, err := articleModel.restoreRevision(revisionModel, GetArticleUserModel(myUserModel)); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ArticleSerializer{c, articleModel}
+	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+}
+
 func TagList(c *gin.Context) {
 	tagModels, err := getAllTags()
 	if err != nil {
@@ -0,0 +1,51 @@
+package articles
+
+import (
+	"log"
+	"time"
+
+	"realworld-backend/common"
+)
+
+// You could publish the scheduled articles whose time has come, it returns how many were published.
+//
+//	count, err := articles.PublishDueArticles(time.Now())
+func PublishDueArticles(now time.Time) (int64, error) {
+	db := common.GetDB()
+	result := db.Model(&ArticleModel{}).
+		Where("status = ? AND published_at <= ?", ArticleStatusScheduled, now).
+		Update("status", ArticleStatusPublished)
+	return result.RowsAffected, result.Error
+}
+
+// You could run PublishDueArticles every interval in the background until stop is called.
+//
+//	stop := articles.StartPublishScheduler(common.ArticlePublishInterval)
+//	defer stop()
+func StartPublishScheduler(interval time.Duration) (stop func()) {
+	return every(interval, func(now time.Time) {
+		if _, err := PublishDueArticles(now); err != nil {
+			log.Printf("scheduled articles could not be published: %v", err)
+		}
+	})
+}
+
+// Run the job every interval in a goroutine until stop is called
+func every(interval time.Duration, job func(now time.Time)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				job(now)
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
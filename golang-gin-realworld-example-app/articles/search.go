@@ -0,0 +1,306 @@
+package articles
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+// Full text search runs on a SQLite FTS5 table when the driver has it, build with
+//
+//	go build -tags sqlite_fts5
+//
+// Without it the search falls back to LIKE, unranked and slower but with the same results format.
+var searchFTS5 bool
+
+// The index holds one row per article, its rowid is the id of the article. Triggers keep it in sync with
+// the articles and their tags, whatever code changes them. Soft deleted articles are left out.
+const searchIndexRow = `INSERT INTO article_search (rowid, title, description, body, tags)
+	SELECT article_models.id, article_models.title, article_models.description, article_models.body,
+		COALESCE((SELECT group_concat(tag_models.tag, ' ') FROM article_tags
+			JOIN tag_models ON tag_models.id = article_tags.tag_model_id
+			WHERE article_tags.article_model_id = article_models.id), '')
+	FROM article_models WHERE article_models.deleted_at IS NULL`
+
+var searchTriggers = map[string]string{
+	"article_search_insert": `AFTER INSERT ON article_models BEGIN ` +
+		searchIndexRow + ` AND article_models.id = new.id; END`,
+	"article_search_update": `AFTER UPDATE ON article_models BEGIN
+		DELETE FROM article_search WHERE rowid = old.id; ` +
+		searchIndexRow + ` AND article_models.id = new.id; END`,
+	"article_search_delete": `AFTER DELETE ON article_models BEGIN
+		DELETE FROM article_search WHERE rowid = old.id; END`,
+	"article_search_tag_insert": `AFTER INSERT ON article_tags BEGIN
+		DELETE FROM article_search WHERE rowid = new.article_model_id; ` +
+		searchIndexRow + ` AND article_models.id = new.article_model_id; END`,
+	"article_search_tag_delete": `AFTER DELETE ON article_tags BEGIN
+		DELETE FROM article_search WHERE rowid = old.article_model_id; ` +
+		searchIndexRow + ` AND article_models.id = old.article_model_id; END`,
+}
+
+// Create the FTS5 table and its triggers, an empty index is filled from the articles.
+func migrateArticleSearch(db *gorm.DB) {
+	var available struct{ Used bool }
+	err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5') AS used").Scan(&available).Error
+	if err == nil && !available.Used {
+		err = fmt.Errorf("no such module: fts5")
+	}
+	if err == nil {
+		err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS article_search
+			USING fts5(title, description, body, tags, tokenize = 'porter unicode61')`).Error
+	}
+	if err != nil {
+		fmt.Println("Full text search is not available, build with -tags sqlite_fts5 to enable it:", err)
+		searchFTS5 = false
+		// The triggers of a database indexed by a FTS5 build would make every write of an article fail,
+		// the index is stale from now on and needs the search-rebuild command once FTS5 is back.
+		for name := range searchTriggers {
+			db.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s", name))
+		}
+		return
+	}
+	searchFTS5 = true
+	for name, trigger := range searchTriggers {
+		db.Exec(fmt.Sprintf("CREATE TRIGGER IF NOT EXISTS %s %s", name, trigger))
+	}
+	var indexed int
+	db.Table("article_search").Count(&indexed)
+	if indexed == 0 {
+		RebuildSearchIndex()
+	}
+}
+
+// You could fill the index again from the articles, e.g. after restoring a backup. It returns the number
+// of articles indexed.
+//
+//	count, err := articles.RebuildSearchIndex()
+func RebuildSearchIndex() (int, error) {
+	if !searchFTS5 {
+		return 0, fmt.Errorf("full text search is not available, build with -tags sqlite_fts5")
+	}
+	tx := common.GetDB().Begin()
+	if err := tx.Exec("DELETE FROM article_search").Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Exec(searchIndexRow).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	var count int
+	tx.Table("article_search").Count(&count)
+	return count, tx.Commit().Error
+}
+
+// An article found by a search with the matching part of its text
+type ArticleSearchResult struct {
+	ArticleModel
+	// HTML escaped text with the matched terms in <mark> elements
+	Snippet string
+}
+
+// The words of a query, quotes are part of the FTS5 syntax and only separate words here
+func searchTerms(query string) []string {
+	return strings.Fields(strings.ReplaceAll(query, `"`, " "))
+}
+
+// Every term has to match, a term is a word or the beginning of one.
+func ftsMatchExpression(terms []string) string {
+	var parts []string
+	for _, term := range terms {
+		parts = append(parts, `"`+term+`"*`)
+	}
+	return strings.Join(parts, " ")
+}
+
+// The snippet markers are control characters so that the text could be escaped before they become <mark>
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+func markSnippet(text string) string {
+	text = html.EscapeString(text)
+	text = strings.ReplaceAll(text, snippetStart, "<mark>")
+	return strings.ReplaceAll(text, snippetEnd, "</mark>")
+}
+
+// You could search the published articles for all the words of the query, best matches first,
+// with the count of all the matches.
+//
+//	results, count, err := articles.SearchArticles("gin middleware", 20, 0)
+func SearchArticles(query string, limit, offset int) ([]ArticleSearchResult, int, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []ArticleSearchResult{}, 0, nil
+	}
+	if searchFTS5 {
+		return searchArticlesFTS5(terms, limit, offset)
+	}
+	return searchArticlesLike(terms, limit, offset)
+}
+
+func searchArticlesFTS5(terms []string, limit, offset int) ([]ArticleSearchResult, int, error) {
+	db := common.GetDB()
+	var count int
+	var matches []struct {
+		ID      uint
+		Snippet string
+	}
+	// bm25 weights the columns: title, description, body, tags
+	query := publishedArticles(db.Table("article_search").
+		Joins("JOIN article_models ON article_models.id = article_search.rowid").
+		Where("article_search MATCH ?", ftsMatchExpression(terms)).
+		Where("article_models.deleted_at IS NULL"))
+	if err := query.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Select("article_search.rowid AS id, snippet(article_search, -1, ?, ?, '…', 24) AS snippet", snippetStart, snippetEnd).
+		Order("bm25(article_search, 10.0, 4.0, 1.0, 6.0)").Offset(offset).Limit(limit).Scan(&matches).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	var ids []uint
+	snippets := map[uint]string{}
+	for _, match := range matches {
+		ids = append(ids, match.ID)
+		snippets[match.ID] = markSnippet(match.Snippet)
+	}
+	results, err := loadSearchResults(ids, func(article ArticleModel) string { return snippets[article.ID] })
+	return results, count, err
+}
+
+// Escape the wildcards of LIKE, the pattern uses \ as its escape character
+func likePattern(term string) string {
+	term = strings.ReplaceAll(term, `\`, `\\`)
+	term = strings.ReplaceAll(term, "%", `\%`)
+	term = strings.ReplaceAll(term, "_", `\_`)
+	return "%" + term + "%"
+}
+
+func searchArticlesLike(terms []string, limit, offset int) ([]ArticleSearchResult, int, error) {
+	db := common.GetDB()
+	var count int
+	query := publishedArticles(db.Model(&ArticleModel{}))
+	for _, term := range terms {
+		pattern := likePattern(term)
+		tagged := db.Table("article_tags").Select("article_tags.article_model_id").
+			Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+			Where(`tag_models.tag LIKE ? ESCAPE '\'`, pattern).SubQuery()
+		query = query.Where(`(title LIKE ? ESCAPE '\' OR description LIKE ? ESCAPE '\' OR body LIKE ? ESCAPE '\' OR id IN (?))`,
+			pattern, pattern, pattern, tagged)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	var ids []uint
+	if err := query.Order("updated_at desc").Offset(offset).Limit(limit).Pluck("id", &ids).Error; err != nil {
+		return nil, 0, err
+	}
+	results, err := loadSearchResults(ids, func(article ArticleModel) string { return likeSnippet(article, terms) })
+	return results, count, err
+}
+
+// How many characters of text a LIKE snippet keeps around the first match
+const likeSnippetRadius = 60
+
+// The first field with a match, cut around the match, with every term marked like the FTS5 snippets
+func likeSnippet(article ArticleModel, terms []string) string {
+	for _, text := range []string{article.Body, article.Description, article.Title} {
+		start := -1
+		for _, term := range terms {
+			if i := indexFold(text, term, 0); i >= 0 && (start < 0 || i < start) {
+				start = i
+			}
+		}
+		if start < 0 {
+			continue
+		}
+		from, to := start-likeSnippetRadius, start+likeSnippetRadius
+		prefix, suffix := "…", "…"
+		if from <= 0 {
+			from, prefix = 0, ""
+		}
+		if to >= len(text) {
+			to, suffix = len(text), ""
+		}
+		for from > 0 && !utf8.RuneStart(text[from]) {
+			from--
+		}
+		for to < len(text) && !utf8.RuneStart(text[to]) {
+			to++
+		}
+		return prefix + markTerms(text[from:to], terms) + suffix
+	}
+	return ""
+}
+
+// The byte index of the first case insensitive occurrence of term in text at or after from, -1 if none
+func indexFold(text, term string, from int) int {
+	for i := from; term != "" && i+len(term) <= len(text); i++ {
+		if utf8.RuneStart(text[i]) && strings.EqualFold(text[i:i+len(term)], term) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Escape the text and wrap every case insensitive occurrence of the terms in <mark>
+func markTerms(text string, terms []string) string {
+	marked := make([]bool, len(text))
+	for _, term := range terms {
+		for i := indexFold(text, term, 0); i >= 0; i = indexFold(text, term, i+len(term)) {
+			for k := i; k < i+len(term); k++ {
+				marked[k] = true
+			}
+		}
+	}
+	var b strings.Builder
+	inside := false
+	for i := 0; i < len(text); i++ {
+		if marked[i] != inside {
+			inside = marked[i]
+			if inside {
+				b.WriteString(snippetStart)
+			} else {
+				b.WriteString(snippetEnd)
+			}
+		}
+		b.WriteByte(text[i])
+	}
+	if inside {
+		b.WriteString(snippetEnd)
+	}
+	return markSnippet(b.String())
+}
+
+// Load the articles in the order of the ids, with their author and tags
+func loadSearchResults(ids []uint, snippet func(ArticleModel) string) ([]ArticleSearchResult, error) {
+	results := []ArticleSearchResult{}
+	if len(ids) == 0 {
+		return results, nil
+	}
+	db := common.GetDB()
+	var models []ArticleModel
+	tx := db.Begin()
+	tx.Where("id IN (?)", ids).Find(&models)
+	byID := map[uint]ArticleModel{}
+	for _, model := range models {
+		tx.Model(&model).Related(&model.Author, "Author")
+		tx.Model(&model.Author).Related(&model.Author.UserModel)
+		tx.Model(&model).Related(&model.Tags, "Tags")
+		byID[model.ID] = model
+	}
+	err := tx.Commit().Error
+	for _, id := range ids {
+		if model, ok := byID[id]; ok {
+			results = append(results, ArticleSearchResult{model, snippet(model)})
+		}
+	}
+	return results, err
+}
@@ -1,7 +1,8 @@
 package articles
 
 import (
-	"github.com/gosimple/slug"
+	"fmt"
+	"realworld-backend/common"
 	"realworld-backend/users"
 	"github.com/gin-gonic/gin"
 )
@@ -39,6 +40,44 @@ func (s *ArticleUserSerializer) Response() users.ProfileResponse {
 	return response.Response()
 }
 
+// The profiles of many authors serialized together, looked up by the id of their user. A list does not
+// make more queries for its authors when it grows, see users.ProfilesSerializer.
+func authorProfiles(c *gin.Context, authors []ArticleUserModel) map[uint]users.ProfileResponse {
+	listed := map[uint]bool{}
+	userModels := []users.UserModel{}
+	for _, author := range authors {
+		if !listed[author.UserModel.ID] {
+			listed[author.UserModel.ID] = true
+			userModels = append(userModels, author.UserModel)
+		}
+	}
+	serializer := users.ProfilesSerializer{c, userModels}
+	profiles := map[uint]users.ProfileResponse{}
+	for i, profile := range serializer.Response() {
+		profiles[userModels[i].ID] = profile
+	}
+	return profiles
+}
+
+func articleAuthors(articles []ArticleModel) []ArticleUserModel {
+	authors := make([]ArticleUserModel, 0, len(articles))
+	for _, article := range articles {
+		authors = append(authors, article.Author)
+	}
+	return authors
+}
+
+// The authors of the comments, a deleted comment is a tombstone without author
+func commentAuthors(comments []CommentModel) []ArticleUserModel {
+	authors := make([]ArticleUserModel, 0, len(comments))
+	for _, comment := range comments {
+		if comment.DeletedAt == nil {
+			authors = append(authors, comment.Author)
+		}
+	}
+	return authors
+}
+
 type ArticleSerializer struct {
 	C *gin.Context
 	ArticleModel
@@ -50,12 +89,15 @@ type ArticleResponse struct {
 	Slug           string                `json:"slug"`
 	Description    string                `json:"description"`
 	Body           string                `json:"body"`
+	BodyHTML       string                `json:"bodyHtml,omitempty"`
 	CreatedAt      string                `json:"createdAt"`
 	UpdatedAt      string                `json:"updatedAt"`
 	Author         users.ProfileResponse `json:"author"`
 	Tags           []string              `json:"tagList"`
 	Favorite       bool                  `json:"favorited"`
 	FavoritesCount uint                  `json:"favoritesCount"`
+	Status         string                `json:"status"`
+	PublishedAt    *string               `json:"publishedAt"`
 }
 
 type ArticlesSerializer struct {
@@ -64,20 +106,33 @@ type ArticlesSerializer struct {
 }
 
 func (s *ArticleSerializer) Response() ArticleResponse {
-	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
 	authorSerializer := ArticleUserSerializer{s.C, s.Author}
+	return s.response(authorSerializer.Response())
+}
+
+// Same as Response, with the profile of the author given, see authorProfiles
+func (s *ArticleSerializer) response(author users.ProfileResponse) ArticleResponse {
+	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
 	response := ArticleResponse{
 		ID:          s.ID,
-		Slug:        slug.Make(s.Title),
+		Slug:        s.Slug,
 		Title:       s.Title,
 		Description: s.Description,
 		Body:        s.Body,
 		CreatedAt:   s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		//UpdatedAt:      s.UpdatedAt.UTC().Format(time.RFC3339Nano),
 		UpdatedAt:      s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
-		Author:         authorSerializer.Response(),
+		Author:         author,
 		Favorite:       s.isFavoriteBy(GetArticleUserModel(myUserModel)),
 		FavoritesCount: s.favoritesCount(),
+		Status:         s.Status,
+	}
+	if s.PublishedAt != nil {
+		publishedAt := s.PublishedAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.PublishedAt = &publishedAt
+	}
+	if wantsHTML(s.C) {
+		response.BodyHTML = s.bodyHTML()
 	}
 	response.Tags = make([]string, 0)
 	for _, tag := range s.Tags {
@@ -88,10 +143,62 @@ func (s *ArticleSerializer) Response() ArticleResponse {
 }
 
 func (s *ArticlesSerializer) Response() []ArticleResponse {
+	profiles := authorProfiles(s.C, articleAuthors(s.Articles))
 	response := []ArticleResponse{}
 	for _, article := range s.Articles {
 		serializer := ArticleSerializer{s.C, article}
-		response = append(response, serializer.Response())
+		response = append(response, serializer.response(profiles[article.Author.UserModel.ID]))
+	}
+	return response
+}
+
+type ArticleSearchResultsSerializer struct {
+	C       *gin.Context
+	Results []ArticleSearchResult
+}
+
+// An article with the part of its text matching the search, the terms are in <mark> elements
+type ArticleSearchResponse struct {
+	ArticleResponse
+	Snippet string `json:"snippet"`
+}
+
+func (s *ArticleSearchResultsSerializer) Response() []ArticleSearchResponse {
+	authors := make([]ArticleUserModel, 0, len(s.Results))
+	for _, result := range s.Results {
+		authors = append(authors, result.Author)
+	}
+	profiles := authorProfiles(s.C, authors)
+	response := []ArticleSearchResponse{}
+	for _, result := range s.Results {
+		serializer := ArticleSerializer{s.C, result.ArticleModel}
+		response = append(response, ArticleSearchResponse{serializer.response(profiles[result.Author.UserModel.ID]), result.Snippet})
+	}
+	return response
+}
+
+type TrashedArticlesSerializer struct {
+	C        *gin.Context
+	Articles []ArticleModel
+}
+
+// An article in the trash, with when it was deleted and when it is removed for good
+type TrashedArticleResponse struct {
+	ArticleResponse
+	DeletedAt string `json:"deletedAt"`
+	PurgeAt   string `json:"purgeAt"`
+}
+
+func (s *TrashedArticlesSerializer) Response() []TrashedArticleResponse {
+	profiles := authorProfiles(s.C, articleAuthors(s.Articles))
+	response := []TrashedArticleResponse{}
+	for _, article := range s.Articles {
+		serializer := ArticleSerializer{s.C, article}
+		response = append(response, TrashedArticleResponse{
+			ArticleResponse: serializer.response(profiles[article.Author.UserModel.ID]),
+			DeletedAt:       article.DeletedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			PurgeAt:         trashPurgeTime(article.DeletedAt).UTC().Format("2006-01-02T15:04:05.999Z"),
+		})
 	}
 	return response
 }
@@ -109,28 +216,231 @@ type CommentsSerializer struct {
 type CommentResponse struct {
 	ID        uint                  `json:"id"`
 	Body      string                `json:"body"`
+	BodyHTML  string                `json:"bodyHtml,omitempty"`
 	CreatedAt string                `json:"createdAt"`
 	UpdatedAt string                `json:"updatedAt"`
 	Author    users.ProfileResponse `json:"author"`
+	// The id of the comment replied to, null for a comment on the article itself
+	ParentID *uint `json:"parentId"`
+	// A tombstone: the comment is deleted but its replies are not
+	Deleted bool              `json:"deleted,omitempty"`
+	Replies []CommentResponse `json:"replies,omitempty"`
 }
 
 func (s *CommentSerializer) Response() CommentResponse {
 	authorSerializer := ArticleUserSerializer{s.C, s.Author}
+	return s.response(authorSerializer.Response())
+}
+
+// Same as Response, with the profile of the author given, see authorProfiles
+func (s *CommentSerializer) response(author users.ProfileResponse) CommentResponse {
 	response := CommentResponse{
 		ID:        s.ID,
 		Body:      s.Body,
 		CreatedAt: s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		UpdatedAt: s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
-		Author:    authorSerializer.Response(),
+		Author:    author,
+	}
+	if s.ParentID != 0 {
+		parentID := s.ParentID
+		response.ParentID = &parentID
+	}
+	if wantsHTML(s.C) {
+		if s.CommentModel.BodyHTML != nil {
+			response.BodyHTML = *s.CommentModel.BodyHTML
+		} else {
+			response.BodyHTML = common.RenderMarkdown(s.Body)
+		}
+	}
+	return response
+}
+
+// A comment of a thread, a deleted one keeps its place but neither its body nor its author.
+// The profiles are the ones of authorProfiles.
+func (s *CommentSerializer) threadResponse(profiles map[uint]users.ProfileResponse) CommentResponse {
+	if s.DeletedAt == nil {
+		return s.response(profiles[s.Author.UserModel.ID])
+	}
+	response := CommentResponse{
+		ID:        s.ID,
+		Body:      CommentTombstone,
+		CreatedAt: s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		UpdatedAt: s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Deleted:   true,
+	}
+	if s.ParentID != 0 {
+		parentID := s.ParentID
+		response.ParentID = &parentID
+	}
+	if wantsHTML(s.C) {
+		response.BodyHTML = common.RenderMarkdown(CommentTombstone)
 	}
 	return response
 }
 
 func (s *CommentsSerializer) Response() []CommentResponse {
+	profiles := authorProfiles(s.C, commentAuthors(s.Comments))
 	response := []CommentResponse{}
 	for _, comment := range s.Comments {
 		serializer := CommentSerializer{s.C, comment}
-		response = append(response, serializer.Response())
+		response = append(response, serializer.threadResponse(profiles))
+	}
+	return response
+}
+
+type CommentTreeSerializer struct {
+	C        *gin.Context
+	Comments []CommentModel
+}
+
+// The comments on the article with their replies nested in them. A reply whose parent is not in the list,
+// e.g. a comment of a muted user, is shown at the top.
+func (s *CommentTreeSerializer) Response() []CommentResponse {
+	listed := map[uint]bool{}
+	for _, comment := range s.Comments {
+		listed[comment.ID] = true
+	}
+	var roots []CommentModel
+	replies := map[uint][]CommentModel{}
+	for _, comment := range s.Comments {
+		if comment.ParentID != 0 && listed[comment.ParentID] {
+			replies[comment.ParentID] = append(replies[comment.ParentID], comment)
+		} else {
+			roots = append(roots, comment)
+		}
+	}
+	return s.nest(roots, replies, authorProfiles(s.C, commentAuthors(s.Comments)))
+}
+
+func (s *CommentTreeSerializer) nest(comments []CommentModel, replies map[uint][]CommentModel, profiles map[uint]users.ProfileResponse) []CommentResponse {
+	response := []CommentResponse{}
+	for _, comment := range comments {
+		serializer := CommentSerializer{s.C, comment}
+		item := serializer.threadResponse(profiles)
+		item.Replies = s.nest(replies[comment.ID], replies, profiles)
+		response = append(response, item)
+	}
+	return response
+}
+
+type TrashedCommentsSerializer struct {
+	C        *gin.Context
+	Comments []CommentModel
+}
+
+// A comment in the trash, with the slug of its article, when it was deleted and when it is removed for good
+type TrashedCommentResponse struct {
+	CommentResponse
+	Article   string `json:"article"`
+	DeletedAt string `json:"deletedAt"`
+	PurgeAt   string `json:"purgeAt"`
+}
+
+func (s *TrashedCommentsSerializer) Response() []TrashedCommentResponse {
+	authors := make([]ArticleUserModel, 0, len(s.Comments))
+	for _, comment := range s.Comments {
+		authors = append(authors, comment.Author)
+	}
+	profiles := authorProfiles(s.C, authors)
+	response := []TrashedCommentResponse{}
+	for _, comment := range s.Comments {
+		serializer := CommentSerializer{s.C, comment}
+		response = append(response, TrashedCommentResponse{
+			CommentResponse: serializer.response(profiles[comment.Author.UserModel.ID]),
+			Article:         comment.Article.Slug,
+			DeletedAt:       comment.DeletedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+			PurgeAt:         trashPurgeTime(comment.DeletedAt).UTC().Format("2006-01-02T15:04:05.999Z"),
+		})
+	}
+	return response
+}
+
+type RevisionSerializer struct {
+	C *gin.Context
+	ArticleRevisionModel
+}
+
+type RevisionsSerializer struct {
+	C         *gin.Context
+	Revisions []ArticleRevisionModel
+}
+
+type RevisionResponse struct {
+	Number       uint                  `json:"number"`
+	Title        string                `json:"title"`
+	Description  string                `json:"description"`
+	Body         string                `json:"body"`
+	CreatedAt    string                `json:"createdAt"`
+	Author       users.ProfileResponse `json:"author"`
+	RestoredFrom uint                  `json:"restoredFrom,omitempty"`
+}
+
+func (s *RevisionSerializer) Response() RevisionResponse {
+	authorSerializer := ArticleUserSerializer{s.C, s.Author}
+	return s.response(authorSerializer.Response())
+}
+
+// Same as Response, with the profile of the author given, see authorProfiles
+func (s *RevisionSerializer) response(author users.ProfileResponse) RevisionResponse {
+	return RevisionResponse{
+		Number:       s.Number,
+		Title:        s.Title,
+		Description:  s.Description,
+		Body:         s.Body,
+		CreatedAt:    s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Author:       author,
+		RestoredFrom: s.RestoredFrom,
+	}
+}
+
+func (s *RevisionsSerializer) Response() []RevisionResponse {
+	authors := make([]ArticleUserModel, 0, len(s.Revisions))
+	for _, revision := range s.Revisions {
+		authors = append(authors, revision.Author)
+	}
+	profiles := authorProfiles(s.C, authors)
+	response := []RevisionResponse{}
+	for _, revision := range s.Revisions {
+		serializer := RevisionSerializer{s.C, revision}
+		response = append(response, serializer.response(profiles[revision.Author.UserModel.ID]))
+	}
+	return response
+}
+
+// The changes between two revisions field by field, a unified diff string or a list of DiffChange
+type RevisionDiffResponse struct {
+	From        uint        `json:"from"`
+	To          uint        `json:"to"`
+	Format      string      `json:"format"`
+	Title       interface{} `json:"title"`
+	Description interface{} `json:"description"`
+	Body        interface{} `json:"body"`
+}
+
+type RevisionDiffSerializer struct {
+	From   ArticleRevisionModel
+	To     ArticleRevisionModel
+	Format string
+}
+
+func (s *RevisionDiffSerializer) Response() RevisionDiffResponse {
+	response := RevisionDiffResponse{From: s.From.Number, To: s.To.Number, Format: s.Format}
+	fields := []struct {
+		name     string
+		from, to string
+		target   *interface{}
+	}{
+		{"title", s.From.Title, s.To.Title, &response.Title},
+		{"description", s.From.Description, s.To.Description, &response.Description},
+		{"body", s.From.Body, s.To.Body, &response.Body},
+	}
+	for _, field := range fields {
+		if s.Format == RevisionDiffWords {
+			*field.target = wordDiff(field.from, field.to)
+		} else {
+			*field.target = unifiedDiff(field.from, field.to,
+				fmt.Sprintf("revision %d/%s", s.From.Number, field.name), fmt.Sprintf("revision %d/%s", s.To.Number, field.name))
+		}
 	}
 	return response
 }
@@ -0,0 +1,132 @@
+package articles
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gosimple/slug"
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+// A slug an article had before it was renamed. Old links keep working: a request to one of them is
+// redirected to the current slug of the article, see ArticleSlugRedirect.
+type ArticleSlugModel struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	Slug      string `gorm:"unique_index"`
+	ArticleID uint   `gorm:"index"`
+}
+
+// The paths under /api/articles which are not articles
+var reservedSlugs = map[string]bool{"feed": true, "drafts": true, "search": true, "trash": true}
+
+func migrateArticleSlugs(db *gorm.DB) {
+	db.AutoMigrate(&ArticleSlugModel{})
+}
+
+// The slug of the text, followed by -2, -3... when it belongs to another article, soft deleted ones
+// included, or is an old slug of another article.
+//
+//	articleModel.Slug = uniqueSlug(db, articleModel.Title, 0)
+func uniqueSlug(db *gorm.DB, text string, articleID uint) string {
+	base := slug.Make(text)
+	if base == "" {
+		base = "article"
+	}
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(base) + "-%"
+	var current, old []string
+	db.Unscoped().Model(&ArticleModel{}).Where(`(slug = ? OR slug LIKE ? ESCAPE '\') AND id <> ?`, base, pattern, articleID).
+		Pluck("slug", &current)
+	db.Model(&ArticleSlugModel{}).Where(`(slug = ? OR slug LIKE ? ESCAPE '\') AND article_id <> ?`, base, pattern, articleID).
+		Pluck("slug", &old)
+	taken := map[string]bool{}
+	for _, s := range append(current, old...) {
+		taken[s] = true
+	}
+	candidate := base
+	for n := 2; taken[candidate] || reservedSlugs[candidate]; n++ {
+		candidate = fmt.Sprintf("%s-%d", base, n)
+	}
+	return candidate
+}
+
+// You could give the article a new slug made of the text, the current one is kept as an old slug.
+// The title of an article could change without touching its slug, a new slug is only made on demand.
+// Run it in a transaction, the old slug and the new one are written apart.
+//
+//	err := articleModel.changeSlug(tx, "a better slug")
+func (article *ArticleModel) changeSlug(tx *gorm.DB, text string) error {
+	newSlug := uniqueSlug(tx, text, article.ID)
+	if newSlug == article.Slug {
+		return nil
+	}
+	// Going back to an old slug makes it the current one again
+	if err := tx.Where("slug = ?", newSlug).Delete(ArticleSlugModel{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Create(&ArticleSlugModel{Slug: article.Slug, ArticleID: article.ID}).Error; err != nil {
+		return err
+	}
+	return tx.Model(article).Update("slug", newSlug).Error
+}
+
+// The article an old slug belonged to
+func findArticleBySlugHistory(db *gorm.DB, old string) (ArticleModel, error) {
+	var history ArticleSlugModel
+	var model ArticleModel
+	if err := db.Where("slug = ?", old).First(&history).Error; err != nil {
+		return model, err
+	}
+	if err := db.Where("id = ?", history.ArticleID).First(&model).Error; err != nil {
+		return model, err
+	}
+	err := db.Model(&model).Related(&model.Author, "Author").Error
+	return model, err
+}
+
+// Requests to an old slug are redirected to the same path under the current slug of the article, with
+// 301 for reads and 308 for the other methods so that clients repeat the method and the body.
+// An article the user could not read is left to the handler, which answers 404.
+func ArticleSlugRedirect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		old := c.Param("slug")
+		if old == "" || reservedSlugs[old] {
+			return
+		}
+		db := common.GetDB()
+		var count int
+		db.Unscoped().Model(&ArticleModel{}).Where("slug = ?", old).Count(&count)
+		if count > 0 {
+			return
+		}
+		articleModel, err := findArticleBySlugHistory(db, old)
+		myUserModel, _ := c.MustGet("my_user_model").(users.UserModel)
+		if err != nil || !canReadArticle(myUserModel, articleModel) {
+			return
+		}
+		target := c.FullPath()
+		for _, param := range c.Params {
+			value := url.PathEscape(param.Value)
+			if param.Key == "slug" {
+				value = articleModel.Slug
+			}
+			target = strings.Replace(target, ":"+param.Key, value, 1)
+		}
+		if c.Request.URL.RawQuery != "" {
+			target += "?" + c.Request.URL.RawQuery
+		}
+		status := http.StatusMovedPermanently
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		c.Redirect(status, target)
+		c.Abort()
+	}
+}
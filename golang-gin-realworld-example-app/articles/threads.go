@@ -0,0 +1,90 @@
+package articles
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+// The formats of a comment list: a flat list in the order of the comments, each with the id of its parent,
+// or a tree of the comments on the article with their replies nested in them.
+const (
+	CommentFormatFlat = "flat"
+	CommentFormatTree = "tree"
+)
+
+// The body standing for a deleted comment which still has replies
+const CommentTombstone = "[deleted]"
+
+// The depth of the comment in its thread, 1 for a comment on the article itself. Deleted parents count too,
+// they are still part of the thread.
+func (comment CommentModel) depth(db *gorm.DB) int {
+	depth := 1
+	for parentID := comment.ParentID; parentID != 0 && depth <= common.CommentMaxDepth; depth++ {
+		var parent CommentModel
+		if err := db.Unscoped().Select("id, parent_id").Where("id = ?", parentID).First(&parent).Error; err != nil {
+			break
+		}
+		parentID = parent.ParentID
+	}
+	return depth
+}
+
+// Whether a reply to the comment would still be within common.CommentMaxDepth
+func (comment CommentModel) canReply(db *gorm.DB) bool {
+	return comment.depth(db) < common.CommentMaxDepth
+}
+
+// The comments which are not deleted, and the deleted ones which still have replies among them, in the
+// order given. The deleted ones become tombstones in the responses so that the threads stay intact.
+func threadComments(models []CommentModel) []CommentModel {
+	byID := map[uint]CommentModel{}
+	for _, model := range models {
+		byID[model.ID] = model
+	}
+	keep := map[uint]bool{}
+	for _, model := range models {
+		if model.DeletedAt != nil {
+			continue
+		}
+		keep[model.ID] = true
+		for parentID := model.ParentID; parentID != 0 && !keep[parentID]; {
+			parent, ok := byID[parentID]
+			if !ok {
+				break
+			}
+			keep[parentID] = true
+			parentID = parent.ParentID
+		}
+	}
+	comments := []CommentModel{}
+	for _, model := range models {
+		if keep[model.ID] {
+			comments = append(comments, model)
+		}
+	}
+	return comments
+}
+
+// Remove for good the comments deleted before the time. A comment which still has replies, deleted or not,
+// stays as the tombstone of its thread with its body cleared, it goes away with its last reply.
+func purgeComments(tx *gorm.DB, before time.Time) (int64, error) {
+	var purged int64
+	for {
+		replied := tx.Unscoped().Model(&CommentModel{}).Select("parent_id").Where("parent_id <> 0").SubQuery()
+		result := tx.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at <= ? AND id NOT IN (?)", before, replied).
+			Delete(CommentModel{})
+		if result.Error != nil {
+			return purged, result.Error
+		}
+		purged += result.RowsAffected
+		if result.RowsAffected == 0 {
+			break
+		}
+	}
+	err := tx.Unscoped().Model(&CommentModel{}).Where("deleted_at IS NOT NULL AND deleted_at <= ?", before).
+		UpdateColumns(map[string]interface{}{"body": "", "body_html": nil}).Error
+	return purged, err
+}
@@ -0,0 +1,178 @@
+package articles
+
+import (
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+// Deleted articles and comments are soft deleted: they wait in the trash of their author, who could restore
+// them, until they are older than common.TrashRetention and the purge removes them for good.
+
+// The deleted articles of the author, the latest deleted first, with the count of all of them
+func (self *ArticleUserModel) GetTrashedArticles(limit, offset int) ([]ArticleModel, int, error) {
+	db := common.GetDB()
+	var models []ArticleModel
+	var count int
+
+	tx := db.Begin()
+	query := tx.Unscoped().Model(&ArticleModel{}).Where("author_id = ? AND deleted_at IS NOT NULL", self.ID)
+	query.Count(&count)
+	query.Order("deleted_at desc").Offset(offset).Limit(limit).Find(&models)
+
+	for i, _ := range models {
+		tx.Model(&models[i]).Related(&models[i].Author, "Author")
+		tx.Model(&models[i].Author).Related(&models[i].Author.UserModel)
+		tx.Model(&models[i]).Related(&models[i].Tags, "Tags")
+	}
+	err := tx.Commit().Error
+	return models, count, err
+}
+
+// The deleted comments of the author, the latest deleted first, with the count of all of them. The comments
+// of a deleted article are left out, they could only come back with the article.
+func (self *ArticleUserModel) GetTrashedComments(limit, offset int) ([]CommentModel, int, error) {
+	db := common.GetDB()
+	var models []CommentModel
+	var count int
+
+	tx := db.Begin()
+	query := tx.Unscoped().Model(&CommentModel{}).
+		Where("author_id = ? AND deleted_at IS NOT NULL", self.ID).
+		Where("article_id IN (?)", tx.Model(&ArticleModel{}).Select("id").SubQuery())
+	query.Count(&count)
+	query.Order("deleted_at desc").Offset(offset).Limit(limit).Find(&models)
+
+	for i, _ := range models {
+		tx.Model(&models[i]).Related(&models[i].Article, "Article")
+		tx.Model(&models[i]).Related(&models[i].Author, "Author")
+		tx.Model(&models[i].Author).Related(&models[i].Author.UserModel)
+	}
+	err := tx.Commit().Error
+	return models, count, err
+}
+
+// A deleted article by its slug, the slug of a deleted article is not given to another one
+func findTrashedArticle(slug string) (ArticleModel, error) {
+	db := common.GetDB()
+	var model ArticleModel
+	tx := db.Begin()
+	if err := tx.Unscoped().Where("slug = ? AND deleted_at IS NOT NULL", slug).First(&model).Error; err != nil {
+		tx.Rollback()
+		return model, err
+	}
+	tx.Model(&model).Related(&model.Author, "Author")
+	tx.Model(&model.Author).Related(&model.Author.UserModel)
+	tx.Model(&model).Related(&model.Tags, "Tags")
+	err := tx.Commit().Error
+	return model, err
+}
+
+// A deleted comment of the article
+func findTrashedComment(articleID, id uint) (CommentModel, error) {
+	db := common.GetDB()
+	var model CommentModel
+	tx := db.Begin()
+	if err := tx.Unscoped().Where("id = ? AND article_id = ? AND deleted_at IS NOT NULL", id, articleID).First(&model).Error; err != nil {
+		tx.Rollback()
+		return model, err
+	}
+	tx.Model(&model).Related(&model.Author, "Author")
+	tx.Model(&model.Author).Related(&model.Author.UserModel)
+	err := tx.Commit().Error
+	return model, err
+}
+
+// When an item deleted at the time leaves the trash for good
+func trashPurgeTime(deletedAt *time.Time) time.Time {
+	if deletedAt == nil {
+		return time.Time{}
+	}
+	return deletedAt.Add(common.TrashRetention)
+}
+
+// Take the article out of the trash, the updated_at of the article is left as it was
+func (article *ArticleModel) restore() error {
+	db := common.GetDB()
+	err := db.Unscoped().Model(article).UpdateColumn("deleted_at", nil).Error
+	if err == nil {
+		article.DeletedAt = nil
+	}
+	return err
+}
+
+// Take the comment out of the trash, the updated_at of the comment is left as it was
+func (comment *CommentModel) restore() error {
+	db := common.GetDB()
+	err := db.Unscoped().Model(comment).UpdateColumn("deleted_at", nil).Error
+	if err == nil {
+		comment.DeletedAt = nil
+	}
+	return err
+}
+
+// Remove the articles for good, with their comments, favorites, tag links, revisions and old slugs.
+// Soft deleted rows are covered as well.
+func purgeArticles(tx *gorm.DB, articleIDs []uint) error {
+	if len(articleIDs) == 0 {
+		return nil
+	}
+	if err := tx.Unscoped().Where("article_id IN (?)", articleIDs).Delete(CommentModel{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Where("favorite_id IN (?)", articleIDs).Delete(FavoriteModel{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec("DELETE FROM article_tags WHERE article_model_id IN (?)", articleIDs).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id IN (?)", articleIDs).Delete(ArticleRevisionModel{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id IN (?)", articleIDs).Delete(ArticleSlugModel{}).Error; err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("id IN (?)", articleIDs).Delete(ArticleModel{}).Error
+}
+
+// You could remove for good the articles and comments deleted before the time. It returns how many
+// articles and comments left the trash, the comments of the purged articles are not counted.
+// Comments with replies stay as tombstones, see purgeComments.
+//
+//	articleCount, commentCount, err := articles.PurgeTrash(time.Now().Add(-common.TrashRetention))
+func PurgeTrash(before time.Time) (int, int64, error) {
+	db := common.GetDB()
+	var articleIDs []uint
+	err := db.Unscoped().Model(&ArticleModel{}).Where("deleted_at IS NOT NULL AND deleted_at <= ?", before).
+		Pluck("id", &articleIDs).Error
+	if err != nil {
+		return 0, 0, err
+	}
+	tx := db.Begin()
+	if err := purgeArticles(tx, articleIDs); err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	commentCount, err := purgeComments(tx, before)
+	if err != nil {
+		tx.Rollback()
+		return 0, 0, err
+	}
+	return len(articleIDs), commentCount, tx.Commit().Error
+}
+
+// You could purge the trash every interval in the background until stop is called, the items deleted
+// longer than retention ago are removed.
+//
+//	stop := articles.StartTrashPurger(common.TrashPurgeInterval, common.TrashRetention)
+//	defer stop()
+func StartTrashPurger(interval, retention time.Duration) (stop func()) {
+	return every(interval, func(now time.Time) {
+		if _, _, err := PurgeTrash(now.Add(-retention)); err != nil {
+			log.Printf("the trash could not be purged: %v", err)
+		}
+	})
+}
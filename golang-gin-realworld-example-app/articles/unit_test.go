@@ -1,6 +1,7 @@
 package articles
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -403,3 +404,104 @@ func TestMultipleArticlesCollection(t *testing.T) {
 	asserts.Equal("First Article", articles[0].Title, "First article title should match")
 	asserts.Equal("second-article", articles[1].Slug, "Second article slug should match")
 }
+
+// Test 26: Only published and due scheduled articles are public, drafts are seen by their author
+func TestCanReadArticle(t *testing.T) {
+	asserts := assert.New(t)
+
+	author := users.UserModel{}
+	author.ID = 1
+	reader := users.UserModel{}
+	reader.ID = 2
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	article := newTestArticleModel()
+	article.Author = ArticleUserModel{UserModelID: author.ID}
+	article.Status = ArticleStatusPublished
+	asserts.True(canReadArticle(users.UserModel{}, article))
+
+	article.Status = ArticleStatusScheduled
+	article.PublishedAt = &past
+	asserts.True(canReadArticle(reader, article), "a due article is public before the scheduler runs")
+	article.PublishedAt = &future
+	asserts.False(canReadArticle(reader, article))
+	asserts.True(canReadArticle(author, article))
+
+	article.Status = ArticleStatusDraft
+	article.PublishedAt = nil
+	asserts.False(canReadArticle(users.UserModel{}, article))
+	asserts.False(canReadArticle(reader, article))
+	asserts.True(canReadArticle(author, article))
+}
+
+// Test 27: Word and unified diffs of two texts
+func TestRevisionDiffs(t *testing.T) {
+	asserts := assert.New(t)
+
+	changes := wordDiff("The quick brown fox", "The slow brown fox jumps")
+	asserts.Equal([]DiffChange{
+		{Op: "equal", Text: "The "},
+		{Op: "delete", Text: "quick"},
+		{Op: "insert", Text: "slow"},
+		{Op: "equal", Text: " brown fox"},
+		{Op: "insert", Text: " jumps"},
+	}, changes)
+	asserts.Equal([]DiffChange{{Op: "equal", Text: "same"}}, wordDiff("same", "same"))
+	asserts.Equal([]DiffChange{}, wordDiff("", ""))
+
+	diff := unifiedDiff("line one\nline two\n", "line one\nline 2\n", "revision 1/body", "revision 2/body")
+	asserts.Equal("--- revision 1/body\n+++ revision 2/body\n@@ -1,2 +1,2 @@\n line one\n-line two\n+line 2\n", diff)
+	asserts.Empty(unifiedDiff("same", "same", "a", "b"))
+}
+
+// Test 28: Search queries are reduced to quoted terms and snippets are escaped before they are marked
+func TestSearchHelpers(t *testing.T) {
+	asserts := assert.New(t)
+
+	terms := searchTerms(`gin "middle ware" `)
+	asserts.Equal([]string{"gin", "middle", "ware"}, terms)
+	asserts.Equal(`"gin"* "middle"* "ware"*`, ftsMatchExpression(terms))
+	asserts.Empty(searchTerms(` " `))
+	asserts.Equal(`%50\%\_off%`, likePattern("50%_off"))
+
+	asserts.Equal("a <mark>Gin</mark> &lt;b&gt; and <mark>gin</mark>", markTerms("a Gin <b> and gin", []string{"gin"}))
+	article := newTestArticleModel()
+	article.Body = strings.Repeat("x", 100) + " the Gin framework"
+	asserts.Equal("…"+strings.Repeat("x", 55)+" the <mark>Gin</mark> framework", likeSnippet(article, []string{"gin"}))
+	asserts.Equal("Test Article <mark>Title</mark>", likeSnippet(article, []string{"title"}), "the title is used when the body and description do not match")
+	asserts.Empty(likeSnippet(article, []string{"nothing"}))
+}
+
+// Test 29: Deleted comments are only kept in a thread while some of their replies are not deleted
+func TestThreadComments(t *testing.T) {
+	asserts := assert.New(t)
+
+	deletedAt := time.Now()
+	comment := func(id, parentID uint, deleted bool) CommentModel {
+		model := CommentModel{ParentID: parentID}
+		model.ID = id
+		if deleted {
+			model.DeletedAt = &deletedAt
+		}
+		return model
+	}
+	ids := func(models []CommentModel) []uint {
+		result := []uint{}
+		for _, model := range models {
+			result = append(result, model.ID)
+		}
+		return result
+	}
+
+	asserts.Equal([]uint{1, 2, 3, 5}, ids(threadComments([]CommentModel{
+		comment(1, 0, true),
+		comment(2, 1, true),
+		comment(3, 2, false),
+		comment(4, 1, true),
+		comment(5, 0, false),
+		comment(6, 5, true),
+	})), "the deleted ancestors of a reply stay as tombstones, deleted leaves go away")
+	asserts.Equal([]uint{2}, ids(threadComments([]CommentModel{comment(2, 1, false)})), "a reply to a hidden comment is kept")
+	asserts.Empty(threadComments(nil))
+}
@@ -1,10 +1,11 @@
 package articles
 
 import (
-	"github.com/gosimple/slug"
+	"errors"
 	"realworld-backend/common"
 	"realworld-backend/users"
 	"github.com/gin-gonic/gin"
+	"time"
 )
 
 type ArticleModelValidator struct {
@@ -13,8 +14,16 @@ type ArticleModelValidator struct {
 		Description string   `form:"description" json:"description" binding:"max=2048"`
 		Body        string   `form:"body" json:"body" binding:"max=2048"`
 		Tags        []string `form:"tagList" json:"tagList"`
+		// Made from the title of a new article when empty, an update only changes the slug when it is given
+		Slug string `form:"slug" json:"slug" binding:"max=255"`
+		// Empty publishes a new article and keeps the status of an updated one
+		Status string `form:"status" json:"status" binding:"omitempty,oneof=draft scheduled published"`
+		// Only read for a scheduled article, when it should go live
+		PublishedAt *time.Time `form:"publishedAt" json:"publishedAt"`
 	} `json:"article"`
 	articleModel ArticleModel `json:"-"`
+	// The article before the update, empty for a new one
+	current ArticleModel `json:"-"`
 }
 
 func NewArticleModelValidator() ArticleModelValidator {
@@ -29,28 +38,74 @@ func NewArticleModelValidatorFillWith(articleModel ArticleModel) ArticleModelVal
 	for _, tagModel := range articleModel.Tags {
 		articleModelValidator.Article.Tags = append(articleModelValidator.Article.Tags, tagModel.Tag)
 	}
+	articleModelValidator.current = articleModel
 	return articleModelValidator
 }
 
+// The author is left out, it is set by ArticleCreate and never changed by an update: an user editing the
+// article of someone else with articles:update:any does not become its author.
 func (s *ArticleModelValidator) Bind(c *gin.Context) error {
-	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-
 	err := common.Bind(c, s)
 	if err != nil {
 		return err
 	}
-	s.articleModel.Slug = slug.Make(s.Article.Title)
 	s.articleModel.Title = s.Article.Title
 	s.articleModel.Description = s.Article.Description
 	s.articleModel.Body = s.Article.Body
-	s.articleModel.Author = GetArticleUserModel(myUserModel)
 	s.articleModel.setTags(s.Article.Tags)
+	s.bindStatus()
+	return nil
+}
+
+// A published article keeps its first publication time, a draft has none. An update without a status keeps the
+// status and the publication time of the article.
+func (s *ArticleModelValidator) bindStatus() {
+	now := time.Now()
+	status := s.Article.Status
+	publishedAt := s.current.PublishedAt
+	if status == "" {
+		status = s.current.Status
+	}
+	if s.Article.PublishedAt != nil {
+		// Stored in the zone of the other times of the database, they are compared as strings
+		local := s.Article.PublishedAt.Local()
+		publishedAt = &local
+	}
+	switch status {
+	case ArticleStatusDraft:
+		s.articleModel.Status = ArticleStatusDraft
+		s.articleModel.PublishedAt = nil
+	case ArticleStatusScheduled:
+		s.articleModel.Status = ArticleStatusScheduled
+		s.articleModel.PublishedAt = publishedAt
+	default:
+		s.articleModel.Status = ArticleStatusPublished
+		s.articleModel.PublishedAt = &now
+		if s.current.Status == ArticleStatusPublished && s.current.PublishedAt != nil {
+			s.articleModel.PublishedAt = s.current.PublishedAt
+		} else if publishedAt != nil && publishedAt.Before(now) {
+			s.articleModel.PublishedAt = publishedAt
+		}
+	}
+}
+
+// A scheduled article needs a publication time in the future. It is only checked when the request sets the status
+// or the time, an article whose time passed before the scheduler ran could still be edited.
+func (s *ArticleModelValidator) checkSchedule() error {
+	if s.articleModel.Status != ArticleStatusScheduled || (s.Article.Status == "" && s.Article.PublishedAt == nil) {
+		return nil
+	}
+	if s.articleModel.PublishedAt == nil || !s.articleModel.PublishedAt.After(time.Now()) {
+		return errors.New("should be in the future")
+	}
 	return nil
 }
 
 type CommentModelValidator struct {
 	Comment struct {
 		Body string `form:"body" json:"body" binding:"max=2048"`
+		// The id of the comment replied to, empty for a comment on the article itself
+		ParentID uint `form:"parentId" json:"parentId"`
 	} `json:"comment"`
 	commentModel CommentModel `json:"-"`
 }
@@ -67,6 +122,9 @@ func (s *CommentModelValidator) Bind(c *gin.Context) error {
 		return err
 	}
 	s.commentModel.Body = s.Comment.Body
+	s.commentModel.ParentID = s.Comment.ParentID
+	bodyHTML := common.RenderMarkdown(s.Comment.Body)
+	s.commentModel.BodyHTML = &bodyHTML
 	s.commentModel.Author = GetArticleUserModel(myUserModel)
 	return nil
 }
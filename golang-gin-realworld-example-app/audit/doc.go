@@ -0,0 +1,14 @@
+/*
+The audit module keeping an append-only log of the security relevant events.
+
+It only depends on common, so that users and articles could both record events.
+
+models.go: definition of orm based data model, recording and querying
+
+routers.go: the admin API, the routes are bound by users.AdminRegister
+
+serializers.go: definition the schema of return data
+
+middlewares.go: the request id of every request
+*/
+package audit
@@ -0,0 +1,29 @@
+package audit
+
+import (
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"realworld-backend/common"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// An id sent by a proxy is kept when it looks harmless, so that the logs of both could be matched.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Give every request an id, it is returned in the X-Request-ID header and recorded with the audit events.
+//
+//	r.Use(audit.RequestIDMiddleware())
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = common.RandToken(12)
+		}
+		c.Set("my_request_id", requestID)
+		c.Header(RequestIDHeader, requestID)
+		c.Next()
+	}
+}
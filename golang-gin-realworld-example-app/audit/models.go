@@ -0,0 +1,190 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+// The actions recorded in the log, "<resource>.<verb>"
+const (
+	ActionUserRegister       = "user.register"
+	ActionUserLogin          = "user.login"
+	ActionUserLoginFailed    = "user.login_failed"
+	ActionUserPasswordChange = "user.password_change"
+	ActionUserPasswordReset  = "user.password_reset"
+	ActionUserEmailChange    = "user.email_change"
+	ActionUserDelete         = "user.delete"
+	ActionTokenRefresh       = "token.refresh"
+	ActionTokenCreate        = "token.create"
+	ActionTokenRevoke        = "token.revoke"
+	ActionArticleDelete      = "article.delete"
+	ActionCommentDelete      = "comment.delete"
+	ActionArticleRestore     = "article.restore"
+	ActionCommentRestore     = "comment.restore"
+	ActionProfileFollow      = "profile.follow"
+	ActionProfileUnfollow    = "profile.unfollow"
+	ActionRoleGrant          = "role.grant"
+	ActionRoleRevoke         = "role.revoke"
+	ActionUserUnlock         = "user.unlock"
+)
+
+// The types of the targets
+const (
+	TargetUser    = "user"
+	TargetToken   = "token"
+	TargetArticle = "article"
+	TargetComment = "comment"
+)
+
+// One entry of the log. There is no UpdatedAt or DeletedAt, entries are never changed once written.
+type AuditEventModel struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+	Action    string    `gorm:"column:action;index"`
+	// The user who did it, 0 when nobody is logged in, e.g. a failed login
+	ActorID    uint   `gorm:"column:actor_id;index"`
+	TargetType string `gorm:"column:target_type"`
+	TargetID   string `gorm:"column:target_id"`
+	IP         string `gorm:"column:ip"`
+	RequestID  string `gorm:"column:request_id;index"`
+	// A JSON object with the details of the action, e.g. the previous email
+	Details string `gorm:"column:details;size:4096"`
+}
+
+// Migrate the table, the triggers refuse any UPDATE or DELETE so the log stays append-only
+// even for code that would try.
+func AutoMigrate() {
+	db := common.GetDB()
+	db.AutoMigrate(&AuditEventModel{})
+	for _, statement := range []string{"UPDATE", "DELETE"} {
+		db.Exec(fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS audit_event_models_no_%s BEFORE %s ON audit_event_models
+			BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END`, statement, statement))
+	}
+}
+
+// What happened, the actor, IP and request id are taken from the request.
+type Event struct {
+	Action string
+	// 0 takes the user of the request, set it when the request has no user yet, e.g. a login
+	ActorID    uint
+	TargetType string
+	TargetID   interface{}
+	Details    map[string]interface{}
+}
+
+// You could record an event of the current request. A failure is logged and does not fail the request.
+// The IP is the client IP of gin, only taken from X-Forwarded-For behind common.TrustedProxies.
+//
+//	audit.Record(c, audit.Event{Action: audit.ActionProfileFollow, TargetType: audit.TargetUser, TargetID: userModel.ID})
+func Record(c *gin.Context, event Event) {
+	if event.ActorID == 0 {
+		event.ActorID = c.GetUint("my_user_id")
+	}
+	save(event, c.ClientIP(), c.GetString("my_request_id"))
+}
+
+// You could record an event outside of a request, e.g. a command of the operator. It has no IP and no request id,
+// the actor is 0 unless the event sets one.
+//
+//	audit.RecordWithoutRequest(audit.Event{Action: audit.ActionUserUnlock, TargetType: audit.TargetUser, TargetID: userModel.ID})
+func RecordWithoutRequest(event Event) {
+	save(event, "", "")
+}
+
+func save(event Event, ip string, requestID string) {
+	model := AuditEventModel{
+		Action:     event.Action,
+		ActorID:    event.ActorID,
+		TargetType: event.TargetType,
+		IP:         ip,
+		RequestID:  requestID,
+		Details:    "{}",
+	}
+	if event.TargetID != nil {
+		model.TargetID = fmt.Sprint(event.TargetID)
+	}
+	if len(event.Details) > 0 {
+		if details, err := json.Marshal(event.Details); err == nil {
+			model.Details = string(details)
+		}
+	}
+	if err := common.GetDB().Create(&model).Error; err != nil {
+		log.Printf("audit event could not be recorded: %s %v", event.Action, err)
+	}
+}
+
+// The conditions of a query, the zero value of a field matches everything.
+type Filter struct {
+	Action     string
+	ActorID    uint
+	TargetType string
+	TargetID   string
+	IP         string
+	RequestID  string
+	Since      *time.Time
+	Until      *time.Time
+}
+
+func (f Filter) apply(db *gorm.DB) *gorm.DB {
+	db = db.Model(&AuditEventModel{}).Where(&AuditEventModel{
+		Action:     f.Action,
+		ActorID:    f.ActorID,
+		TargetType: f.TargetType,
+		TargetID:   f.TargetID,
+		IP:         f.IP,
+		RequestID:  f.RequestID,
+	})
+	if f.Since != nil {
+		db = db.Where("created_at >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		db = db.Where("created_at < ?", *f.Until)
+	}
+	return db
+}
+
+// You could find a page of events, latest first, and the count of all matching events.
+//
+//	events, count, err := audit.FindEvents(audit.Filter{Action: audit.ActionUserLoginFailed}, 20, 0)
+func FindEvents(filter Filter, limit, offset int) ([]AuditEventModel, int, error) {
+	var models []AuditEventModel
+	var count int
+	db := common.GetDB()
+	if err := filter.apply(db).Count(&count).Error; err != nil {
+		return models, 0, err
+	}
+	err := filter.apply(db).Order("id DESC").Limit(limit).Offset(offset).Find(&models).Error
+	return models, count, err
+}
+
+// You could write every matching event as JSON Lines, oldest first. The rows are streamed,
+// the whole log is never loaded at once.
+//
+//	err := audit.ExportEvents(w, audit.Filter{ActorID: 1})
+func ExportEvents(w io.Writer, filter Filter) error {
+	db := common.GetDB()
+	rows, err := filter.apply(db).Order("id ASC").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	encoder := json.NewEncoder(w)
+	for rows.Next() {
+		var model AuditEventModel
+		if err := db.ScanRows(rows, &model); err != nil {
+			return err
+		}
+		if err := encoder.Encode(EventSerializer{model}.Response()); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
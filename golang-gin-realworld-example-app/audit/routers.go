@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"realworld-backend/common"
+)
+
+// Read the filter from the query: action, actor, targetType, targetId, ip, requestId,
+// and since/until as RFC 3339 times.
+func filterFromQuery(c *gin.Context) (Filter, error) {
+	filter := Filter{
+		Action:     c.Query("action"),
+		TargetType: c.Query("targetType"),
+		TargetID:   c.Query("targetId"),
+		IP:         c.Query("ip"),
+		RequestID:  c.Query("requestId"),
+	}
+	if actor := c.Query("actor"); actor != "" {
+		actorID, err := strconv.ParseUint(actor, 10, 32)
+		if err != nil || actorID == 0 {
+			return filter, errors.New("actor should be an user id")
+		}
+		filter.ActorID = uint(actorID)
+	}
+	for name, target := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.Query(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s should be a RFC 3339 time", name)
+			}
+			*target = &parsed
+		}
+	}
+	return filter, nil
+}
+
+// A page of the events matching the query, latest first, as {"events": [...], "eventsCount": n}
+func AuditEventList(c *gin.Context) {
+	filter, err := filterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("audit", err))
+		return
+	}
+	limit, offset := common.Pagination(c)
+	events, count, err := FindEvents(filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := EventsSerializer{events}
+	c.JSON(http.StatusOK, gin.H{"events": serializer.Response(), "eventsCount": count})
+}
+
+// Every event matching the query as JSON Lines, oldest first
+func AuditEventExport(c *gin.Context) {
+	filter, err := filterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("audit", err))
+		return
+	}
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"audit-%s.jsonl\"", time.Now().UTC().Format("20060102T150405Z")))
+	c.Status(http.StatusOK)
+	if err := ExportEvents(c.Writer, filter); err != nil {
+		log.Printf("audit export failed: %v", err)
+	}
+}
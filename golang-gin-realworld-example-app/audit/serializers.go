@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"encoding/json"
+)
+
+// The serializer needs no request, the JSON Lines export uses it outside of one.
+type EventSerializer struct {
+	AuditEventModel
+}
+
+type EventsSerializer struct {
+	Events []AuditEventModel
+}
+
+type EventResponse struct {
+	ID         uint            `json:"id"`
+	Action     string          `json:"action"`
+	ActorID    uint            `json:"actorId"`
+	TargetType string          `json:"targetType"`
+	TargetID   string          `json:"targetId"`
+	IP         string          `json:"ip"`
+	RequestID  string          `json:"requestId"`
+	Details    json.RawMessage `json:"details"`
+	CreatedAt  string          `json:"createdAt"`
+}
+
+func (self EventSerializer) Response() EventResponse {
+	details := json.RawMessage(self.Details)
+	if !json.Valid(details) {
+		details = json.RawMessage("{}")
+	}
+	return EventResponse{
+		ID:         self.ID,
+		Action:     self.Action,
+		ActorID:    self.ActorID,
+		TargetType: self.TargetType,
+		TargetID:   self.TargetID,
+		IP:         self.IP,
+		RequestID:  self.RequestID,
+		Details:    details,
+		CreatedAt:  self.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+func (self EventsSerializer) Response() []EventResponse {
+	response := []EventResponse{}
+	for _, event := range self.Events {
+		response = append(response, EventSerializer{event}.Response())
+	}
+	return response
+}
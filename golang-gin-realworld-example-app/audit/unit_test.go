@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"realworld-backend/common"
+)
+
+var test_db *gorm.DB
+
+func newTestContext(requestID string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("GET", "/", nil)
+	c.Request.RemoteAddr = "10.0.0.1:1234"
+	if requestID != "" {
+		c.Set("my_request_id", requestID)
+	}
+	return c
+}
+
+func TestRecordIsAppendOnly(t *testing.T) {
+	asserts := assert.New(t)
+	c := newTestContext("req-1")
+	c.Set("my_user_id", uint(7))
+	Record(c, Event{Action: ActionArticleDelete, TargetType: TargetArticle, TargetID: uint(3), Details: map[string]interface{}{"slug": "hello"}})
+
+	events, count, err := FindEvents(Filter{RequestID: "req-1"}, 20, 0)
+	asserts.NoError(err)
+	asserts.Equal(1, count)
+	event := events[0]
+	asserts.Equal(uint(7), event.ActorID, "the actor should be the user of the request")
+	asserts.Equal("3", event.TargetID)
+	asserts.Equal("10.0.0.1", event.IP)
+	asserts.Equal(`{"slug":"hello"}`, event.Details)
+
+	asserts.Error(test_db.Model(&event).Update("action", "nothing.happened").Error, "events should not be updated")
+	asserts.Error(test_db.Delete(&event).Error, "events should not be deleted")
+	_, count, _ = FindEvents(Filter{RequestID: "req-1", Action: ActionArticleDelete}, 20, 0)
+	asserts.Equal(1, count)
+}
+
+func TestRecordWithoutRequest(t *testing.T) {
+	asserts := assert.New(t)
+	RecordWithoutRequest(Event{Action: ActionRoleGrant, TargetType: TargetUser, TargetID: uint(8), Details: map[string]interface{}{"role": "admin"}})
+
+	events, count, err := FindEvents(Filter{Action: ActionRoleGrant, TargetID: "8"}, 20, 0)
+	asserts.NoError(err)
+	asserts.Equal(1, count)
+	asserts.Equal(uint(0), events[0].ActorID, "the operator has no user")
+	asserts.Empty(events[0].IP)
+	asserts.Empty(events[0].RequestID)
+	asserts.Equal(`{"role":"admin"}`, events[0].Details)
+}
+
+func TestFindAndExportEvents(t *testing.T) {
+	asserts := assert.New(t)
+	c := newTestContext("req-2")
+	for _, action := range []string{ActionUserLogin, ActionProfileFollow, ActionProfileUnfollow} {
+		Record(c, Event{Action: action, ActorID: 5, TargetType: TargetUser, TargetID: uint(6)})
+	}
+	events, count, err := FindEvents(Filter{ActorID: 5, TargetType: TargetUser}, 2, 1)
+	asserts.NoError(err)
+	asserts.Equal(3, count, "the count should ignore the page")
+	asserts.Len(events, 2)
+	asserts.Equal(ActionProfileFollow, events[0].Action)
+
+	future := time.Now().Add(time.Hour)
+	_, count, _ = FindEvents(Filter{ActorID: 5, Since: &future}, 20, 0)
+	asserts.Equal(0, count)
+
+	var buffer bytes.Buffer
+	asserts.NoError(ExportEvents(&buffer, Filter{RequestID: "req-2"}))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	asserts.Len(lines, 3)
+	var first EventResponse
+	asserts.NoError(json.Unmarshal([]byte(lines[0]), &first))
+	asserts.Equal(ActionUserLogin, first.Action)
+	asserts.Equal(`{}`, string(first.Details))
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	asserts := assert.New(t)
+	r := gin.New()
+	r.Use(RequestIDMiddleware())
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("my_request_id"))
+	})
+
+	for header, kept := range map[string]bool{"": false, "abc-123.x_y": true, "bad id\r\nX-Evil: 1": false, strings.Repeat("a", 65): false} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(RequestIDHeader, header)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		asserts.NotEmpty(w.Body.String())
+		asserts.Equal(w.Body.String(), w.Header().Get(RequestIDHeader))
+		asserts.Equal(kept, w.Body.String() == header, "%q", header)
+	}
+}
+
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	AutoMigrate()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
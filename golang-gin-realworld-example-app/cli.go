@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"realworld-backend/articles"
+	"realworld-backend/audit"
+	"realworld-backend/common"
+	"realworld-backend/users"
+)
+
+const usage = `usage: realworld-backend [command]
+
+Without a command the server is started.
+
+commands:
+  unlock <email>     lift the login lockout of an account
+  unlock-ip <ip>     lift the login lockout of a client IP
+  roles <username>   show the roles of an user
+  grant <username> <role>
+                     grant a role, e.g. admin or moderator
+  revoke <username> <role>
+                     revoke a role
+  audit-export       write the whole audit log to stdout as JSON Lines
+  search-rebuild     fill the full text search index again from the articles
+  trash-purge        remove the deleted articles and comments older than TRASH_RETENTION`
+
+// Maintenance commands for the operator, they share the database configuration of the server:
+//
+//	go run . unlock jake@jake.jake
+func runCommand(args []string) error {
+	switch args[0] {
+	case "unlock":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		if err := users.UnlockAccount(args[1]); err != nil {
+			return err
+		}
+		event := audit.Event{Action: audit.ActionUserUnlock, Details: map[string]interface{}{"email": args[1]}}
+		if userModel, err := users.FindOneUser(&users.UserModel{Email: args[1]}); err == nil {
+			event.TargetType, event.TargetID = audit.TargetUser, userModel.ID
+		}
+		audit.RecordWithoutRequest(event)
+		fmt.Println("Account unlocked:", args[1])
+	case "unlock-ip":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		if err := users.UnlockIP(args[1]); err != nil {
+			return err
+		}
+		fmt.Println("IP unlocked:", args[1])
+	case "roles":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		userModel, err := users.FindOneUser(&users.UserModel{Username: args[1]})
+		if err != nil {
+			return fmt.Errorf("unknown user %s", args[1])
+		}
+		fmt.Println(strings.Join(userModel.Roles(), " "))
+	case "grant", "revoke":
+		if len(args) != 3 {
+			return errors.New(usage)
+		}
+		userModel, err := users.FindOneUser(&users.UserModel{Username: args[1]})
+		if err != nil {
+			return fmt.Errorf("unknown user %s", args[1])
+		}
+		action := audit.ActionRoleGrant
+		if args[0] == "grant" {
+			err = users.GrantRole(userModel.ID, args[2])
+		} else {
+			action = audit.ActionRoleRevoke
+			err = users.RevokeRole(userModel.ID, args[2])
+		}
+		if err != nil {
+			return err
+		}
+		audit.RecordWithoutRequest(audit.Event{Action: action, TargetType: audit.TargetUser, TargetID: userModel.ID,
+			Details: map[string]interface{}{"role": args[2]}})
+		fmt.Printf("Roles of %s: %s\n", userModel.Username, strings.Join(userModel.Roles(), " "))
+	case "audit-export":
+		if len(args) != 1 {
+			return errors.New(usage)
+		}
+		return audit.ExportEvents(os.Stdout, audit.Filter{})
+	case "search-rebuild":
+		if len(args) != 1 {
+			return errors.New(usage)
+		}
+		count, err := articles.RebuildSearchIndex()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Articles indexed:", count)
+	case "trash-purge":
+		if len(args) != 1 {
+			return errors.New(usage)
+		}
+		articleCount, commentCount, err := articles.PurgeTrash(time.Now().Add(-common.TrashRetention))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Purged %d articles and %d comments\n", articleCount, commentCount)
+	default:
+		return errors.New(usage)
+	}
+	return nil
+}
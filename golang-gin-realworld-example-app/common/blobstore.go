@@ -0,0 +1,171 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ErrBlobKeyInvalid = errors.New("Invalid blob key")
+
+// Uploaded files go through a BlobStore, so that the local disk could be swapped for an object storage.
+//
+// Keys are slash separated relative paths like "avatars/1/k3j9x2m4/256.jpg".
+//
+//	err := common.GetBlobStore().Put("avatars/1/k3j9x2m4/256.jpg", reader, "image/jpeg")
+type BlobStore interface {
+	Put(key string, r io.Reader, contentType string) error
+	Delete(key string) error
+	// The public URL the file is served from
+	URL(key string) string
+}
+
+// Keys could not climb out of the root of the store
+func cleanBlobKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != key || strings.Contains(key, "\\") {
+		return "", ErrBlobKeyInvalid
+	}
+	return cleaned, nil
+}
+
+// Keep the files in a directory of the local disk, the server publishes it under BlobRoute.
+type LocalBlobStore struct {
+	Dir     string
+	BaseURL string
+}
+
+func (s *LocalBlobStore) Put(key string, r io.Reader, contentType string) error {
+	key, err := cleanBlobKey(key)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	// Write next to the target and rename, readers never see a half written file.
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// Deleting a missing file is not an error
+func (s *LocalBlobStore) Delete(key string) error {
+	key, err := cleanBlobKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(s.Dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalBlobStore) URL(key string) string {
+	return strings.TrimSuffix(s.BaseURL, "/") + "/" + key
+}
+
+// Keep the files in memory, the tests read them back instead of checking the disk.
+type MemoryBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: map[string][]byte{}}
+}
+
+func (s *MemoryBlobStore) Put(key string, r io.Reader, contentType string) error {
+	key, err := cleanBlobKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = data
+	return nil
+}
+
+func (s *MemoryBlobStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *MemoryBlobStore) URL(key string) string {
+	return "memory://" + key
+}
+
+// The content of a stored file, ok is false if there is none.
+func (s *MemoryBlobStore) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.blobs[key]
+	return bytes.Clone(data), ok
+}
+
+// The keys of all stored files
+func (s *MemoryBlobStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for key := range s.blobs {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// The route the files of a LocalBlobStore are served from
+const BlobRoute = "/uploads"
+
+// Where the uploaded files are kept, and the URL they are reached at from the browser.
+//
+//	export BLOB_DIR="./uploads"
+//	export BLOB_BASE_URL="https://conduit.example.com/uploads"
+var BlobDir = getEnvDefaultQuiet("BLOB_DIR", "./uploads")
+var BlobBaseURL = getEnvDefaultQuiet("BLOB_BASE_URL", "http://localhost:8080"+BlobRoute)
+
+var blobStore BlobStore = NewMemoryBlobStore()
+
+// Store the uploaded files in BLOB_DIR
+func InitBlobStore() BlobStore {
+	blobStore = &LocalBlobStore{Dir: BlobDir, BaseURL: BlobBaseURL}
+	return blobStore
+}
+
+// Using this function to get the blob store, it defaults to an in-memory store.
+func GetBlobStore() BlobStore {
+	return blobStore
+}
+
+// Replace the blob store, e.g. with a MemoryBlobStore in tests.
+func SetBlobStore(s BlobStore) {
+	blobStore = s
+}
@@ -0,0 +1,217 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrPasswordMismatch = errors.New("Password does not match")
+var ErrPasswordHashUnknown = errors.New("Unknown password hash format")
+
+// Passwords are hashed through a PasswordHasher, the stored hash names the algorithm and its parameters
+// so that the hashes of another algorithm or of older parameters still verify.
+//
+//	hash, err := common.GetPasswordHasher().Hash("password0")
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Whether the hash has the format of this algorithm
+	Recognizes(hash string) bool
+	// nil when the password matches, the parameters are read from the hash
+	Verify(hash string, password string) error
+	// Whether the hash was made with other parameters than the ones of the hasher
+	Outdated(hash string) bool
+}
+
+// bcrypt at a configurable cost, the cost is part of the "$2a$10$..." hash.
+//
+// bcrypt only reads the first 72 bytes, longer passwords are reduced with SHA-256 first so that
+// they are neither truncated nor refused.
+type BcryptHasher struct {
+	Cost int
+}
+
+func bcryptInput(password string) []byte {
+	if len(password) <= 72 {
+		return []byte(password)
+	}
+	sum := sha256.Sum256([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(bcryptInput(password), h.Cost)
+	return string(hash), err
+}
+
+func (h BcryptHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h BcryptHasher) Verify(hash string, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), bcryptInput(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+func (h BcryptHasher) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.Cost
+}
+
+// argon2id with the PHC string format: "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>".
+//
+// Memory is in KiB.
+type Argon2idHasher struct {
+	Memory     uint32
+	Time       uint32
+	Threads    uint8
+	KeyLength  uint32
+	SaltLength int
+}
+
+const argon2idPrefix = "$argon2id$"
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+// The parameters, salt and key of an argon2id hash
+func parseArgon2id(hash string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+	var version int
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrPasswordHashUnknown
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrPasswordHashUnknown
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, ErrPasswordHashUnknown
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrPasswordHashUnknown
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrPasswordHashUnknown
+	}
+	params.SaltLength = len(salt)
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+func (h Argon2idHasher) Verify(hash string, password string) error {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	computed := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (h Argon2idHasher) Outdated(hash string) bool {
+	params, _, _, err := parseArgon2id(hash)
+	return err != nil || params != h
+}
+
+// How new passwords are hashed, "bcrypt" or "argon2id". Changing the algorithm or its parameters
+// upgrades the stored hashes one by one, at the next successful login of each user.
+//
+//	export PASSWORD_HASH="argon2id"
+//	export PASSWORD_BCRYPT_COST="10"
+//	export PASSWORD_ARGON2_MEMORY="65536"
+//	export PASSWORD_ARGON2_TIME="3"
+//	export PASSWORD_ARGON2_THREADS="2"
+var PasswordHashAlgorithm = getEnvDefaultQuiet("PASSWORD_HASH", "bcrypt")
+var PasswordBcryptCost = getEnvIntOrDefault("PASSWORD_BCRYPT_COST", bcrypt.DefaultCost)
+var PasswordArgon2Memory = getEnvIntOrDefault("PASSWORD_ARGON2_MEMORY", 64*1024)
+var PasswordArgon2Time = getEnvIntOrDefault("PASSWORD_ARGON2_TIME", 3)
+var PasswordArgon2Threads = getEnvIntOrDefault("PASSWORD_ARGON2_THREADS", 2)
+
+// The hasher described by the PASSWORD_HASH* settings
+func DefaultPasswordHasher() PasswordHasher {
+	switch PasswordHashAlgorithm {
+	case "argon2id":
+		return Argon2idHasher{
+			Memory:     uint32(PasswordArgon2Memory),
+			Time:       uint32(PasswordArgon2Time),
+			Threads:    uint8(PasswordArgon2Threads),
+			KeyLength:  32,
+			SaltLength: 16,
+		}
+	case "bcrypt":
+	default:
+		fmt.Printf("WARNING: PASSWORD_HASH %q is not supported, using bcrypt\n", PasswordHashAlgorithm)
+	}
+	cost := PasswordBcryptCost
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		fmt.Printf("WARNING: PASSWORD_BCRYPT_COST should be between %d and %d, using %d\n", bcrypt.MinCost, bcrypt.MaxCost, bcrypt.DefaultCost)
+		cost = bcrypt.DefaultCost
+	}
+	return BcryptHasher{Cost: cost}
+}
+
+var passwordHasher = DefaultPasswordHasher()
+
+// Every algorithm a stored hash could use, the parameters come from the hash
+var knownPasswordHashers = []PasswordHasher{BcryptHasher{}, Argon2idHasher{}}
+
+// Using this function to get the hasher of new passwords
+func GetPasswordHasher() PasswordHasher {
+	return passwordHasher
+}
+
+// Replace the hasher of new passwords, e.g. with a cheap one in tests.
+func SetPasswordHasher(h PasswordHasher) {
+	passwordHasher = h
+}
+
+// You could hash a new password with the current hasher
+//
+//	passwordHash, err := common.HashPassword("password0")
+func HashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// You could check a password against a stored hash of any known algorithm. When it matches and
+// rehash is true, the hash uses another algorithm or older parameters and should be replaced by
+// HashPassword(password).
+//
+//	rehash, err := common.VerifyPassword(userModel.PasswordHash, "password0")
+func VerifyPassword(hash string, password string) (rehash bool, err error) {
+	for _, hasher := range append([]PasswordHasher{passwordHasher}, knownPasswordHashers...) {
+		if !hasher.Recognizes(hash) {
+			continue
+		}
+		if err := hasher.Verify(hash, password); err != nil {
+			return false, err
+		}
+		return !passwordHasher.Recognizes(hash) || passwordHasher.Outdated(hash), nil
+	}
+	return false, ErrPasswordHashUnknown
+}
@@ -0,0 +1,175 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+
+	"golang.org/x/image/draw"
+)
+
+var ErrImageUnsupported = errors.New("Only JPEG, PNG and GIF images are supported")
+var ErrImageTooLarge = errors.New("The image has too many pixels")
+
+// Decoding allocates width * height * 4 bytes, bigger images are refused before they are decoded.
+const MaxImagePixels = 40 * 1000 * 1000
+
+// The content types DecodeImage accepts with the name of their decoder
+var imageFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// You could decode an uploaded image, the type is sniffed from the data and the declared one is ignored.
+//
+// The pixels are all that is kept, EXIF and other metadata are dropped. The EXIF orientation of a JPEG
+// is returned so that the thumbnails could be turned the right way up, 1 means no change.
+//
+//	img, orientation, err := common.DecodeImage(data)
+func DecodeImage(data []byte) (image.Image, int, error) {
+	format, ok := imageFormats[http.DetectContentType(data)]
+	if !ok {
+		return nil, 0, ErrImageUnsupported
+	}
+	config, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoded != format {
+		return nil, 0, ErrImageUnsupported
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxImagePixels {
+		return nil, 0, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, ErrImageUnsupported
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	return img, orientation, nil
+}
+
+// You could make a size x size thumbnail of the center of the image, transparent parts become white.
+//
+// Cropping the center commutes with turning the image, so the orientation is applied to the small
+// thumbnail instead of the full image.
+//
+//	thumbnail := common.SquareThumbnail(img, orientation, 256)
+func SquareThumbnail(img image.Image, orientation int, size int) image.Image {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	thumbnail := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(thumbnail, thumbnail.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), img, image.Rect(x, y, x+side, y+side), draw.Over, nil)
+	return orient(thumbnail, orientation)
+}
+
+func EncodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 88})
+	return buf.Bytes(), err
+}
+
+// Turn a square image as described by the EXIF orientation 1 to 8
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	size := img.Bounds().Dx()
+	last := size - 1
+	turned := image.NewRGBA(img.Bounds())
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			// The source pixel of the destination pixel x, y
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = last - x
+			case 3:
+				sx, sy = last-x, last-y
+			case 4:
+				sy = last - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, last-x
+			case 7:
+				sx, sy = last-y, last-x
+			case 8:
+				sx, sy = last-y, x
+			}
+			turned.SetRGBA(x, y, img.RGBAAt(sx, sy))
+		}
+	}
+	return turned
+}
+
+// The orientation tag of the EXIF segment of a JPEG, 1 when there is none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		marker := data[i+1]
+		// The metadata segments come before the start of scan
+		if data[i] != 0xFF || marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// Look for the tag 0x0112 in the first IFD of the TIFF structure of an EXIF segment
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < count; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
@@ -0,0 +1,289 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The kid of the key built from NBSecretPassword, tokens without a kid header are verified with it.
+const LegacyKeyID = "default"
+
+// One key of the keyring.
+//
+// Private is nil for a verification-only key, e.g. a retired key which is only kept until
+// the tokens it signed expire.
+//
+//	HS256: Private and Public are the same []byte secret
+//	RS256: *rsa.PrivateKey and *rsa.PublicKey
+//	EdDSA: ed25519.PrivateKey and ed25519.PublicKey
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{}
+	Public  interface{}
+}
+
+// A Keyring holds several keys identified by their kid, one of them signs the new tokens.
+//
+// Rotation is done by adding the new key as active and keeping the old one until its tokens expire:
+//
+//	keyring.Add(newKey, true)
+type Keyring struct {
+	mu       sync.RWMutex
+	keys     map[string]*SigningKey
+	activeID string
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]*SigningKey)}
+}
+
+// Keys signs all the tokens issued by GenToken.
+//
+// Set these environment variables to load the keys from files:
+// export JWT_KEYS_DIR="/etc/realworld/keys"   every file is a key, the file name without extension is the kid
+// export JWT_ACTIVE_KID="2024-rs256"          the kid used to sign new tokens
+//
+// The server does not start when JWT_KEYS_DIR is set but its keys could not be loaded, falling back
+// to JWT_SECRET would sign the tokens with a key nobody expects.
+var Keys = mustLoadKeyringFromEnv()
+
+func mustLoadKeyringFromEnv() *Keyring {
+	keyring, err := loadKeyringFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	return keyring
+}
+
+func loadKeyringFromEnv() (*Keyring, error) {
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		keyring, err := LoadKeyringFromDir(dir, os.Getenv("JWT_ACTIVE_KID"))
+		if err != nil {
+			return nil, fmt.Errorf("can not load JWT keys from JWT_KEYS_DIR %s: %v", dir, err)
+		}
+		return keyring, nil
+	}
+	keyring := NewKeyring()
+	keyring.Add(NewHMACKey(LegacyKeyID, []byte(NBSecretPassword)), true)
+	return keyring, nil
+}
+
+func NewHMACKey(kid string, secret []byte) *SigningKey {
+	return &SigningKey{ID: kid, Method: jwt.SigningMethodHS256, Private: secret, Public: secret}
+}
+
+// You could add a key to the keyring, an active key will sign the new tokens.
+func (k *Keyring) Add(key *SigningKey, active bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key.ID] = key
+	if active {
+		k.activeID = key.ID
+	}
+}
+
+// You could drop a key when no valid token is signed by it anymore.
+func (k *Keyring) Remove(kid string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, kid)
+	if k.activeID == kid {
+		k.activeID = ""
+	}
+}
+
+func (k *Keyring) Active() (*SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[k.activeID]
+	if !ok || key.Private == nil {
+		return nil, errors.New("keyring has no active signing key")
+	}
+	return key, nil
+}
+
+func (k *Keyring) Lookup(kid string) (*SigningKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// Sign the claims with the active key and put its kid in the header.
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.Active()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// A jwt.Keyfunc choosing the verification key by the kid header.
+//
+// The algorithm of the token has to match the key, otherwise a public key could be used as a HMAC secret.
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = LegacyKeyID
+	}
+	key, ok := k.Lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v for kid %q", token.Method.Alg(), kid)
+	}
+	return key.Public, nil
+}
+
+// A JSON Web Key, only the fields of RSA and Ed25519 public keys are used.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// The public keys of the keyring, HMAC secrets are never published.
+func (k *Keyring) JWKS() JWKSet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.keys {
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// You could load a key from a file, the format is detected from the content:
+//
+//	RSA or Ed25519 private key in PEM (PKCS#1 or PKCS#8)   signing key
+//	RSA or Ed25519 public key in PEM (PKIX)                verification-only key
+//	anything else                                          HS256 secret, surrounding whitespace is trimmed
+func LoadKeyFile(kid, path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := bytes.TrimSpace(data)
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("HMAC secret in %s should be at least 32 bytes", path)
+		}
+		return NewHMACKey(kid, secret), nil
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newPrivateKey(kid, private)
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newPrivateKey(kid, private)
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newPublicKey(kid, public)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+}
+
+func newPrivateKey(kid string, private interface{}) (*SigningKey, error) {
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		return &SigningKey{ID: kid, Method: jwt.SigningMethodRS256, Private: private, Public: &private.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &SigningKey{ID: kid, Method: jwt.SigningMethodEdDSA, Private: private, Public: private.Public()}, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", private)
+}
+
+func newPublicKey(kid string, public interface{}) (*SigningKey, error) {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return &SigningKey{ID: kid, Method: jwt.SigningMethodRS256, Public: public}, nil
+	case ed25519.PublicKey:
+		return &SigningKey{ID: kid, Method: jwt.SigningMethodEdDSA, Public: public}, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", public)
+}
+
+// You could load every file of a directory as a key, the file name without extension is the kid.
+//
+//	keyring, err := LoadKeyringFromDir("/etc/realworld/keys", "2024-rs256")
+func LoadKeyringFromDir(dir string, activeID string) (*Keyring, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keyring := NewKeyring()
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		kid := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		key, err := LoadKeyFile(kid, filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		keyring.Add(key, kid == activeID)
+	}
+	if _, err := keyring.Active(); err != nil {
+		return nil, fmt.Errorf("active kid %q is not a signing key in %s", activeID, dir)
+	}
+	return keyring, nil
+}
@@ -0,0 +1,175 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A plain text email
+type Message struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sentAt"`
+}
+
+// Every email goes through a Mailer, so that the transport could be swapped in tests.
+//
+//	err := common.GetMailer().Send(common.Message{To: "a@b.c", Subject: "Hi", Body: "..."})
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Deliver emails through a SMTP server with PLAIN auth.
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	// Headers could not contain line breaks, otherwise extra headers could be injected.
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(msg.Subject)
+	to := strings.NewReplacer("\r", "", "\n", "").Replace(msg.To)
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.From, to, subject, msg.Body)
+	return smtp.SendMail(addr, auth, m.From, []string{to}, []byte(body))
+}
+
+// Keep the emails in memory, the tests read them back instead of checking a real mailbox.
+type MemoryOutbox struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryOutbox) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg.SentAt = time.Now()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// All the emails sent so far, oldest first.
+func (m *MemoryOutbox) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message{}, m.messages...)
+}
+
+// The newest email sent to the address, ok is false if there is none.
+func (m *MemoryOutbox) Last(to string) (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To == to {
+			return m.messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// Append the emails as JSON lines to a file, handy for local development without a SMTP server.
+type FileOutbox struct {
+	mu   sync.Mutex
+	Path string
+}
+
+func (m *FileOutbox) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg.SentAt = time.Now()
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+var mailer Mailer = &MemoryOutbox{}
+
+var backgroundMail sync.WaitGroup
+
+// You could send an email after the response, when the time spent sending it would tell something to the
+// client, e.g. whether an address is registered. A failure is logged under the name of the email.
+//
+//	common.SendInBackground("password reset email", func() error { return sendPasswordResetEmail(userModel) })
+func SendInBackground(name string, send func() error) {
+	backgroundMail.Add(1)
+	go func() {
+		defer backgroundMail.Done()
+		if err := send(); err != nil {
+			log.Printf("%s failed: %v", name, err)
+		}
+	}()
+}
+
+// Wait until the emails sent in the background are gone, e.g. in tests before reading the outbox.
+func WaitForBackgroundMail() {
+	backgroundMail.Wait()
+}
+
+// Choose the mailer from environment variables:
+//
+//	export MAIL_SMTP_HOST="smtp.example.com" MAIL_SMTP_PORT="587" MAIL_SMTP_USERNAME="..." MAIL_SMTP_PASSWORD="..." MAIL_FROM="noreply@example.com"
+//
+// Without MAIL_SMTP_HOST the emails are written to MAIL_OUTBOX_FILE (default ./../outbox.jsonl).
+func InitMailer() Mailer {
+	if host := os.Getenv("MAIL_SMTP_HOST"); host != "" {
+		port, err := strconv.Atoi(os.Getenv("MAIL_SMTP_PORT"))
+		if err != nil {
+			port = 587
+		}
+		mailer = &SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("MAIL_SMTP_USERNAME"),
+			Password: os.Getenv("MAIL_SMTP_PASSWORD"),
+			From:     getEnvOrDefault("MAIL_FROM", "noreply@localhost"),
+		}
+		return mailer
+	}
+	path := os.Getenv("MAIL_OUTBOX_FILE")
+	if path == "" {
+		path = "./../outbox.jsonl"
+	}
+	fmt.Printf("WARNING: MAIL_SMTP_HOST not set, emails are written to %s\n", path)
+	mailer = &FileOutbox{Path: path}
+	return mailer
+}
+
+// Using this function to get the mailer, it defaults to an in-memory outbox.
+func GetMailer() Mailer {
+	return mailer
+}
+
+// Replace the mailer, e.g. with a MemoryOutbox in tests.
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+// Links in emails point at the frontend.
+//
+//	export APP_BASE_URL="https://conduit.example.com"
+var AppBaseURL = getEnvDefaultQuiet("APP_BASE_URL", "http://localhost:4100")
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// CommonMark with the GitHub extensions: tables, strikethrough, autolinks and task lists.
+// Raw HTML is kept by the renderer, the sanitizer decides what is left of it.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// The allowlist of user generated content, plus the disabled checkboxes of the task lists and the
+// language class of the code blocks. Links get rel="nofollow", scripts, styles and event handlers go away.
+var markdownPolicy = newMarkdownPolicy()
+
+func newMarkdownPolicy() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	policy.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^$|^checked$|^disabled$`)).OnElements("input")
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+-]+$`)).OnElements("code")
+	return policy
+}
+
+// You could render the Markdown of an article or a comment to HTML that is safe to insert in a page.
+//
+//	bodyHTML := common.RenderMarkdown(articleModel.Body)
+func RenderMarkdown(source string) string {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		// Only a failing writer makes goldmark fail, a bytes.Buffer does not
+		return markdownPolicy.Sanitize(source)
+	}
+	return markdownPolicy.Sanitize(buf.String())
+}
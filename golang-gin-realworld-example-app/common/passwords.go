@@ -0,0 +1,312 @@
+package common
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// A rule of the password policy. Check returns the validation tag and param reported when the
+// password breaks the rule, e.g. "min" and "8", and an empty tag when the password is fine.
+//
+// The identities are the username and email of the account, they could be empty.
+type PasswordRule interface {
+	Check(password string, identities []string) (tag string, param string)
+}
+
+// The rules are checked in order, only the first broken one is reported.
+type PasswordPolicy []PasswordRule
+
+// At least Min characters, counted as runes
+type MinLengthRule struct {
+	Min int
+}
+
+func (r MinLengthRule) Check(password string, identities []string) (string, string) {
+	if utf8.RuneCountInString(password) < r.Min {
+		return "min", strconv.Itoa(r.Min)
+	}
+	return "", ""
+}
+
+// At least Min of the four classes: lower case, upper case, digits and symbols
+type CharacterClassesRule struct {
+	Min int
+}
+
+func (r CharacterClassesRule) Check(password string, identities []string) (string, string) {
+	var lower, upper, digit, symbol int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < r.Min {
+		return "classes", strconv.Itoa(r.Min)
+	}
+	return "", ""
+}
+
+// Refuse the passwords found in a list of known breached passwords.
+//
+// Path is either a file or a directory:
+//   - a file has one password per line, or the upper case SHA-1 of one, optionally followed by ":count"
+//     like the Pwned Passwords downloads
+//   - a directory holds k-anonymity range files named after the first 5 hex characters of the SHA-1,
+//     e.g. "5BAA6.txt", with "SUFFIX:count" lines like the Pwned Passwords range API returns
+//
+// A file is loaded once by Load or the first check, range files are read on every check. A list which could
+// not be loaded is logged once and refuses no password.
+type BreachedPasswordRule struct {
+	Path string
+
+	once   sync.Once
+	err    error
+	dir    bool
+	hashes map[string]bool
+}
+
+func NewBreachedPasswordRule(path string) *BreachedPasswordRule {
+	return &BreachedPasswordRule{Path: path}
+}
+
+func (r *BreachedPasswordRule) Check(password string, identities []string) (string, string) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	if r.isBreached(hash) {
+		return "breached", ""
+	}
+	return "", ""
+}
+
+// You could load the list before the first check, e.g. to refuse to start without it.
+//
+//	err := common.NewBreachedPasswordRule("./breached-passwords.txt").Load()
+func (r *BreachedPasswordRule) Load() error {
+	r.once.Do(func() {
+		if r.err = r.load(); r.err != nil {
+			log.Printf("breached password list could not be read, no password is checked against it: %v", r.err)
+		}
+	})
+	return r.err
+}
+
+func (r *BreachedPasswordRule) load() error {
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return err
+	}
+	if r.dir = info.IsDir(); r.dir {
+		return nil
+	}
+	r.hashes = map[string]bool{}
+	return scanBreachedList(r.Path, func(line string) bool {
+		r.hashes[breachedListHash(line)] = true
+		return true
+	})
+}
+
+func (r *BreachedPasswordRule) isBreached(hash string) bool {
+	if r.Load() != nil {
+		return false
+	}
+	if !r.dir {
+		return r.hashes[hash]
+	}
+	// A missing range file is a range without breached passwords
+	found := false
+	err := scanBreachedList(filepath.Join(r.Path, hash[:5]+".txt"), func(line string) bool {
+		found = strings.EqualFold(line, hash[5:])
+		return !found
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("breached password range could not be read: %v", err)
+	}
+	return found
+}
+
+// A line of the list is a SHA-1 when it looks like one, a password otherwise
+func breachedListHash(line string) string {
+	if _, err := hex.DecodeString(line); err == nil && len(line) == 40 {
+		return strings.ToUpper(line)
+	}
+	sum := sha1.Sum([]byte(line))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Call fn with every non empty line without its ":count", until it returns false
+func scanBreachedList(path string, fn func(line string) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.LastIndex(line, ":"); i > 0 {
+			if _, err := strconv.Atoi(line[i+1:]); err == nil {
+				line = line[:i]
+			}
+		}
+		if line != "" && !fn(line) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// The password could not contain the username or the email, be contained in them, or be a few edits away.
+type SimilarityRule struct{}
+
+// Identities shorter than this are too common to be checked, e.g. "bob" in "bobsleigh42"
+const minSimilarIdentity = 4
+
+func (r SimilarityRule) Check(password string, identities []string) (string, string) {
+	password = strings.ToLower(password)
+	for _, identity := range passwordIdentities(identities) {
+		if strings.Contains(password, identity) || strings.Contains(identity, password) ||
+			editDistanceAtMost(password, identity, 2) {
+			return "similar", ""
+		}
+	}
+	return "", ""
+}
+
+// The lower case identities, an email counts with and without its domain
+func passwordIdentities(identities []string) []string {
+	var result []string
+	for _, identity := range identities {
+		identity = strings.ToLower(strings.TrimSpace(identity))
+		candidates := []string{identity}
+		if at := strings.LastIndex(identity, "@"); at > 0 {
+			candidates = append(candidates, identity[:at])
+		}
+		for _, candidate := range candidates {
+			if utf8.RuneCountInString(candidate) >= minSimilarIdentity {
+				result = append(result, candidate)
+			}
+		}
+	}
+	return result
+}
+
+// Whether the Levenshtein distance of a and b is at most max
+func editDistanceAtMost(a, b string, max int) bool {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra)-len(rb) > max || len(rb)-len(ra) > max {
+		return false
+	}
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)] <= max
+}
+
+// The password policy of new passwords, old passwords keep working at login.
+//
+//	export PASSWORD_MIN_LENGTH="8"
+//	export PASSWORD_MIN_CLASSES="1"
+//	export PASSWORD_BREACHED_LIST="./breached-passwords.txt"
+//	export PASSWORD_SIMILARITY_CHECK="true"
+var PasswordMinLength = getEnvIntOrDefault("PASSWORD_MIN_LENGTH", 8)
+var PasswordMinClasses = getEnvIntOrDefault("PASSWORD_MIN_CLASSES", 1)
+var PasswordBreachedList = getEnvDefaultQuiet("PASSWORD_BREACHED_LIST", "")
+var PasswordSimilarityCheck = getEnvBoolOrDefault("PASSWORD_SIMILARITY_CHECK", true)
+
+// The policy described by the PASSWORD_* settings.
+//
+// The server does not start when PASSWORD_BREACHED_LIST is set but could not be loaded, every password
+// would pass the check.
+func DefaultPasswordPolicy() PasswordPolicy {
+	policy := PasswordPolicy{
+		MinLengthRule{Min: PasswordMinLength},
+		CharacterClassesRule{Min: PasswordMinClasses},
+	}
+	if PasswordBreachedList != "" {
+		rule := NewBreachedPasswordRule(PasswordBreachedList)
+		if err := rule.Load(); err != nil {
+			panic(fmt.Errorf("can not load PASSWORD_BREACHED_LIST %s: %v", PasswordBreachedList, err))
+		}
+		policy = append(policy, rule)
+	}
+	if PasswordSimilarityCheck {
+		policy = append(policy, SimilarityRule{})
+	}
+	return policy
+}
+
+var passwordPolicy = DefaultPasswordPolicy()
+
+// Using this function to get the password policy
+func GetPasswordPolicy() PasswordPolicy {
+	return passwordPolicy
+}
+
+// Replace the password policy, e.g. with extra rules or a smaller list in tests.
+func SetPasswordPolicy(policy PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// The validator only sees this struct, so the broken rule is reported as an error of the Password field.
+type passwordCheck struct {
+	Password   string
+	identities []string
+}
+
+var passwordValidate = newPasswordValidate()
+
+func newPasswordValidate() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterStructValidation(func(sl validator.StructLevel) {
+		check := sl.Current().Interface().(passwordCheck)
+		for _, rule := range GetPasswordPolicy() {
+			if tag, param := rule.Check(check.Password, check.identities); tag != "" {
+				sl.ReportError(check.Password, "Password", "Password", tag, param)
+				return
+			}
+		}
+	}, passwordCheck{})
+	return validate
+}
+
+// You could check a new password against the password policy, the error is a validator.ValidationErrors
+// so that it could be returned by NewValidatorError like the other binding errors.
+//
+//	if err := common.ValidatePassword(password, username, email); err != nil {
+//		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+//	}
+func ValidatePassword(password string, identities ...string) error {
+	return passwordValidate.Struct(passwordCheck{Password: password, identities: identities})
+}
@@ -2,13 +2,26 @@ package common
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"image"
+	"image/color"
+	"image/png"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -77,7 +90,7 @@ func TestGenToken(t *testing.T) {
 	token := GenToken(2)
 
 	asserts.IsType(token, string("token"), "token type should be string")
-	asserts.Len(token, 115, "JWT's length should be 115")
+	asserts.Len(token, 201, "JWT's length should be 201")
 }
 
 func TestNewValidatorError(t *testing.T) {
@@ -295,3 +308,399 @@ func TestRandStringCharacterSet(t *testing.T) {
 		asserts.Contains(validChars, string(char), "Each character should be from the valid set")
 	}
 }
+
+// ===========================
+// KEYRING TESTS
+// ===========================
+
+func writeKeyFile(t *testing.T, dir, name string, block *pem.Block) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	asserts := assert.New(t)
+	dir := t.TempDir()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaPath := writeKeyFile(t, dir, "rsa.pem", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	key, err := LoadKeyFile("rsa", rsaPath)
+	asserts.NoError(err, "RSA private key should be loaded")
+	asserts.Equal("RS256", key.Method.Alg())
+
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	edBytes, _ := x509.MarshalPKCS8PrivateKey(edPrivate)
+	edPath := writeKeyFile(t, dir, "ed.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: edBytes})
+	key, err = LoadKeyFile("ed", edPath)
+	asserts.NoError(err, "Ed25519 private key should be loaded")
+	asserts.Equal("EdDSA", key.Method.Alg())
+
+	publicBytes, _ := x509.MarshalPKIXPublicKey(edPublic)
+	publicPath := writeKeyFile(t, dir, "ed-public.pem", &pem.Block{Type: "PUBLIC KEY", Bytes: publicBytes})
+	key, err = LoadKeyFile("ed-public", publicPath)
+	asserts.NoError(err, "Ed25519 public key should be loaded")
+	asserts.Nil(key.Private, "public key should be verification only")
+
+	secretPath := filepath.Join(dir, "hmac.key")
+	os.WriteFile(secretPath, []byte(RandToken(32)+"\n"), 0600)
+	key, err = LoadKeyFile("hmac", secretPath)
+	asserts.NoError(err, "HMAC secret should be loaded")
+	asserts.Equal("HS256", key.Method.Alg())
+
+	os.WriteFile(secretPath, []byte("short"), 0600)
+	_, err = LoadKeyFile("hmac", secretPath)
+	asserts.Error(err, "short HMAC secret should be refused")
+}
+
+func TestKeyringRotation(t *testing.T) {
+	asserts := assert.New(t)
+	keyring := NewKeyring()
+	keyring.Add(NewHMACKey("old", []byte(RandToken(32))), true)
+	oldToken, err := keyring.Sign(jwt.MapClaims{"id": 1})
+	asserts.NoError(err)
+
+	_, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	newKey, _ := newPrivateKey("new", edPrivate)
+	keyring.Add(newKey, true)
+	newToken, err := keyring.Sign(jwt.MapClaims{"id": 1})
+	asserts.NoError(err)
+
+	parsed, err := jwt.Parse(newToken, keyring.Keyfunc)
+	asserts.NoError(err, "token signed by the active key should be valid")
+	asserts.Equal("new", parsed.Header["kid"], "kid header should be the active key")
+	asserts.Equal("EdDSA", parsed.Method.Alg())
+
+	_, err = jwt.Parse(oldToken, keyring.Keyfunc)
+	asserts.NoError(err, "token signed by a rotated key should still be valid")
+
+	keyring.Remove("old")
+	_, err = jwt.Parse(oldToken, keyring.Keyfunc)
+	asserts.Error(err, "token signed by a removed key should be refused")
+
+	// A public key must never be accepted as a HMAC secret
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": 1})
+	forged.Header["kid"] = "new"
+	forgedToken, _ := forged.SignedString([]byte(edPrivate.Public().(ed25519.PublicKey)))
+	_, err = jwt.Parse(forgedToken, keyring.Keyfunc)
+	asserts.Error(err, "algorithm of the token should match the key")
+
+	jwks := keyring.JWKS()
+	asserts.Len(jwks.Keys, 1, "only the public keys should be published")
+	asserts.Equal("OKP", jwks.Keys[0].Kty)
+	asserts.Equal("new", jwks.Keys[0].Kid)
+}
+
+func TestLoadKeyringFromDir(t *testing.T) {
+	asserts := assert.New(t)
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	writeKeyFile(t, dir, "2024-rs256.pem", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	os.WriteFile(filepath.Join(dir, "2023-hs256.key"), []byte(RandToken(32)), 0600)
+
+	keyring, err := LoadKeyringFromDir(dir, "2024-rs256")
+	asserts.NoError(err)
+	active, _ := keyring.Active()
+	asserts.Equal("2024-rs256", active.ID)
+	_, ok := keyring.Lookup("2023-hs256")
+	asserts.True(ok, "every file should be a key")
+	asserts.Len(keyring.JWKS().Keys, 1)
+	asserts.Equal("RSA", keyring.JWKS().Keys[0].Kty)
+
+	_, err = LoadKeyringFromDir(dir, "missing")
+	asserts.Error(err, "active kid should exist")
+}
+
+func TestLoadKeyringFromEnv(t *testing.T) {
+	asserts := assert.New(t)
+	t.Setenv("JWT_KEYS_DIR", "")
+	keyring, err := loadKeyringFromEnv()
+	asserts.NoError(err)
+	active, _ := keyring.Active()
+	asserts.Equal(LegacyKeyID, active.ID, "JWT_SECRET should be used without a key directory")
+
+	t.Setenv("JWT_KEYS_DIR", filepath.Join(t.TempDir(), "missing"))
+	keyring, err = loadKeyringFromEnv()
+	asserts.Error(err, "a key directory which does not load should not fall back to JWT_SECRET")
+	asserts.Nil(keyring)
+}
+
+// ===========================
+// MAILER TESTS
+// ===========================
+
+func TestMemoryOutbox(t *testing.T) {
+	asserts := assert.New(t)
+	outbox := &MemoryOutbox{}
+	var mailer Mailer = outbox
+	mailer.Send(Message{To: "a@example.com", Subject: "first", Body: "1"})
+	mailer.Send(Message{To: "b@example.com", Subject: "second", Body: "2"})
+	mailer.Send(Message{To: "a@example.com", Subject: "third", Body: "3"})
+
+	asserts.Len(outbox.Messages(), 3)
+	message, ok := outbox.Last("a@example.com")
+	asserts.True(ok)
+	asserts.Equal("third", message.Subject, "Last should return the newest email")
+	_, ok = outbox.Last("c@example.com")
+	asserts.False(ok)
+}
+
+func TestFileOutbox(t *testing.T) {
+	asserts := assert.New(t)
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	outbox := &FileOutbox{Path: path}
+	asserts.NoError(outbox.Send(Message{To: "a@example.com", Subject: "first", Body: "1"}))
+	asserts.NoError(outbox.Send(Message{To: "b@example.com", Subject: "second", Body: "2"}))
+
+	data, err := os.ReadFile(path)
+	asserts.NoError(err)
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	asserts.Len(lines, 2, "every email should be one line")
+	var message Message
+	asserts.NoError(json.Unmarshal(lines[1], &message))
+	asserts.Equal("b@example.com", message.To)
+}
+
+// ===========================
+// TOTP TESTS
+// ===========================
+
+func TestTOTP(t *testing.T) {
+	asserts := assert.New(t)
+	// Test vector of RFC 6238 appendix B for SHA1
+	asserts.Equal("94287082", hotp([]byte("12345678901234567890"), uint64(TOTPCounter(time.Unix(59, 0))), 8))
+	asserts.Equal("07081804", hotp([]byte("12345678901234567890"), uint64(TOTPCounter(time.Unix(1111111109, 0))), 8))
+
+	secret := GenerateTOTPSecret()
+	asserts.Len(secret, 32)
+	now := time.Now()
+	code, err := TOTPCode(secret, now)
+	asserts.NoError(err)
+	counter, ok := ValidateTOTP(secret, code, now)
+	asserts.True(ok)
+	asserts.Equal(TOTPCounter(now), counter)
+	_, ok = ValidateTOTP(secret, code, now.Add(TOTPPeriod*time.Second))
+	asserts.True(ok, "one step of clock drift should be accepted")
+	_, ok = ValidateTOTP(secret, code, now.Add(3*TOTPPeriod*time.Second))
+	asserts.False(ok, "old code should be refused")
+	_, ok = ValidateTOTP(secret, "12345", now)
+	asserts.False(ok)
+}
+
+// ===========================
+// BLOB STORE AND IMAGE TESTS
+// ===========================
+
+func TestLocalBlobStore(t *testing.T) {
+	asserts := assert.New(t)
+	store := &LocalBlobStore{Dir: t.TempDir(), BaseURL: "http://localhost:8080/uploads/"}
+	asserts.NoError(store.Put("avatars/1/abc/64.jpg", bytes.NewReader([]byte("image")), "image/jpeg"))
+	data, err := os.ReadFile(filepath.Join(store.Dir, "avatars", "1", "abc", "64.jpg"))
+	asserts.NoError(err)
+	asserts.Equal("image", string(data))
+	asserts.Equal("http://localhost:8080/uploads/avatars/1/abc/64.jpg", store.URL("avatars/1/abc/64.jpg"))
+
+	for _, key := range []string{"", "../outside.jpg", "avatars/../../outside.jpg", "/etc/passwd", "avatars\\..\\x.jpg"} {
+		asserts.ErrorIs(store.Put(key, bytes.NewReader(nil), "image/jpeg"), ErrBlobKeyInvalid, "key %q should be refused", key)
+	}
+
+	asserts.NoError(store.Delete("avatars/1/abc/64.jpg"))
+	asserts.NoError(store.Delete("avatars/1/abc/64.jpg"), "deleting a missing file should not fail")
+}
+
+// A JPEG whose APP1 segment carries the given EXIF orientation
+func jpegWithOrientation(t *testing.T, img image.Image, orientation uint16) []byte {
+	data, err := EncodeJPEG(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 1, 0, 0x12, 0x01, 3, 0, 1, 0, 0, 0, byte(orientation), 0, 0, 0, 0, 0, 0, 0}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	segment = append(segment, payload...)
+	return append(append([]byte{0xFF, 0xD8}, segment...), data[2:]...)
+}
+
+func TestDecodeImage(t *testing.T) {
+	asserts := assert.New(t)
+	// Wider than high, the left half is red and the right half is blue
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			if x < 32 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+
+	decoded, orientation, err := DecodeImage(jpegWithOrientation(t, img, 6))
+	asserts.NoError(err)
+	asserts.Equal(6, orientation)
+	asserts.Equal(64, decoded.Bounds().Dx())
+
+	var encoded bytes.Buffer
+	asserts.NoError(png.Encode(&encoded, img))
+	_, orientation, err = DecodeImage(encoded.Bytes())
+	asserts.NoError(err)
+	asserts.Equal(1, orientation, "a PNG has no EXIF orientation")
+
+	_, _, err = DecodeImage([]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"))
+	asserts.ErrorIs(err, ErrImageUnsupported)
+
+	// The center square is red on the left and blue on the right, orientation 6 turns it clockwise
+	thumbnail := SquareThumbnail(img, 1, 16)
+	asserts.Equal(image.Rect(0, 0, 16, 16), thumbnail.Bounds())
+	r, _, b, _ := thumbnail.At(2, 8).RGBA()
+	asserts.True(r > b, "the left of the thumbnail should be red")
+	turned := SquareThumbnail(img, 6, 16)
+	r, _, b, _ = turned.At(8, 2).RGBA()
+	asserts.True(r > b, "the top of the turned thumbnail should be red")
+	r, _, b, _ = turned.At(8, 13).RGBA()
+	asserts.True(b > r, "the bottom of the turned thumbnail should be blue")
+}
+
+// ===========================
+// PASSWORD POLICY TESTS
+// ===========================
+
+func TestPasswordPolicy(t *testing.T) {
+	asserts := assert.New(t)
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "breached.txt")
+	// "letmein123" in plain text, "qwerty12345" as its SHA-1 with a count
+	asserts.NoError(os.WriteFile(listPath, []byte("letmein123\n4E17A448E043206801B95DE317E07C839770C8B8:9999\n"), 0644))
+	rangeDir := filepath.Join(dir, "ranges")
+	asserts.NoError(os.Mkdir(rangeDir, 0755))
+	// The SHA-1 of "password123" is CBFDAC6008F9CAB4083784CBD1874F76618D2A97
+	asserts.NoError(os.WriteFile(filepath.Join(rangeDir, "CBFDA.txt"), []byte("0000000000000000000000000000000000A:1\nC6008F9CAB4083784CBD1874F76618D2A97:250000\n"), 0644))
+
+	previous := GetPasswordPolicy()
+	defer SetPasswordPolicy(previous)
+	SetPasswordPolicy(PasswordPolicy{
+		MinLengthRule{Min: 10},
+		CharacterClassesRule{Min: 2},
+		NewBreachedPasswordRule(listPath),
+		NewBreachedPasswordRule(rangeDir),
+		SimilarityRule{},
+	})
+
+	cases := []struct {
+		password string
+		expected string
+	}{
+		{"shortpw1", "{min: 10}"},
+		{"onlyletters", "{classes: 2}"},
+		{"letmein123", "{key: breached}"},
+		{"qwerty12345", "{key: breached}"},
+		{"qwerty1234", ""},
+		{"password123", "{key: breached}"},
+		{"Johnny-Walker9", "{key: similar}"},
+		{"johnny@example", "{key: similar}"},
+		{"jonhyy.exampl", ""},
+		{"correct-horse-battery", ""},
+	}
+	for _, testData := range cases {
+		err := ValidatePassword(testData.password, "johnny", "johnny@example.com")
+		if testData.expected == "" {
+			asserts.NoError(err, "%q should be accepted", testData.password)
+			continue
+		}
+		asserts.Error(err, "%q should be refused", testData.password)
+		if err != nil {
+			asserts.Equal(testData.expected, NewValidatorError(err).Errors["Password"], "%q", testData.password)
+		}
+	}
+	asserts.Error(ValidatePassword("johnnyy-walker", "johnny-walkers"), "a few edits away from the username should be refused")
+	asserts.NoError(ValidatePassword("bob-rocks-1", "bob"), "short usernames are not checked")
+}
+
+func TestBreachedPasswordListMissing(t *testing.T) {
+	asserts := assert.New(t)
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	rule := NewBreachedPasswordRule(missing)
+	asserts.Error(rule.Load())
+	tag, _ := rule.Check("letmein123", nil)
+	asserts.Empty(tag, "an unreadable list refuses no password")
+
+	previous := PasswordBreachedList
+	defer func() { PasswordBreachedList = previous }()
+	PasswordBreachedList = missing
+	asserts.Panics(func() { DefaultPasswordPolicy() }, "the server should not start without its list")
+}
+
+// ===========================
+// PASSWORD HASHING TESTS
+// ===========================
+
+func TestPasswordHashing(t *testing.T) {
+	asserts := assert.New(t)
+	previous := GetPasswordHasher()
+	defer SetPasswordHasher(previous)
+	argon := Argon2idHasher{Memory: 1024, Time: 1, Threads: 1, KeyLength: 32, SaltLength: 16}
+
+	SetPasswordHasher(BcryptHasher{Cost: 4})
+	bcryptHash, err := HashPassword("password0")
+	asserts.NoError(err)
+	asserts.True(strings.HasPrefix(bcryptHash, "$2a$04$"), "the cost should be encoded in the hash")
+	rehash, err := VerifyPassword(bcryptHash, "password0")
+	asserts.NoError(err)
+	asserts.False(rehash)
+	_, err = VerifyPassword(bcryptHash, "password1")
+	asserts.ErrorIs(err, ErrPasswordMismatch)
+
+	long := strings.Repeat("a", 80)
+	longHash, err := HashPassword(long)
+	asserts.NoError(err, "passwords longer than 72 bytes should be hashed")
+	_, err = VerifyPassword(longHash, long[:72])
+	asserts.ErrorIs(err, ErrPasswordMismatch, "long passwords should not be truncated")
+
+	SetPasswordHasher(BcryptHasher{Cost: 5})
+	rehash, err = VerifyPassword(bcryptHash, "password0")
+	asserts.NoError(err)
+	asserts.True(rehash, "a lower cost should be upgraded")
+
+	SetPasswordHasher(argon)
+	rehash, err = VerifyPassword(bcryptHash, "password0")
+	asserts.NoError(err, "bcrypt hashes should still verify after switching to argon2id")
+	asserts.True(rehash, "bcrypt hashes should be upgraded to argon2id")
+	argonHash, err := HashPassword("password0")
+	asserts.NoError(err)
+	asserts.Regexp(`^\$argon2id\$v=19\$m=1024,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`, argonHash)
+	rehash, err = VerifyPassword(argonHash, "password0")
+	asserts.NoError(err)
+	asserts.False(rehash)
+	_, err = VerifyPassword(argonHash, "password1")
+	asserts.ErrorIs(err, ErrPasswordMismatch)
+
+	SetPasswordHasher(Argon2idHasher{Memory: 2048, Time: 1, Threads: 1, KeyLength: 32, SaltLength: 16})
+	rehash, err = VerifyPassword(argonHash, "password0")
+	asserts.NoError(err, "the parameters should be read from the hash")
+	asserts.True(rehash, "older argon2id parameters should be upgraded")
+
+	for _, hash := range []string{"", "!", "$argon2id$v=19$m=1024$abc$def", "plain text"} {
+		_, err = VerifyPassword(hash, "password0")
+		asserts.ErrorIs(err, ErrPasswordHashUnknown, "%q should not verify", hash)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.Equal("<h1>Title</h1>\n<p>Some <em>text</em> and <code>code</code></p>\n", RenderMarkdown("# Title\n\nSome *text* and `code`"))
+	asserts.Equal("<p><del>old</del> <a href=\"https://example.com\" rel=\"nofollow\">https://example.com</a></p>\n",
+		RenderMarkdown("~~old~~ https://example.com"), "GFM strikethrough and autolinks")
+	asserts.Contains(RenderMarkdown("| a |\n|---|\n| b |"), "<td>b</td>", "GFM tables")
+	asserts.Contains(RenderMarkdown("- [x] done"), `<input checked="" disabled="" type="checkbox"`, "GFM task lists")
+	asserts.Contains(RenderMarkdown("```go\nfmt.Println()\n```"), `<code class="language-go">`)
+
+	unsafe := RenderMarkdown("<script>alert(1)</script>\n\n<img src=x onerror=alert(1)> [link](javascript:alert(1)) <b style=\"color:red\">bold</b>")
+	asserts.NotContains(unsafe, "<script")
+	asserts.NotContains(unsafe, "onerror")
+	asserts.NotContains(unsafe, "javascript:")
+	asserts.NotContains(unsafe, "style=")
+	asserts.Contains(unsafe, "<b>bold</b>", "allowed raw HTML is kept")
+}
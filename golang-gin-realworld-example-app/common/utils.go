@@ -2,9 +2,15 @@
 package common
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"math/rand"
+	mathrand "math/rand"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -20,7 +26,7 @@ var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ012345
 func RandString(n int) string {
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+		b[i] = letters[mathrand.Intn(len(letters))]
 	}
 	return string(b)
 }
@@ -41,16 +47,206 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// Lifetime of the tokens, a short access token is refreshed with a long living refresh token.
+//
+//	export JWT_ACCESS_TTL="15m"
+//	export JWT_REFRESH_TTL="720h"
+var AccessTokenTTL = getEnvDurationOrDefault("JWT_ACCESS_TTL", 15*time.Minute)
+var RefreshTokenTTL = getEnvDurationOrDefault("JWT_REFRESH_TTL", 30*24*time.Hour)
+
+// Lifetime of the password reset tokens sent by email.
+//
+//	export PASSWORD_RESET_TTL="1h"
+var PasswordResetTTL = getEnvDurationOrDefault("PASSWORD_RESET_TTL", time.Hour)
+
+// Lifetime of the email verification tokens, and whether an unverified account could write content.
+//
+//	export EMAIL_VERIFICATION_TTL="48h"
+//	export REQUIRE_VERIFIED_EMAIL="true"
+var EmailVerificationTTL = getEnvDurationOrDefault("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+var RequireVerifiedEmail = getEnvBoolOrDefault("REQUIRE_VERIFIED_EMAIL", false)
+
+// What happens to the articles and comments of a deleted account. They are kept under a "deleted user"
+// placeholder by default, set it to false to remove them with the account.
+//
+//	export KEEP_DELETED_USER_CONTENT="true"
+var KeepDeletedUserContent = getEnvBoolOrDefault("KEEP_DELETED_USER_CONTENT", true)
+
+// The largest avatar upload accepted, in bytes.
+//
+//	export AVATAR_MAX_BYTES="5242880"
+var AvatarMaxBytes = getEnvIntOrDefault("AVATAR_MAX_BYTES", 5<<20)
+
+// How often the server looks for scheduled articles to publish.
+//
+//	export ARTICLE_PUBLISH_INTERVAL="1m"
+var ArticlePublishInterval = getEnvDurationOrDefault("ARTICLE_PUBLISH_INTERVAL", time.Minute)
+
+// How long deleted articles and comments stay in the trash of their author before they are removed
+// for good, and how often the server looks for the expired ones.
+//
+//	export TRASH_RETENTION="720h"
+//	export TRASH_PURGE_INTERVAL="1h"
+var TrashRetention = getEnvDurationOrDefault("TRASH_RETENTION", 30*24*time.Hour)
+var TrashPurgeInterval = getEnvDurationOrDefault("TRASH_PURGE_INTERVAL", time.Hour)
+
+// How deep replies to comments could nest, a comment on the article itself is at depth 1.
+//
+//	export COMMENT_MAX_DEPTH="5"
+var CommentMaxDepth = getEnvIntOrDefault("COMMENT_MAX_DEPTH", 5)
+
+// Same as getEnvOrDefault, but keep quiet for the settings which are fine to leave unset
+func getEnvDefaultQuiet(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// Same as getEnvOrDefault, but split the value on commas and keep quiet when it is not set
+func getEnvListOrDefault(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Same as getEnvOrDefault, but parse the value with strconv.ParseBool
+func getEnvBoolOrDefault(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// Same as getEnvOrDefault, but parse the value with strconv.Atoi and keep quiet when it is not set
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		fmt.Printf("WARNING: %s is not a positive number, using default value %v\n", key, defaultValue)
+		return defaultValue
+	}
+	return number
+}
+
+// Same as getEnvOrDefault, but parse the value with time.ParseDuration and keep quiet when it is not set
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("WARNING: %s is not a valid duration, using default value %v\n", key, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
+
 // A Util function to generate jwt_token which can be used in the request header
+//
+// Every token carries an unique `jti` so that it could be revoked before it expires,
+// and the `kid` header of the key which signed it.
+//
+// It panics when the token could not be signed, like RandToken, the handlers use GenSessionToken.
 func GenToken(id uint) string {
-	// Create token with claims
-	jwt_token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	token, err := GenSessionToken(id, 0)
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+// Same as GenToken, but the token belongs to a session and stops working once the session is revoked.
+//
+// The session ID goes in the `sid` claim, 0 means no session. It fails when the keyring has no active
+// signing key.
+func GenSessionToken(id uint, sessionID uint) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"id":  id,
+		"jti": RandToken(16),
+		"iat": jwt.NewNumericDate(now),
+		"exp": jwt.NewNumericDate(now.Add(AccessTokenTTL)),
+	}
+	if sessionID != 0 {
+		claims["sid"] = sessionID
+	}
+	// Sign with the active key of the keyring and get the complete encoded token as a string
+	return Keys.Sign(claims)
+}
+
+// Brute-force protection of the login, failures are counted per account and per client IP.
+//
+// Once a counter reaches its threshold the login is locked for LoginLockoutBase, doubled by every
+// further failure up to LoginLockoutMax. Counters are forgotten after LoginFailureWindow without failures,
+// counted from the end of the last lockout.
+//
+//	export LOGIN_MAX_ACCOUNT_FAILURES="5"
+//	export LOGIN_MAX_IP_FAILURES="20"
+//	export LOGIN_LOCKOUT_BASE="1m"
+//	export LOGIN_LOCKOUT_MAX="1h"
+//	export LOGIN_FAILURE_WINDOW="15m"
+var LoginMaxAccountFailures = getEnvIntOrDefault("LOGIN_MAX_ACCOUNT_FAILURES", 5)
+var LoginMaxIPFailures = getEnvIntOrDefault("LOGIN_MAX_IP_FAILURES", 20)
+var LoginLockoutBase = getEnvDurationOrDefault("LOGIN_LOCKOUT_BASE", time.Minute)
+var LoginLockoutMax = getEnvDurationOrDefault("LOGIN_LOCKOUT_MAX", time.Hour)
+var LoginFailureWindow = getEnvDurationOrDefault("LOGIN_FAILURE_WINDOW", 15*time.Minute)
+
+// The reverse proxies in front of the server, as IPs or CIDRs separated by commas. The client IP, which the
+// login lockout and the audit log rely on, is only taken from X-Forwarded-For when the request comes from
+// one of them. None is trusted by default, the client IP is then the address of the connection.
+//
+//	export TRUSTED_PROXIES="10.0.0.0/8,192.168.1.2"
+var TrustedProxies = getEnvListOrDefault("TRUSTED_PROXIES", nil)
+
+// Tokens with a `typ` claim are refused by AuthMiddleware, they are only good for one step of a flow.
+const MFAChallengeTokenType = "mfa_pending"
+
+var MFAChallengeTTL = getEnvDurationOrDefault("MFA_CHALLENGE_TTL", 5*time.Minute)
+
+// A Util function to generate a short-lived token for one step of a flow, e.g. the second factor of a login
+//
+//	challenge, err := GenChallengeToken(userModel.ID, MFAChallengeTokenType, MFAChallengeTTL)
+func GenChallengeToken(id uint, typ string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return Keys.Sign(jwt.MapClaims{
 		"id":  id,
-		"exp": jwt.NewNumericDate(time.Now().Add(time.Hour * 24)),
+		"typ": typ,
+		"jti": RandToken(16),
+		"iat": jwt.NewNumericDate(now),
+		"exp": jwt.NewNumericDate(now.Add(ttl)),
 	})
-	// Sign and get the complete encoded token as a string
-	token, _ := jwt_token.SignedString([]byte(NBSecretPassword))
-	return token
+}
+
+// A helper function to generate an unguessable url-safe token from n random bytes,
+// use it for everything that works as a credential.
+func RandToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Tokens stored in database are hashed, so a leaked table could not be replayed.
+//
+//	db.Where(&RefreshTokenModel{TokenHash: common.HashToken(token)}).First(&model)
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 // My own Error type that will help return my customized Error info
@@ -94,3 +290,25 @@ func Bind(c *gin.Context, obj interface{}) error {
 	b := binding.Default(c.Request.Method, c.ContentType())
 	return c.ShouldBindWith(obj, b)
 }
+
+// The largest page a list endpoint returns, whatever the limit asked for
+const MaxPageLimit = 100
+
+// You could read the `limit` and `offset` query parameters of a list endpoint, like the article list
+// they default to 20 and 0. Invalid values fall back to the defaults.
+//
+//	limit, offset := common.Pagination(c)
+func Pagination(c *gin.Context) (int, int) {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+	offset, err := strconv.Atoi(c.Query("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 
 	"realworld-backend/articles"
+	"realworld-backend/audit"
 	"realworld-backend/common"
 	"realworld-backend/users"
 
@@ -16,11 +18,8 @@ import (
 
 func Migrate(db *gorm.DB) {
 	users.AutoMigrate()
-	db.AutoMigrate(&articles.ArticleModel{})
-	db.AutoMigrate(&articles.TagModel{})
-	db.AutoMigrate(&articles.FavoriteModel{})
-	db.AutoMigrate(&articles.ArticleUserModel{})
-	db.AutoMigrate(&articles.CommentModel{})
+	audit.AutoMigrate()
+	articles.AutoMigrate()
 
 	// Performance optimization: Add database indexes
 	db.Model(&articles.ArticleModel{}).AddIndex("idx_articles_author", "author_id")
@@ -35,14 +34,40 @@ func main() {
 	db := common.Init()
 	Migrate(db)
 	defer db.Close()
+	common.InitMailer()
+	common.InitBlobStore()
+	users.InitOIDCProviders()
+
+	// Maintenance commands run instead of the server, see cli.go
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Scheduled articles are published in the background, see articles/scheduler.go
+	stopPublishScheduler := articles.StartPublishScheduler(common.ArticlePublishInterval)
+	defer stopPublishScheduler()
+	// Deleted articles and comments leave the trash for good after the retention, see articles/trash.go
+	stopTrashPurger := articles.StartTrashPurger(common.TrashPurgeInterval, common.TrashRetention)
+	defer stopTrashPurger()
 
 	r := gin.Default()
+	// The client IP is only read from X-Forwarded-For behind a trusted proxy, see common.TrustedProxies
+	if err := r.SetTrustedProxies(common.TrustedProxies); err != nil {
+		fmt.Println("invalid TRUSTED_PROXIES:", err)
+		os.Exit(1)
+	}
+	r.Use(audit.RequestIDMiddleware())
 
 	// Configure CORS
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:4100"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", audit.RequestIDHeader},
+		ExposeHeaders:    []string{audit.RequestIDHeader},
 		AllowCredentials: true,
 	}))
 
@@ -67,6 +92,10 @@ func main() {
 		c.Next()
 	})
 
+	users.WellKnownRegister(r.Group("/.well-known"))
+	// The uploaded avatars, see common/blobstore.go
+	r.Static(common.BlobRoute, common.BlobDir)
+
 	v1 := r.Group("/api")
 	users.UsersRegister(v1.Group("/users"))
 	v1.Use(users.AuthMiddleware(false))
@@ -76,6 +105,7 @@ func main() {
 	v1.Use(users.AuthMiddleware(true))
 	users.UserRegister(v1.Group("/user"))
 	users.ProfileRegister(v1.Group("/profiles"))
+	users.AdminRegister(v1.Group("/admin"))
 
 	articles.ArticlesRegister(v1.Group("/articles"))
 
@@ -91,14 +121,16 @@ func main() {
 	tx1 := db.Begin()
 
 	// Hash the password for seed user
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword123"), bcrypt.DefaultCost)
+	hashedPassword, _ := common.HashPassword("testpassword123")
+	verifiedAt := time.Now()
 
 	userA := users.UserModel{
 		Username:     "AAAAAAAAAAAAAAAA",
 		Email:        "aaaa@g.cn",
 		Bio:          "seed user for testing",
 		Image:        nil,
-		PasswordHash: string(hashedPassword),
+		PasswordHash: hashedPassword,
+		VerifiedAt:   &verifiedAt,
 	}
 
 	// Check if user already exists before saving
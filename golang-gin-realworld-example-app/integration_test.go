@@ -1,43 +1,45 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"realworld-backend/articles"
+	"realworld-backend/audit"
 	"realworld-backend/common"
 	"realworld-backend/users"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"github.com/stretchr/testify/assert"
 )
 
 // Setup test router with all routes
 func setupTestRouter() *gin.Engine {
 	router := gin.Default()
-	db := common.TestDBInit()
+	common.TestDBInit()
 
 	// Migrate tables
 	users.AutoMigrate()
-	db.AutoMigrate(&articles.ArticleModel{})
-	db.AutoMigrate(&articles.TagModel{})
-	db.AutoMigrate(&articles.FavoriteModel{})
-	db.AutoMigrate(&articles.ArticleUserModel{})
-	db.AutoMigrate(&articles.CommentModel{})
+	audit.AutoMigrate()
+	articles.AutoMigrate()
 
 	v1 := router.Group("/api")
 
-	// Public routes
+	// Public routes, the article routes see the user when a token is sent like in hello.go
 	users.UsersRegister(v1.Group("/users"))
+	v1.Use(users.AuthMiddleware(false))
 	articles.ArticlesAnonymousRegister(v1.Group("/articles"))
 	articles.TagsAnonymousRegister(v1.Group("/tags"))
 
 	// Authenticated routes
-	v1.Use(users.AuthMiddleware(false))
 	users.UserRegister(v1.Group("/user"))
 	users.ProfileRegister(v1.Group("/profiles"))
 	articles.ArticlesRegister(v1.Group("/articles"))
@@ -641,3 +643,1200 @@ func TestGetTags(t *testing.T) {
 		asserts.Contains(response, "tags", "Response should contain tags array")
 	}
 }
+
+// ==============================================
+// PART 4: AUTHORIZATION INTEGRATION TESTS
+// ==============================================
+
+// The integration database is shared between runs, so every fixture gets a random suffix.
+func createUniqueTestUser(t *testing.T, router *gin.Engine, prefix string) (string, string) {
+	username := prefix + common.RandString(8)
+	token, response := createTestUser(t, router, username, username+"@example.com", "password123")
+	if token == "" {
+		t.Fatalf("failed to create user %s: %v", username, response)
+	}
+	return token, username
+}
+
+// Test helper to send a JSON request with an optional token
+func performRequest(router *gin.Engine, method, url, token string, body interface{}) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body != nil {
+		bodyBytes, _ := json.Marshal(body)
+		req, _ = http.NewRequest(method, url, bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req, _ = http.NewRequest(method, url, nil)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// Test helper to create an article and return its slug
+func createTestArticle(t *testing.T, router *gin.Engine, token string) string {
+	w := performRequest(router, "POST", "/api/articles/", token, map[string]interface{}{
+		"article": map[string]interface{}{
+			"title":       "Authz Article " + common.RandString(8),
+			"description": "Description",
+			"body":        "Body",
+		},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to create article: %d %s", w.Code, w.Body.String())
+	}
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response["article"].(map[string]interface{})["slug"].(string)
+}
+
+// Test helper to comment on an article and return the comment id
+func createTestComment(t *testing.T, router *gin.Engine, token, slug string) uint {
+	w := performRequest(router, "POST", "/api/articles/"+slug+"/comments", token, map[string]interface{}{
+		"comment": map[string]string{"body": "Authz comment"},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to create comment: %d %s", w.Code, w.Body.String())
+	}
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return uint(response["comment"].(map[string]interface{})["id"].(float64))
+}
+
+func promoteTestUser(username, role string) {
+	userModel, _ := users.FindOneUser(&users.UserModel{Username: username})
+	users.GrantRole(userModel.ID, role)
+}
+
+// Test 19: Only the author could update an article
+func TestUpdateArticleForbiddenForOtherUser(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	authorToken, _ := createUniqueTestUser(t, router, "authzauthor")
+	otherToken, _ := createUniqueTestUser(t, router, "authzother")
+	slug := createTestArticle(t, router, authorToken)
+
+	w := performRequest(router, "PUT", "/api/articles/"+slug, otherToken, map[string]interface{}{
+		"article": map[string]interface{}{"title": "Hijacked Title"},
+	})
+	asserts.Equal(http.StatusForbidden, w.Code, "Non author update should return 403")
+	asserts.Equal(`{"errors":{"articles":"You are not the author of this article"}}`, w.Body.String())
+
+	w = performRequest(router, "PUT", "/api/articles/"+slug, authorToken, map[string]interface{}{
+		"article": map[string]interface{}{"title": "Author Title " + common.RandString(8)},
+	})
+	asserts.Equal(http.StatusOK, w.Code, "Author update should return 200")
+}
+
+// Test 20: Only the author could delete an article
+func TestDeleteArticleForbiddenForOtherUser(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	authorToken, _ := createUniqueTestUser(t, router, "authzauthor")
+	otherToken, _ := createUniqueTestUser(t, router, "authzother")
+	slug := createTestArticle(t, router, authorToken)
+
+	w := performRequest(router, "DELETE", "/api/articles/"+slug, otherToken, nil)
+	asserts.Equal(http.StatusForbidden, w.Code, "Non author delete should return 403")
+	asserts.Equal(`{"errors":{"articles":"You are not the author of this article"}}`, w.Body.String())
+
+	w = performRequest(router, "DELETE", "/api/articles/"+slug, "", nil)
+	asserts.Equal(http.StatusForbidden, w.Code, "Anonymous delete should return 403")
+
+	w = performRequest(router, "DELETE", "/api/articles/"+slug, authorToken, nil)
+	asserts.Equal(http.StatusOK, w.Code, "Author delete should return 200")
+
+	w = performRequest(router, "DELETE", "/api/articles/"+slug, authorToken, nil)
+	asserts.Equal(http.StatusNotFound, w.Code, "Deleting a missing article should return 404")
+}
+
+// Test 21: A privileged user could edit and delete any article
+func TestAdminCanModifyAnyArticle(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	authorToken, authorName := createUniqueTestUser(t, router, "authzauthor")
+	adminToken, adminName := createUniqueTestUser(t, router, "authzadmin")
+	promoteTestUser(adminName, users.RoleAdmin)
+	slug := createTestArticle(t, router, authorToken)
+
+	w := performRequest(router, "PUT", "/api/articles/"+slug, adminToken, map[string]interface{}{
+		"article": map[string]interface{}{"title": "Moderated Title " + common.RandString(8)},
+	})
+	asserts.Equal(http.StatusOK, w.Code, "Admin update should return 200")
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	slug = response["article"].(map[string]interface{})["slug"].(string)
+	author := response["article"].(map[string]interface{})["author"].(map[string]interface{})
+	asserts.Equal(authorName, author["username"], "the article should keep its author")
+	w = performRequest(router, "PUT", "/api/articles/"+slug, authorToken, map[string]interface{}{
+		"article": map[string]interface{}{"description": "Still mine"},
+	})
+	asserts.Equal(http.StatusOK, w.Code, "the author should still be able to edit the article")
+
+	w = performRequest(router, "DELETE", "/api/articles/"+slug, adminToken, nil)
+	asserts.Equal(http.StatusOK, w.Code, "Admin delete should return 200")
+}
+
+// Test 22: A comment could only be deleted by its author or the article's author
+func TestDeleteCommentForbiddenForOtherUser(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	authorToken, _ := createUniqueTestUser(t, router, "authzauthor")
+	commenterToken, _ := createUniqueTestUser(t, router, "authzcommenter")
+	otherToken, _ := createUniqueTestUser(t, router, "authzother")
+	slug := createTestArticle(t, router, authorToken)
+
+	firstID := createTestComment(t, router, commenterToken, slug)
+	w := performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, firstID), otherToken, nil)
+	asserts.Equal(http.StatusForbidden, w.Code, "Third party comment delete should return 403")
+	asserts.Equal(`{"errors":{"comment":"You are not allowed to delete this comment"}}`, w.Body.String())
+
+	w = performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, firstID), commenterToken, nil)
+	asserts.Equal(http.StatusOK, w.Code, "Comment author delete should return 200")
+
+	secondID := createTestComment(t, router, commenterToken, slug)
+	w = performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, secondID), authorToken, nil)
+	asserts.Equal(http.StatusOK, w.Code, "Article author delete should return 200")
+}
+
+// Test 23: A comment could not be reached through the slug of another article
+func TestDeleteCommentThroughOtherArticle(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	attackerToken, _ := createUniqueTestUser(t, router, "authzattacker")
+	victimToken, _ := createUniqueTestUser(t, router, "authzvictim")
+	attackerSlug := createTestArticle(t, router, attackerToken)
+	victimSlug := createTestArticle(t, router, victimToken)
+	commentID := createTestComment(t, router, victimToken, victimSlug)
+
+	w := performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", attackerSlug, commentID), attackerToken, nil)
+	asserts.Equal(http.StatusNotFound, w.Code, "Comment of another article should return 404")
+	asserts.Equal(`{"errors":{"comment":"Invalid id"}}`, w.Body.String())
+
+	w = performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", victimSlug, commentID), attackerToken, nil)
+	asserts.Equal(http.StatusForbidden, w.Code, "Comment of another user should return 403")
+}
+
+// ==============================================
+// PART 5: EMAIL VERIFICATION INTEGRATION TESTS
+// ==============================================
+
+// Test 24: Unverified accounts could not write content when the switch is on
+func TestUnverifiedUserCannotWrite(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+	common.RequireVerifiedEmail = true
+	defer func() { common.RequireVerifiedEmail = false }()
+
+	token, username := createUniqueTestUser(t, router, "unverified")
+	w := performRequest(router, "POST", "/api/articles/", token, map[string]interface{}{
+		"article": map[string]interface{}{"title": "Unverified " + common.RandString(8), "body": "Body"},
+	})
+	asserts.Equal(http.StatusForbidden, w.Code, "unverified user should not create articles")
+	asserts.Contains(w.Body.String(), `"email_unverified"`)
+
+	common.GetDB().Model(&users.UserModel{}).Where("username = ?", username).Update("verified_at", time.Now())
+	slug := createTestArticle(t, router, token)
+	asserts.NotEmpty(slug, "verified user should create articles")
+
+	otherToken, _ := createUniqueTestUser(t, router, "unverified")
+	w = performRequest(router, "POST", "/api/articles/"+slug+"/comments", otherToken, map[string]interface{}{
+		"comment": map[string]string{"body": "Unverified comment"},
+	})
+	asserts.Equal(http.StatusForbidden, w.Code, "unverified user should not comment")
+}
+
+// ==============================================
+// PART 6: PERSONAL ACCESS TOKEN INTEGRATION TESTS
+// ==============================================
+
+// Test 25: Personal access tokens only write what their scopes allow
+func TestPersonalAccessTokenScopes(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	token, _ := createUniqueTestUser(t, router, "pat")
+	createAccessToken := func(scopes ...string) string {
+		w := performRequest(router, "POST", "/api/user/tokens", token, map[string]interface{}{
+			"token": map[string]interface{}{"name": "script", "scopes": scopes},
+		})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("failed to create access token: %d %s", w.Code, w.Body.String())
+		}
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response["token"].(map[string]interface{})["token"].(string)
+	}
+	articlesToken := createAccessToken("articles:write")
+	commentsToken := createAccessToken("comments:write")
+
+	slug := createTestArticle(t, router, articlesToken)
+	asserts.NotEmpty(slug, "articles:write should create articles")
+
+	w := performRequest(router, "POST", "/api/articles/", commentsToken, map[string]interface{}{
+		"article": map[string]interface{}{"title": "Scoped " + common.RandString(8), "description": "Description", "body": "Body"},
+	})
+	asserts.Equal(http.StatusForbidden, w.Code, "comments:write should not create articles")
+	asserts.Equal(`{"errors":{"scope":"The token lacks the scope articles:write"}}`, w.Body.String())
+
+	commentID := createTestComment(t, router, commentsToken, slug)
+	asserts.NotZero(commentID, "comments:write should comment")
+	w = performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, commentID), articlesToken, nil)
+	asserts.Equal(http.StatusForbidden, w.Code, "articles:write should not delete comments")
+}
+
+// ==============================================
+// PART 7: ROLE-BASED ACCESS CONTROL INTEGRATION TESTS
+// ==============================================
+
+// Test 26: Moderators could remove content of other users, but not edit it
+func TestModeratorCanRemoveContent(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	authorToken, _ := createUniqueTestUser(t, router, "author")
+	moderatorToken, moderatorName := createUniqueTestUser(t, router, "moderator")
+	promoteTestUser(moderatorName, users.RoleModerator)
+
+	slug := createTestArticle(t, router, authorToken)
+	commentID := createTestComment(t, router, authorToken, slug)
+
+	w := performRequest(router, "PUT", "/api/articles/"+slug, moderatorToken, map[string]interface{}{
+		"article": map[string]interface{}{"body": "Moderated"},
+	})
+	asserts.Equal(http.StatusForbidden, w.Code, "moderator should not edit other users' articles")
+
+	w = performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, commentID), moderatorToken, nil)
+	asserts.Equal(http.StatusOK, w.Code, "moderator should delete other users' comments")
+
+	w = performRequest(router, "DELETE", "/api/articles/"+slug, moderatorToken, nil)
+	asserts.Equal(http.StatusOK, w.Code, "moderator should delete other users' articles")
+}
+
+// ==============================================
+// PART 8: ACCOUNT EXPORT AND DELETION INTEGRATION TESTS
+// ==============================================
+
+// Test helper to delete the account of the token with its password
+func deleteTestAccount(router *gin.Engine, token string) *httptest.ResponseRecorder {
+	return performRequest(router, "DELETE", "/api/user/", token, map[string]interface{}{
+		"user": map[string]string{"password": "password123"},
+	})
+}
+
+// Test 27: The export contains the profile, articles, comments, favorites and follows
+func TestAccountExport(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	token, username := createUniqueTestUser(t, router, "exporter")
+	otherToken, otherName := createUniqueTestUser(t, router, "exported")
+	slug := createTestArticle(t, router, token)
+	createTestComment(t, router, token, slug)
+	otherSlug := createTestArticle(t, router, otherToken)
+	performRequest(router, "POST", "/api/articles/"+otherSlug+"/favorite", token, nil)
+	performRequest(router, "POST", "/api/profiles/"+otherName+"/follow", token, nil)
+
+	w := performRequest(router, "GET", "/api/user/export", token, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	var response struct {
+		Export struct {
+			Profile struct {
+				Username string `json:"username"`
+			} `json:"profile"`
+			Follows struct {
+				Following []string `json:"following"`
+			} `json:"follows"`
+			Articles []struct {
+				Slug string `json:"slug"`
+			} `json:"articles"`
+			Comments []struct {
+				Article string `json:"article"`
+			} `json:"comments"`
+			Favorites []string `json:"favorites"`
+		} `json:"export"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(username, response.Export.Profile.Username)
+	asserts.Equal([]string{otherName}, response.Export.Follows.Following)
+	asserts.Len(response.Export.Articles, 1)
+	asserts.Equal(slug, response.Export.Articles[0].Slug)
+	asserts.Len(response.Export.Comments, 1)
+	asserts.Equal(slug, response.Export.Comments[0].Article)
+	asserts.Equal([]string{otherSlug}, response.Export.Favorites)
+
+	w = performRequest(router, "GET", "/api/user/export?format=zip", token, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("application/zip", w.Header().Get("Content-Type"))
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	asserts.NoError(err)
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	asserts.Equal([]string{"articles.json", "blocks.json", "comments.json", "favorites.json", "follows.json", "profile.json"}, names)
+}
+
+// Test 28: By default the articles and comments of a deleted account stay under the placeholder
+func TestAccountDeletionKeepsContent(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	token, username := createUniqueTestUser(t, router, "leaver")
+	otherToken, _ := createUniqueTestUser(t, router, "stayer")
+	slug := createTestArticle(t, router, token)
+	otherSlug := createTestArticle(t, router, otherToken)
+	createTestComment(t, router, token, otherSlug)
+	performRequest(router, "POST", "/api/articles/"+otherSlug+"/favorite", token, nil)
+	performRequest(router, "POST", "/api/profiles/"+username+"/follow", otherToken, nil)
+
+	w := performRequest(router, "DELETE", "/api/user/", token, map[string]interface{}{
+		"user": map[string]string{"password": "wrongpassword"},
+	})
+	asserts.Equal(http.StatusForbidden, w.Code, "the password is required")
+
+	w = deleteTestAccount(router, token)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(`{"user":"Account deleted"}`, w.Body.String())
+
+	w = performRequest(router, "GET", "/api/user/", token, nil)
+	asserts.NotContains(w.Body.String(), username, "the token of a deleted account should not work")
+	w = performRequest(router, "GET", "/api/profiles/"+username, otherToken, nil)
+	asserts.Equal(http.StatusNotFound, w.Code)
+
+	// The article routes of the test router are anonymous, the content is checked in the database.
+	articleModel, err := articles.FindOneArticle(&articles.ArticleModel{Slug: slug})
+	asserts.NoError(err, "articles should be kept")
+	asserts.Equal(users.DeletedUserUsername, articleModel.Author.UserModel.Username)
+
+	otherArticle, _ := articles.FindOneArticle(&articles.ArticleModel{Slug: otherSlug})
+	var count int
+	common.GetDB().Model(&articles.FavoriteModel{}).Where("favorite_id = ?", otherArticle.ID).Count(&count)
+	asserts.Equal(0, count, "favorites should be removed")
+
+	var comment articles.CommentModel
+	common.GetDB().Where("article_id = ?", otherArticle.ID).First(&comment)
+	asserts.Equal(articleModel.AuthorID, comment.AuthorID, "comments should be kept")
+
+	w = performRequest(router, "GET", "/api/user/export", otherToken, nil)
+	asserts.Contains(w.Body.String(), `"followers":[]`)
+	asserts.NotContains(w.Body.String(), username, "follows should be removed")
+}
+
+// Test 29: With KEEP_DELETED_USER_CONTENT=false the content goes away with the account
+func TestAccountDeletionRemovesContent(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+	common.KeepDeletedUserContent = false
+	defer func() { common.KeepDeletedUserContent = true }()
+
+	token, _ := createUniqueTestUser(t, router, "leaver")
+	otherToken, _ := createUniqueTestUser(t, router, "stayer")
+	slug := createTestArticle(t, router, token)
+	createTestComment(t, router, otherToken, slug)
+	otherSlug := createTestArticle(t, router, otherToken)
+	createTestComment(t, router, token, otherSlug)
+	replied := createTestComment(t, router, token, otherSlug)
+	reply := replyTestComment(router, otherToken, otherSlug, replied)
+	asserts.Equal(http.StatusCreated, reply.Code)
+
+	w := deleteTestAccount(router, token)
+	asserts.Equal(http.StatusOK, w.Code)
+
+	var count int
+	common.GetDB().Unscoped().Model(&articles.ArticleModel{}).Where("slug = ?", slug).Count(&count)
+	asserts.Equal(0, count, "articles should be removed, not only soft deleted")
+
+	otherArticle, _ := articles.FindOneArticle(&articles.ArticleModel{Slug: otherSlug})
+	var remaining []articles.CommentModel
+	common.GetDB().Unscoped().Where("article_id = ?", otherArticle.ID).Order("id").Find(&remaining)
+	asserts.Len(remaining, 2, "comments should be removed, except the one with a reply")
+	asserts.Equal(replied, remaining[0].ID)
+	asserts.Empty(remaining[0].Body)
+	asserts.Zero(remaining[0].AuthorID)
+	asserts.NotNil(remaining[0].DeletedAt)
+	tree := listTestThread(router, otherSlug, "tree")
+	asserts.Len(tree, 1)
+	asserts.Equal("[deleted]", tree[0].Body)
+	asserts.Len(tree[0].Replies, 1, "the reply stays in the thread")
+}
+
+// ==============================================
+// PART 9: BLOCK AND MUTE INTEGRATION TESTS
+// ==============================================
+
+// Test helper to list the comments of an article as seen by the token
+func listTestComments(router *gin.Engine, token, slug string) []string {
+	w := performRequest(router, "GET", "/api/articles/"+slug+"/comments", token, nil)
+	var response struct {
+		Comments []struct {
+			Author struct {
+				Username string `json:"username"`
+			} `json:"author"`
+		} `json:"comments"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	var authors []string
+	for _, comment := range response.Comments {
+		authors = append(authors, comment.Author.Username)
+	}
+	return authors
+}
+
+// Test helper to list the slugs of the feed of the token
+func listTestFeed(router *gin.Engine, token string) []string {
+	w := performRequest(router, "GET", "/api/articles/feed", token, nil)
+	var response struct {
+		Articles []struct {
+			Slug string `json:"slug"`
+		} `json:"articles"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	var slugs []string
+	for _, article := range response.Articles {
+		slugs = append(slugs, article.Slug)
+	}
+	return slugs
+}
+
+// Test 30: A blocked user could not follow or comment, and disappears from the blocker's comments and feed
+func TestBlockUser(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	blockerToken, blockerName := createUniqueTestUser(t, router, "blocker")
+	blockedToken, blockedName := createUniqueTestUser(t, router, "blocked")
+	slug := createTestArticle(t, router, blockerToken)
+	createTestComment(t, router, blockedToken, slug)
+	blockedSlug := createTestArticle(t, router, blockedToken)
+	performRequest(router, "POST", "/api/profiles/"+blockedName+"/follow", blockerToken, nil)
+	asserts.Equal([]string{blockedSlug}, listTestFeed(router, blockerToken))
+
+	w := performRequest(router, "POST", "/api/profiles/"+blockedName+"/block", blockerToken, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"following":false,"blocking":true`, "blocking should remove the follow")
+
+	w = performRequest(router, "POST", "/api/profiles/"+blockerName+"/follow", blockedToken, nil)
+	asserts.Equal(http.StatusForbidden, w.Code)
+	asserts.Equal(`{"errors":{"profile":"You are blocked by this user"}}`, w.Body.String())
+	w = performRequest(router, "POST", "/api/articles/"+slug+"/comments", blockedToken, map[string]interface{}{
+		"comment": map[string]string{"body": "Let me in"},
+	})
+	asserts.Equal(http.StatusForbidden, w.Code)
+	asserts.Equal(`{"errors":{"comment":"You are blocked by the author of this article"}}`, w.Body.String())
+
+	asserts.Empty(listTestComments(router, blockerToken, slug), "comments of blocked users should be hidden from the blocker")
+	asserts.Equal([]string{blockedName}, listTestComments(router, blockedToken, slug), "others still see the comments")
+	asserts.Empty(listTestFeed(router, blockerToken))
+
+	w = performRequest(router, "DELETE", "/api/profiles/"+blockedName+"/block", blockerToken, nil)
+	asserts.Contains(w.Body.String(), `"blocking":false`)
+	asserts.Equal(http.StatusOK, performRequest(router, "POST", "/api/profiles/"+blockerName+"/follow", blockedToken, nil).Code)
+	asserts.Equal([]string{blockedName}, listTestComments(router, blockerToken, slug))
+}
+
+// Test 31: Muting only hides content from the muter
+func TestMuteUser(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	muterToken, muterName := createUniqueTestUser(t, router, "muter")
+	mutedToken, mutedName := createUniqueTestUser(t, router, "muted")
+	slug := createTestArticle(t, router, muterToken)
+	createTestComment(t, router, mutedToken, slug)
+	mutedSlug := createTestArticle(t, router, mutedToken)
+	performRequest(router, "POST", "/api/profiles/"+mutedName+"/follow", muterToken, nil)
+
+	w := performRequest(router, "POST", "/api/profiles/"+mutedName+"/mute", muterToken, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"following":true,"blocking":false,"muting":true`, "muting should keep the follow")
+
+	asserts.Empty(listTestFeed(router, muterToken), "muted users should be hidden from the feed")
+	asserts.Empty(listTestComments(router, muterToken, slug))
+	asserts.NotZero(createTestComment(t, router, mutedToken, slug), "muted users could still comment")
+	asserts.Equal(http.StatusOK, performRequest(router, "POST", "/api/profiles/"+muterName+"/follow", mutedToken, nil).Code)
+
+	performRequest(router, "DELETE", "/api/profiles/"+mutedName+"/mute", muterToken, nil)
+	asserts.Equal([]string{mutedSlug}, listTestFeed(router, muterToken))
+	asserts.Len(listTestComments(router, muterToken, slug), 2)
+}
+
+// ==============================================
+// PART 10: DRAFT AND SCHEDULED ARTICLE TESTS
+// ==============================================
+
+// Test helper to create an article with a status and return the article of the response, a random title
+// is used unless one is given
+func createTestArticleWithStatus(t *testing.T, router *gin.Engine, token string, article map[string]interface{}) map[string]interface{} {
+	if _, ok := article["title"]; !ok {
+		article["title"] = "Status Article " + common.RandString(8)
+	}
+	article["description"] = "Description"
+	article["body"] = "Body"
+	w := performRequest(router, "POST", "/api/articles/", token, map[string]interface{}{"article": article})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("failed to create article: %d %s", w.Code, w.Body.String())
+	}
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response["article"].(map[string]interface{})
+}
+
+// Test helper to list the slugs of an article list
+func listTestArticles(router *gin.Engine, token, url string) []string {
+	w := performRequest(router, "GET", url, token, nil)
+	var response struct {
+		Articles []struct {
+			Slug string `json:"slug"`
+		} `json:"articles"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	var slugs []string
+	for _, article := range response.Articles {
+		slugs = append(slugs, article.Slug)
+	}
+	return slugs
+}
+
+// Test 32: A draft is only seen by its author until it is published
+func TestDraftArticle(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	authorToken, authorName := createUniqueTestUser(t, router, "drafter")
+	readerToken, _ := createUniqueTestUser(t, router, "reader")
+	article := createTestArticleWithStatus(t, router, authorToken, map[string]interface{}{"status": "draft"})
+	slug := article["slug"].(string)
+	asserts.Equal("draft", article["status"])
+	asserts.Nil(article["publishedAt"])
+
+	asserts.Equal(http.StatusOK, performRequest(router, "GET", "/api/articles/"+slug, authorToken, nil).Code)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "GET", "/api/articles/"+slug, readerToken, nil).Code)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "GET", "/api/articles/"+slug, "", nil).Code)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "GET", "/api/articles/"+slug+"/comments", readerToken, nil).Code)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "POST", "/api/articles/"+slug+"/favorite", readerToken, nil).Code)
+	commentID := createTestComment(t, router, authorToken, slug)
+	commentPath := fmt.Sprintf("/api/articles/%s/comments/%d", slug, commentID)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "DELETE", commentPath, readerToken, nil).Code)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "POST", commentPath+"/restore", readerToken, nil).Code)
+	asserts.Empty(listTestArticles(router, authorToken, "/api/articles/?author="+authorName))
+	asserts.Equal([]string{slug}, listTestArticles(router, authorToken, "/api/articles/drafts"))
+	asserts.Equal(http.StatusUnauthorized, performRequest(router, "GET", "/api/articles/drafts", "", nil).Code)
+	asserts.Empty(listTestArticles(router, readerToken, "/api/articles/drafts"))
+
+	w := performRequest(router, "PUT", "/api/articles/"+slug, authorToken, map[string]interface{}{
+		"article": map[string]string{"status": "published"},
+	})
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"status":"published"`)
+	asserts.Equal(http.StatusOK, performRequest(router, "GET", "/api/articles/"+slug, readerToken, nil).Code)
+	asserts.Equal([]string{slug}, listTestArticles(router, readerToken, "/api/articles/?author="+authorName))
+	asserts.Empty(listTestArticles(router, authorToken, "/api/articles/drafts"))
+
+	// Back to draft, the publication time goes away
+	w = performRequest(router, "PUT", "/api/articles/"+slug, authorToken, map[string]interface{}{
+		"article": map[string]string{"status": "draft"},
+	})
+	asserts.Contains(w.Body.String(), `"status":"draft","publishedAt":null`)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "GET", "/api/articles/"+slug, readerToken, nil).Code)
+}
+
+// Test 33: A scheduled article goes live at its time, the scheduler flips its status
+func TestScheduledArticle(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	authorToken, authorName := createUniqueTestUser(t, router, "scheduler")
+	readerToken, _ := createUniqueTestUser(t, router, "reader")
+	performRequest(router, "POST", "/api/profiles/"+authorName+"/follow", readerToken, nil)
+
+	w := performRequest(router, "POST", "/api/articles/", authorToken, map[string]interface{}{
+		"article": map[string]interface{}{"title": "Too Late", "status": "scheduled", "publishedAt": time.Now().Add(-time.Hour)},
+	})
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"publishedAt":"should be in the future"}}`, w.Body.String())
+	w = performRequest(router, "POST", "/api/articles/", authorToken, map[string]interface{}{
+		"article": map[string]interface{}{"title": "Unknown Status", "status": "hidden"},
+	})
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+
+	article := createTestArticleWithStatus(t, router, authorToken, map[string]interface{}{
+		"status": "scheduled", "publishedAt": time.Now().Add(time.Hour),
+	})
+	slug := article["slug"].(string)
+	asserts.Equal("scheduled", article["status"])
+	asserts.NotNil(article["publishedAt"])
+	asserts.Equal(http.StatusNotFound, performRequest(router, "GET", "/api/articles/"+slug, readerToken, nil).Code)
+	asserts.Empty(listTestFeed(router, readerToken))
+	asserts.Equal([]string{slug}, listTestArticles(router, authorToken, "/api/articles/drafts"))
+
+	_, err := articles.PublishDueArticles(time.Now())
+	asserts.NoError(err)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "GET", "/api/articles/"+slug, readerToken, nil).Code, "not due yet")
+
+	// Past its time but not yet published by the scheduler, an edit keeps it scheduled
+	common.GetDB().Model(&articles.ArticleModel{}).Where("slug = ?", slug).UpdateColumn("published_at", time.Now().Add(-time.Minute))
+	w = performRequest(router, "PUT", "/api/articles/"+slug, authorToken, map[string]interface{}{
+		"article": map[string]string{"title": "Edited While Due"},
+	})
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"status":"scheduled"`)
+
+	// Two hours later the scheduler publishes it
+	count, err := articles.PublishDueArticles(time.Now().Add(2 * time.Hour))
+	asserts.NoError(err)
+	asserts.NotZero(count)
+	w = performRequest(router, "GET", "/api/articles/"+slug, readerToken, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"status":"published"`)
+	asserts.Equal([]string{slug}, listTestFeed(router, readerToken))
+	asserts.Empty(listTestArticles(router, authorToken, "/api/articles/drafts"))
+
+	// A published article keeps its first publication time
+	w = performRequest(router, "PUT", "/api/articles/"+slug, authorToken, map[string]interface{}{
+		"article": map[string]interface{}{"title": "Edited While Due", "publishedAt": time.Now().Add(-48 * time.Hour)},
+	})
+	asserts.Equal(http.StatusOK, w.Code)
+	var published articles.ArticleModel
+	common.GetDB().Where("slug = ?", slug).First(&published)
+	asserts.WithinDuration(time.Now().Add(-time.Minute), *published.PublishedAt, 5*time.Second)
+}
+
+// ==============================================
+// PART 11: ARTICLE REVISION TESTS
+// ==============================================
+
+// Test helper to list the revisions of an article
+func listTestRevisions(router *gin.Engine, token, slug string) []articles.RevisionResponse {
+	w := performRequest(router, "GET", "/api/articles/"+slug+"/revisions", token, nil)
+	var response struct {
+		Revisions []articles.RevisionResponse `json:"revisions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response.Revisions
+}
+
+// Test 34: Every change of the content is kept as a revision, restoring adds one
+func TestArticleRevisions(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	authorToken, authorName := createUniqueTestUser(t, router, "reviser")
+	otherToken, otherName := createUniqueTestUser(t, router, "editor")
+	slug := createTestArticle(t, router, authorToken)
+
+	revisions := listTestRevisions(router, "", slug)
+	asserts.Len(revisions, 1, "the creation is the first revision")
+	asserts.Equal(uint(1), revisions[0].Number)
+	asserts.Equal(authorName, revisions[0].Author.Username)
+
+	w := performRequest(router, "PUT", "/api/articles/"+slug, authorToken, map[string]interface{}{
+		"article": map[string]string{"body": "The slow brown fox\njumps"},
+	})
+	asserts.Equal(http.StatusOK, w.Code)
+	performRequest(router, "PUT", "/api/articles/"+slug, authorToken, map[string]interface{}{
+		"article": map[string]string{"status": "published"},
+	})
+	revisions = listTestRevisions(router, "", slug)
+	asserts.Len(revisions, 2, "only changes of the content are revisions")
+	asserts.Equal(uint(2), revisions[0].Number, "latest first")
+	asserts.Equal("The slow brown fox\njumps", revisions[0].Body)
+
+	w = performRequest(router, "GET", "/api/articles/"+slug+"/revisions/diff", "", nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"from":1,"to":2,"format":"unified","title":"","description":"","body":"--- revision 1/body\n+++ revision 2/body\n@@ -1 +1,2 @@\n-Body\n+The slow brown fox\n+jumps\n"`)
+	w = performRequest(router, "GET", "/api/articles/"+slug+"/revisions/diff?from=1&to=2&format=words", "", nil)
+	asserts.Contains(w.Body.String(), `"body":[{"op":"delete","text":"Body"},{"op":"insert","text":"The slow brown fox\njumps"}]`)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "GET", "/api/articles/"+slug+"/revisions/diff?from=1&to=9", "", nil).Code)
+	asserts.Equal(http.StatusUnprocessableEntity, performRequest(router, "GET", "/api/articles/"+slug+"/revisions/diff?format=html", "", nil).Code)
+
+	// Only the author restores, even a moderator could not
+	promoteTestUser(otherName, "moderator")
+	w = performRequest(router, "POST", "/api/articles/"+slug+"/revisions/1/restore", otherToken, nil)
+	asserts.Equal(http.StatusForbidden, w.Code)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "POST", "/api/articles/"+slug+"/revisions/9/restore", authorToken, nil).Code)
+	w = performRequest(router, "POST", "/api/articles/"+slug+"/revisions/1/restore", authorToken, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"body":"Body"`)
+
+	revisions = listTestRevisions(router, "", slug)
+	asserts.Len(revisions, 3, "a restore adds a revision instead of removing the later ones")
+	asserts.Equal(uint(1), revisions[0].RestoredFrom)
+	asserts.Equal("Body", revisions[0].Body)
+	asserts.Equal("The slow brown fox\njumps", revisions[1].Body)
+}
+
+// ==============================================
+// PART 12: SEARCH TESTS
+// ==============================================
+
+// Test helper to search articles and return the slugs, the snippets and the count
+func searchTestArticles(router *gin.Engine, query string) ([]string, []string, int) {
+	w := performRequest(router, "GET", "/api/articles/search?q="+query, "", nil)
+	var response struct {
+		Articles []struct {
+			Slug    string `json:"slug"`
+			Snippet string `json:"snippet"`
+		} `json:"articles"`
+		ArticlesCount int `json:"articlesCount"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	var slugs, snippets []string
+	for _, article := range response.Articles {
+		slugs = append(slugs, article.Slug)
+		snippets = append(snippets, article.Snippet)
+	}
+	return slugs, snippets, response.ArticlesCount
+}
+
+// Test 35: Search finds published articles by their words and tags, and follows their changes
+func TestArticleSearch(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	token, _ := createUniqueTestUser(t, router, "searcher")
+	word := "zebra" + strings.ToLower(common.RandString(8))
+	tag := "tag" + strings.ToLower(common.RandString(8))
+	create := func(title, body, status string) string {
+		article := createTestArticleWithStatus(t, router, token, map[string]interface{}{"status": status, "tagList": []string{tag}})
+		w := performRequest(router, "PUT", "/api/articles/"+article["slug"].(string), token, map[string]interface{}{
+			"article": map[string]string{"title": title, "body": body},
+		})
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return response["article"].(map[string]interface{})["slug"].(string)
+	}
+	inTitle := create("About "+word, "Nothing to see", "published")
+	inBody := create("Another article "+common.RandString(8), "Some <b>text</b> with "+word+" inside", "published")
+	create("Draft "+word, word, "draft")
+
+	slugs, snippets, count := searchTestArticles(router, word)
+	asserts.Equal(2, count, "drafts are not found")
+	asserts.ElementsMatch([]string{inTitle, inBody}, slugs)
+	for i, slug := range slugs {
+		if slug == inBody {
+			asserts.Contains(snippets[i], "&lt;b&gt;text&lt;/b&gt; with <mark>"+word+"</mark>", "the snippet is escaped and highlighted")
+		}
+	}
+
+	slugs, _, count = searchTestArticles(router, tag)
+	asserts.Equal(2, count, "tags are searched")
+	slugs, _, _ = searchTestArticles(router, word+"+inside")
+	asserts.Equal([]string{inBody}, slugs, "every word has to match")
+	slugs, _, count = searchTestArticles(router, word+"&limit=1&offset=1")
+	asserts.Len(slugs, 1)
+	asserts.Equal(2, count)
+
+	performRequest(router, "PUT", "/api/articles/"+inBody, token, map[string]interface{}{
+		"article": map[string]string{"body": "Rewritten"},
+	})
+	slugs, _, _ = searchTestArticles(router, word)
+	asserts.Equal([]string{inTitle}, slugs, "updates are searched")
+	performRequest(router, "DELETE", "/api/articles/"+inTitle, token, nil)
+	slugs, _, count = searchTestArticles(router, word)
+	asserts.Empty(slugs, "deleted articles are not found")
+	asserts.Zero(count)
+
+	w := performRequest(router, "GET", "/api/articles/search?q=+", "", nil)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"q":"can't be blank"}}`, w.Body.String())
+	w = performRequest(router, "GET", `/api/articles/search?q=%22unbalanced+(*`, "", nil)
+	asserts.Equal(http.StatusOK, w.Code, "the query syntax of the index is not exposed")
+}
+
+// ==============================================
+// PART 13: RENDERED MARKDOWN TESTS
+// ==============================================
+
+// Test helper to read the bodyHtml of the article or comment of a response
+func testBodyHTML(w *httptest.ResponseRecorder, key string) string {
+	var response map[string]map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	bodyHTML, _ := response[key]["bodyHtml"].(string)
+	return bodyHTML
+}
+
+// Test 36: Bodies are rendered to sanitized HTML when the client asks for it
+func TestRenderedBodies(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	token, _ := createUniqueTestUser(t, router, "renderer")
+	slug := createTestArticle(t, router, token)
+	w := performRequest(router, "PUT", "/api/articles/"+slug, token, map[string]interface{}{
+		"article": map[string]string{"body": "**bold** <script>alert(1)</script>"},
+	})
+	asserts.NotContains(w.Body.String(), "bodyHtml", "the HTML is only returned on demand")
+
+	w = performRequest(router, "GET", "/api/articles/"+slug+"?html=true", "", nil)
+	asserts.Equal("<p><strong>bold</strong> </p>\n", testBodyHTML(w, "article"))
+	revisions := listTestRevisions(router, "", slug)
+	asserts.Len(revisions, 2)
+
+	// Restoring the first revision brings its rendering back
+	performRequest(router, "POST", "/api/articles/"+slug+"/revisions/1/restore", token, nil)
+	w = performRequest(router, "GET", "/api/articles/"+slug+"?html=true", "", nil)
+	asserts.Equal("<p>Body</p>\n", testBodyHTML(w, "article"))
+
+	w = performRequest(router, "POST", "/api/articles/"+slug+"/comments?html=true", token, map[string]interface{}{
+		"comment": map[string]string{"body": "[link](javascript:alert(1)) _nice_"},
+	})
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Equal("<p>link <em>nice</em></p>\n", testBodyHTML(w, "comment"))
+	w = performRequest(router, "GET", "/api/articles/"+slug+"/comments?html=1", "", nil)
+	asserts.Contains(w.Body.String(), `"bodyHtml":"\u003cp\u003elink \u003cem\u003enice`)
+	w = performRequest(router, "GET", "/api/articles/"+slug+"/comments", "", nil)
+	asserts.NotContains(w.Body.String(), "bodyHtml")
+}
+
+// ==============================================
+// PART 14: SLUG TESTS
+// ==============================================
+
+// Test 37: Slugs are unique and stable, an old slug redirects to the current one
+func TestStableSlugs(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	token, _ := createUniqueTestUser(t, router, "slugger")
+	otherToken, _ := createUniqueTestUser(t, router, "slugreader")
+	title := "Same Title " + common.RandString(8)
+	first := createTestArticleWithStatus(t, router, token, map[string]interface{}{"title": title})
+	second := createTestArticleWithStatus(t, router, token, map[string]interface{}{"title": title})
+	slug := first["slug"].(string)
+	asserts.Equal(slug+"-2", second["slug"], "a second article with the same title gets a suffix")
+	feed := createTestArticleWithStatus(t, router, token, map[string]interface{}{"title": "Feed", "slug": "feed"})
+	asserts.NotEqual("feed", feed["slug"], "the paths of the article lists are not slugs")
+
+	w := performRequest(router, "PUT", "/api/articles/"+slug, token, map[string]interface{}{
+		"article": map[string]string{"title": "A Completely New Title"},
+	})
+	asserts.Equal(http.StatusOK, w.Code)
+	w = performRequest(router, "GET", "/api/articles/"+slug, "", nil)
+	asserts.Equal(http.StatusOK, w.Code, "the slug does not follow the title")
+
+	renamed := "renamed " + title
+	w = performRequest(router, "PUT", "/api/articles/"+slug, token, map[string]interface{}{
+		"article": map[string]string{"slug": renamed},
+	})
+	asserts.Equal(http.StatusOK, w.Code)
+	var response map[string]map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	newSlug := response["article"]["slug"].(string)
+	asserts.Equal("renamed-"+slug, newSlug)
+
+	w = performRequest(router, "GET", "/api/articles/"+slug, otherToken, nil)
+	asserts.Equal(http.StatusMovedPermanently, w.Code)
+	asserts.Equal("/api/articles/"+newSlug, w.Header().Get("Location"))
+	w = performRequest(router, "GET", "/api/articles/"+slug+"/comments?html=true", "", nil)
+	asserts.Equal(http.StatusMovedPermanently, w.Code)
+	asserts.Equal("/api/articles/"+newSlug+"/comments?html=true", w.Header().Get("Location"))
+	w = performRequest(router, "POST", "/api/articles/"+slug+"/favorite", otherToken, nil)
+	asserts.Equal(http.StatusPermanentRedirect, w.Code, "writes keep their method")
+
+	// The old slug is not given to another article, and going back to it makes it current again
+	third := createTestArticleWithStatus(t, router, otherToken, map[string]interface{}{"title": title})
+	asserts.Equal(slug+"-3", third["slug"])
+	w = performRequest(router, "PUT", "/api/articles/"+newSlug, token, map[string]interface{}{
+		"article": map[string]string{"slug": slug},
+	})
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(slug, response["article"]["slug"])
+	w = performRequest(router, "GET", "/api/articles/"+newSlug, "", nil)
+	asserts.Equal(http.StatusMovedPermanently, w.Code)
+	asserts.Equal("/api/articles/"+slug, w.Header().Get("Location"))
+
+	// The old slugs of a draft do not reveal its new slug
+	performRequest(router, "PUT", "/api/articles/"+slug, token, map[string]interface{}{
+		"article": map[string]string{"status": "draft"},
+	})
+	w = performRequest(router, "GET", "/api/articles/"+newSlug, otherToken, nil)
+	asserts.Equal(http.StatusNotFound, w.Code)
+}
+
+// ==============================================
+// PART 15: TRASH TESTS
+// ==============================================
+
+// Test helper to read the trash of the token
+func listTestTrash(router *gin.Engine, token string) (articleSlugs []string, commentIDs []uint) {
+	w := performRequest(router, "GET", "/api/articles/trash", token, nil)
+	var response struct {
+		Articles []struct {
+			Slug      string `json:"slug"`
+			DeletedAt string `json:"deletedAt"`
+			PurgeAt   string `json:"purgeAt"`
+		} `json:"articles"`
+		Comments []struct {
+			ID      uint   `json:"id"`
+			Article string `json:"article"`
+		} `json:"comments"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	for _, article := range response.Articles {
+		articleSlugs = append(articleSlugs, article.Slug)
+	}
+	for _, comment := range response.Comments {
+		commentIDs = append(commentIDs, comment.ID)
+	}
+	return articleSlugs, commentIDs
+}
+
+// Test 38: Deleted articles and comments wait in the trash of their author until they are purged
+func TestTrash(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	authorToken, _ := createUniqueTestUser(t, router, "trasher")
+	readerToken, _ := createUniqueTestUser(t, router, "trashreader")
+	slug := createTestArticleWithStatus(t, router, authorToken, map[string]interface{}{"tagList": []string{"trash"}})["slug"].(string)
+	commentID := createTestComment(t, router, readerToken, slug)
+	performRequest(router, "POST", "/api/articles/"+slug+"/favorite", readerToken, nil)
+	asserts.Equal(http.StatusUnauthorized, performRequest(router, "GET", "/api/articles/trash", "", nil).Code)
+
+	performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, commentID), readerToken, nil)
+	_, comments := listTestTrash(router, readerToken)
+	asserts.Equal([]uint{commentID}, comments)
+	w := performRequest(router, "POST", fmt.Sprintf("/api/articles/%s/comments/%d/restore", slug, commentID), authorToken, nil)
+	asserts.Equal(http.StatusOK, w.Code, "the author of the article could restore the comment")
+	_, comments = listTestTrash(router, readerToken)
+	asserts.Empty(comments)
+	asserts.Len(listTestComments(router, readerToken, slug), 1)
+
+	performRequest(router, "DELETE", "/api/articles/"+slug, authorToken, nil)
+	asserts.Equal(http.StatusNotFound, performRequest(router, "GET", "/api/articles/"+slug, "", nil).Code)
+	trashed, _ := listTestTrash(router, authorToken)
+	asserts.Equal([]string{slug}, trashed)
+	other, _ := listTestTrash(router, readerToken)
+	asserts.Empty(other, "the trash is personal")
+
+	w = performRequest(router, "POST", "/api/articles/"+slug+"/restore", readerToken, nil)
+	asserts.Equal(http.StatusForbidden, w.Code)
+	w = performRequest(router, "POST", "/api/articles/"+slug+"/restore", authorToken, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(http.StatusOK, performRequest(router, "GET", "/api/articles/"+slug, "", nil).Code)
+	w = performRequest(router, "POST", "/api/articles/"+slug+"/restore", authorToken, nil)
+	asserts.Equal(http.StatusNotFound, w.Code, "only a deleted article could be restored")
+
+	// Only what was deleted before the retention is purged, with the favorites, tags and comments
+	performRequest(router, "DELETE", "/api/articles/"+slug, authorToken, nil)
+	db := common.GetDB()
+	var articleModel articles.ArticleModel
+	db.Unscoped().Where("slug = ?", slug).First(&articleModel)
+	_, _, err := articles.PurgeTrash(time.Now().Add(-common.TrashRetention))
+	asserts.NoError(err)
+	var count int
+	db.Unscoped().Model(&articles.ArticleModel{}).Where("id = ?", articleModel.ID).Count(&count)
+	asserts.Equal(1, count, "a fresh deletion stays in the trash")
+
+	db.Unscoped().Model(&articleModel).UpdateColumn("deleted_at", time.Now().Add(-2*common.TrashRetention))
+	articleCount, _, err := articles.PurgeTrash(time.Now().Add(-common.TrashRetention))
+	asserts.NoError(err)
+	asserts.NotZero(articleCount)
+	db.Unscoped().Model(&articles.ArticleModel{}).Where("id = ?", articleModel.ID).Count(&count)
+	asserts.Zero(count, "the article is gone for good")
+	db.Unscoped().Model(&articles.FavoriteModel{}).Where("favorite_id = ?", articleModel.ID).Count(&count)
+	asserts.Zero(count, "with its favorites")
+	db.Table("article_tags").Where("article_model_id = ?", articleModel.ID).Count(&count)
+	asserts.Zero(count, "and its tag links")
+	db.Unscoped().Model(&articles.CommentModel{}).Where("article_id = ?", articleModel.ID).Count(&count)
+	asserts.Zero(count, "and its comments")
+	trashed, _ = listTestTrash(router, authorToken)
+	asserts.Empty(trashed)
+}
+
+// ==============================================
+// PART 16: THREADED COMMENT TESTS
+// ==============================================
+
+// A comment of a list response, with its replies when the list is a tree
+type testThreadComment struct {
+	ID       uint                `json:"id"`
+	Body     string              `json:"body"`
+	ParentID *uint               `json:"parentId"`
+	Deleted  bool                `json:"deleted"`
+	Replies  []testThreadComment `json:"replies"`
+}
+
+// Test helper to reply to a comment and return the response
+func replyTestComment(router *gin.Engine, token, slug string, parentID uint) *httptest.ResponseRecorder {
+	return performRequest(router, "POST", "/api/articles/"+slug+"/comments", token, map[string]interface{}{
+		"comment": map[string]interface{}{"body": "Reply", "parentId": parentID},
+	})
+}
+
+// Test helper to read a comment list in the given format
+func listTestThread(router *gin.Engine, slug, format string) []testThreadComment {
+	w := performRequest(router, "GET", "/api/articles/"+slug+"/comments?format="+format, "", nil)
+	var response struct {
+		Comments []testThreadComment `json:"comments"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response.Comments
+}
+
+// Test 39: Comments reply to each other up to the maximum depth, deleted ones with replies are tombstones
+func TestThreadedComments(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+	maxDepth := common.CommentMaxDepth
+	common.CommentMaxDepth = 3
+	defer func() { common.CommentMaxDepth = maxDepth }()
+
+	token, _ := createUniqueTestUser(t, router, "threader")
+	slug := createTestArticle(t, router, token)
+	otherSlug := createTestArticle(t, router, token)
+	replyID := func(w *httptest.ResponseRecorder) uint {
+		var response map[string]map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		id, _ := response["comment"]["id"].(float64)
+		return uint(id)
+	}
+
+	first := createTestComment(t, router, token, slug)
+	w := replyTestComment(router, token, slug, first)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Contains(w.Body.String(), fmt.Sprintf(`"parentId":%d`, first))
+	second := replyID(w)
+	third := replyID(replyTestComment(router, token, slug, second))
+	asserts.NotZero(third)
+	w = replyTestComment(router, token, slug, third)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "replies could not nest deeper than the maximum")
+	asserts.Contains(w.Body.String(), "parentId")
+	w = replyTestComment(router, token, otherSlug, first)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "the parent has to be a comment of the same article")
+
+	flat := listTestThread(router, slug, "flat")
+	asserts.Len(flat, 3)
+	asserts.Nil(flat[0].ParentID)
+	asserts.Equal(first, *flat[1].ParentID)
+	tree := listTestThread(router, slug, "tree")
+	asserts.Len(tree, 1)
+	asserts.Equal(second, tree[0].Replies[0].ID)
+	asserts.Equal(third, tree[0].Replies[0].Replies[0].ID)
+	w = performRequest(router, "GET", "/api/articles/"+slug+"/comments?format=nested", "", nil)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+
+	// A deleted comment with replies stays as a tombstone until its replies are gone
+	performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, second), token, nil)
+	tree = listTestThread(router, slug, "tree")
+	asserts.True(tree[0].Replies[0].Deleted)
+	asserts.Equal("[deleted]", tree[0].Replies[0].Body)
+	asserts.Equal(third, tree[0].Replies[0].Replies[0].ID)
+	asserts.Equal(http.StatusUnprocessableEntity, replyTestComment(router, token, slug, second).Code, "a tombstone takes no replies")
+	performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, third), token, nil)
+	flat = listTestThread(router, slug, "flat")
+	asserts.Len(flat, 1)
+	asserts.Equal(first, flat[0].ID)
+
+	// The purge removes the deleted thread, a deleted comment with a live reply keeps its place without its body
+	fourth := replyID(replyTestComment(router, token, slug, first))
+	performRequest(router, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", slug, first), token, nil)
+	db := common.GetDB()
+	db.Unscoped().Model(&articles.CommentModel{}).Where("id IN (?)", []uint{first, second, third}).
+		UpdateColumn("deleted_at", time.Now().Add(-2*common.TrashRetention))
+	_, _, err := articles.PurgeTrash(time.Now().Add(-common.TrashRetention))
+	asserts.NoError(err)
+	var remaining []articles.CommentModel
+	db.Unscoped().Where("id IN (?)", []uint{first, second, third}).Find(&remaining)
+	asserts.Len(remaining, 1)
+	asserts.Equal(first, remaining[0].ID)
+	asserts.Empty(remaining[0].Body)
+	tree = listTestThread(router, slug, "tree")
+	asserts.Len(tree, 1)
+	asserts.True(tree[0].Deleted)
+	asserts.Equal(fourth, tree[0].Replies[0].ID)
+}
+
+// Test 40: An article is written with its revision, status and slug in one transaction
+func TestArticleWritesAreAtomic(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+	db := common.GetDB()
+
+	token, _ := createUniqueTestUser(t, router, "atomic")
+	title := "Atomic " + common.RandString(8)
+	article := createTestArticleWithStatus(t, router, token, map[string]interface{}{"title": title})
+	slug := article["slug"].(string)
+
+	// The revision is the last write, make it fail
+	db.Callback().Create().Before("gorm:create").Register("test:fail_revisions", func(scope *gorm.Scope) {
+		if scope.TableName() == "article_revision_models" {
+			scope.Err(fmt.Errorf("revisions are down"))
+		}
+	})
+	defer db.Callback().Create().Remove("test:fail_revisions")
+
+	w := performRequest(router, "POST", "/api/articles/", token, map[string]interface{}{
+		"article": map[string]interface{}{"title": "Lost " + title, "description": "Description", "body": "Body"},
+	})
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	var count int
+	db.Unscoped().Model(&articles.ArticleModel{}).Where("title = ?", "Lost "+title).Count(&count)
+	asserts.Equal(0, count, "an article without its revision should not be saved")
+
+	w = performRequest(router, "PUT", "/api/articles/"+slug, token, map[string]interface{}{
+		"article": map[string]string{"title": "Changed " + title, "slug": "changed " + title, "status": "draft"},
+	})
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	w = performRequest(router, "GET", "/api/articles/"+slug, "", nil)
+	asserts.Equal(http.StatusOK, w.Code, "the slug and the status should be left as they were")
+	var response map[string]map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(title, response["article"]["title"])
+	db.Model(&articles.ArticleSlugModel{}).Where("slug = ?", slug).Count(&count)
+	asserts.Equal(0, count, "no old slug should be recorded")
+}
+
+// Test helper to count the queries on the follow, block and mute tables during f
+func countProfileQueries(f func()) int {
+	db := common.GetDB()
+	count := 0
+	counter := func(scope *gorm.Scope) {
+		switch scope.TableName() {
+		case "follow_models", "block_models", "mute_models":
+			count++
+		}
+	}
+	db.Callback().Query().After("gorm:query").Register("test:count_profile_queries", counter)
+	db.Callback().RowQuery().After("gorm:row_query").Register("test:count_profile_row_queries", counter)
+	f()
+	db.Callback().Query().Remove("test:count_profile_queries")
+	db.Callback().RowQuery().Remove("test:count_profile_row_queries")
+	return count
+}
+
+// Test 41: The profiles of the authors of a list are loaded together, whatever the number of authors
+func TestArticleListAuthorQueries(t *testing.T) {
+	asserts := assert.New(t)
+	router := setupTestRouter()
+
+	token, _ := createUniqueTestUser(t, router, "reader")
+	tag := "authors" + common.RandString(8)
+	authorToken, _ := createUniqueTestUser(t, router, "author")
+	createTestArticleWithStatus(t, router, authorToken, map[string]interface{}{"tagList": []string{tag}})
+	list := func() { performRequest(router, "GET", "/api/articles/?tag="+tag, token, nil) }
+	small := countProfileQueries(list)
+
+	for i := 0; i < 3; i++ {
+		authorToken, _ = createUniqueTestUser(t, router, "author")
+		createTestArticleWithStatus(t, router, authorToken, map[string]interface{}{"tagList": []string{tag}})
+	}
+	w := performRequest(router, "GET", "/api/articles/?tag="+tag, token, nil)
+	var response struct {
+		ArticlesCount int `json:"articlesCount"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(4, response.ArticlesCount)
+	large := countProfileQueries(list)
+	asserts.NotZero(small)
+	asserts.Equal(small, large, "the number of queries should not grow with the number of authors")
+}
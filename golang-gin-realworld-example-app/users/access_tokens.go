@@ -0,0 +1,113 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+// Personal access tokens start with this prefix, AuthMiddleware tells them from JWTs by it.
+const PersonalAccessTokenPrefix = "pat_"
+
+// The scopes a personal access token could be granted, routes declare them with RequireScopes.
+const (
+	ScopeArticlesWrite = "articles:write"
+	ScopeCommentsWrite = "comments:write"
+	ScopeProfilesWrite = "profiles:write"
+)
+
+var ErrAccessTokenNotFound = errors.New("Invalid id")
+
+// LastUsedAt is only written when it is older than this, like the LastSeenAt of a session.
+const accessTokenTouchInterval = time.Minute
+
+// A named long-living token for scripts, only the sha256 of the token is saved.
+//
+// Scopes is a space separated list, e.g. "articles:write comments:write". A nil ExpiresAt never expires.
+type PersonalAccessTokenModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint       `gorm:"index"`
+	Name        string     `gorm:"column:name"`
+	TokenHash   string     `gorm:"column:token_hash;unique_index"`
+	Scopes      string     `gorm:"column:scopes"`
+	ExpiresAt   *time.Time `gorm:"column:expires_at"`
+	LastUsedAt  *time.Time `gorm:"column:last_used_at"`
+	RevokedAt   *time.Time `gorm:"column:revoked_at"`
+}
+
+func (model PersonalAccessTokenModel) ScopeList() []string {
+	return strings.Fields(model.Scopes)
+}
+
+func (model PersonalAccessTokenModel) IsActive() bool {
+	if model.ID == 0 || model.RevokedAt != nil {
+		return false
+	}
+	return model.ExpiresAt == nil || time.Now().Before(*model.ExpiresAt)
+}
+
+// You could create a personal access token, the token itself is only returned here.
+//
+//	model, token, err := CreatePersonalAccessToken(myUserModel.ID, "deploy", []string{ScopeArticlesWrite}, nil)
+func CreatePersonalAccessToken(userID uint, name string, scopes []string, expiresAt *time.Time) (PersonalAccessTokenModel, string, error) {
+	token := PersonalAccessTokenPrefix + common.RandToken(32)
+	model := PersonalAccessTokenModel{
+		UserModelID: userID,
+		Name:        name,
+		TokenHash:   common.HashToken(token),
+		Scopes:      strings.Join(scopes, " "),
+		ExpiresAt:   expiresAt,
+	}
+	db := common.GetDB()
+	if err := db.Create(&model).Error; err != nil {
+		return model, "", err
+	}
+	return model, token, nil
+}
+
+// You could look up an active personal access token, an empty model is returned otherwise.
+func FindActivePersonalAccessToken(token string) PersonalAccessTokenModel {
+	db := common.GetDB()
+	var model PersonalAccessTokenModel
+	db.Where(&PersonalAccessTokenModel{TokenHash: common.HashToken(token)}).First(&model)
+	if !model.IsActive() {
+		return PersonalAccessTokenModel{}
+	}
+	return model
+}
+
+func touchPersonalAccessToken(model PersonalAccessTokenModel) {
+	now := time.Now()
+	if model.LastUsedAt != nil && now.Sub(*model.LastUsedAt) < accessTokenTouchInterval {
+		return
+	}
+	db := common.GetDB()
+	db.Model(&PersonalAccessTokenModel{}).Where("id = ?", model.ID).UpdateColumn("last_used_at", now)
+}
+
+// The tokens of an user which are not revoked, expired ones included so that they could be cleaned up.
+func ListPersonalAccessTokens(userID uint) ([]PersonalAccessTokenModel, error) {
+	db := common.GetDB()
+	var models []PersonalAccessTokenModel
+	err := db.Where("user_model_id = ? AND revoked_at IS NULL", userID).Order("id").Find(&models).Error
+	return models, err
+}
+
+func RevokePersonalAccessToken(userID, tokenID uint) error {
+	db := common.GetDB()
+	result := db.Model(&PersonalAccessTokenModel{}).
+		Where("id = ? AND user_model_id = ? AND revoked_at IS NULL", tokenID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAccessTokenNotFound
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package users
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+// The articles and comments of a deleted account are moved to this user when
+// common.KeepDeletedUserContent is set. Usernames are alphanumeric, nobody could register it.
+const (
+	DeletedUserUsername = "deleted-user"
+	DeletedUserEmail    = "deleted-user@invalid"
+)
+
+// Other packages keep data of an user in their own tables, e.g. articles and favorites.
+// They register an AccountDataHandler so that the export and the deletion of an account cover it too.
+//
+// Export returns sections of the bundle by name. Delete runs inside the transaction which deletes the
+// user, placeholder is the "deleted user" when the content is kept and an empty model otherwise.
+type AccountDataHandler struct {
+	Export func(user UserModel) (map[string]interface{}, error)
+	Delete func(tx *gorm.DB, user UserModel, placeholder UserModel) error
+}
+
+var accountDataHandlers []AccountDataHandler
+
+// You could take part in the export and the deletion of accounts, usually from an init function.
+//
+//	users.RegisterAccountDataHandler(users.AccountDataHandler{Export: exportArticles, Delete: deleteArticles})
+func RegisterAccountDataHandler(handler AccountDataHandler) {
+	accountDataHandlers = append(accountDataHandlers, handler)
+}
+
+type AccountProfileExport struct {
+	Username      string   `json:"username"`
+	Email         string   `json:"email"`
+	Bio           string   `json:"bio"`
+	Image         *string  `json:"image"`
+	EmailVerified bool     `json:"emailVerified"`
+	Roles         []string `json:"roles"`
+}
+
+type AccountFollowsExport struct {
+	Following []string `json:"following"`
+	Followers []string `json:"followers"`
+}
+
+type AccountBlocksExport struct {
+	Blocking []string `json:"blocking"`
+	Muting   []string `json:"muting"`
+}
+
+// You could collect everything the account owns, the result is keyed by section name.
+//
+//	bundle, err := ExportAccount(myUserModel)
+func ExportAccount(u UserModel) (map[string]interface{}, error) {
+	follows, err := u.exportFollows()
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := u.exportBlocks()
+	if err != nil {
+		return nil, err
+	}
+	bundle := map[string]interface{}{
+		"profile": AccountProfileExport{
+			Username:      u.Username,
+			Email:         u.Email,
+			Bio:           u.Bio,
+			Image:         u.ImageURL(),
+			EmailVerified: u.IsVerified(),
+			Roles:         u.Roles(),
+		},
+		"follows": follows,
+		"blocks":  blocks,
+	}
+	for _, handler := range accountDataHandlers {
+		if handler.Export == nil {
+			continue
+		}
+		sections, err := handler.Export(u)
+		if err != nil {
+			return nil, err
+		}
+		for name, section := range sections {
+			bundle[name] = section
+		}
+	}
+	return bundle, nil
+}
+
+func (u UserModel) exportFollows() (AccountFollowsExport, error) {
+	follows := AccountFollowsExport{Following: []string{}, Followers: []string{}}
+	err := u.relatedUsernames(&follows.Following, "follow_models", "following_id", "followed_by_id")
+	if err == nil {
+		err = u.relatedUsernames(&follows.Followers, "follow_models", "followed_by_id", "following_id")
+	}
+	return follows, err
+}
+
+func (u UserModel) exportBlocks() (AccountBlocksExport, error) {
+	blocks := AccountBlocksExport{Blocking: []string{}, Muting: []string{}}
+	err := u.relatedUsernames(&blocks.Blocking, "block_models", "blocked_id", "blocked_by_id")
+	if err == nil {
+		err = u.relatedUsernames(&blocks.Muting, "mute_models", "muted_id", "muted_by_id")
+	}
+	return blocks, err
+}
+
+func (u UserModel) relatedUsernames(usernames *[]string, table, userColumn, ownerColumn string) error {
+	return u.relatedUsers(table, userColumn, ownerColumn).Order("user_models.username").Pluck("user_models.username", usernames).Error
+}
+
+// You could write the bundle as a zip archive with one <section>.json file per section
+func WriteAccountExportZip(w io.Writer, bundle map[string]interface{}) error {
+	names := make([]string, 0, len(bundle))
+	for name := range bundle {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	archive := zip.NewWriter(w)
+	for _, name := range names {
+		file, err := archive.Create(name + ".json")
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(bundle[name]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// The "deleted user" which keeps the content of deleted accounts, it is created on first use.
+// Its password hash is no bcrypt hash, so that nobody could log in as it.
+func deletedUserPlaceholder(tx *gorm.DB) (UserModel, error) {
+	var placeholder UserModel
+	err := tx.Where(UserModel{Email: DeletedUserEmail}).
+		Attrs(UserModel{Username: DeletedUserUsername, PasswordHash: "!"}).
+		FirstOrCreate(&placeholder).Error
+	return placeholder, err
+}
+
+// You could delete an account with everything it owns in one transaction.
+//
+// Follows, blocks, mutes, tokens, sessions, identities and roles are always removed. Articles and comments are moved
+// to the "deleted user" when common.KeepDeletedUserContent is set, otherwise they are removed as well.
+//
+//	err := DeleteAccount(myUserModel)
+func DeleteAccount(u UserModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	var placeholder UserModel
+	if common.KeepDeletedUserContent {
+		var err error
+		if placeholder, err = deletedUserPlaceholder(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, handler := range accountDataHandlers {
+		if handler.Delete == nil {
+			continue
+		}
+		if err := handler.Delete(tx, u, placeholder); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// Rows are removed for good, a soft delete would keep the personal data around.
+	byUser := []interface{}{
+		RefreshTokenModel{},
+		PasswordResetModel{},
+		EmailVerificationModel{},
+		TwoFactorModel{},
+		RecoveryCodeModel{},
+		SessionModel{},
+		IdentityModel{},
+		PersonalAccessTokenModel{},
+		UserRoleModel{},
+	}
+	for _, model := range byUser {
+		if err := tx.Unscoped().Where("user_model_id = ?", u.ID).Delete(model).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	others := []struct {
+		model interface{}
+		query string
+		args  []interface{}
+	}{
+		{FollowModel{}, "following_id = ? OR followed_by_id = ?", []interface{}{u.ID, u.ID}},
+		{BlockModel{}, "blocked_id = ? OR blocked_by_id = ?", []interface{}{u.ID, u.ID}},
+		{MuteModel{}, "muted_id = ? OR muted_by_id = ?", []interface{}{u.ID, u.ID}},
+		{OIDCStateModel{}, "link_user_model_id = ?", []interface{}{u.ID}},
+		{LoginThrottleModel{}, "throttle_key = ?", []interface{}{accountThrottleKey(u.Email)}},
+	}
+	for _, other := range others {
+		if err := tx.Unscoped().Where(other.query, other.args...).Delete(other.model).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Delete(UserModel{}, "id = ?", u.ID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	deleteAvatarFiles(u.Avatar, AvatarSizes)
+	return nil
+}
@@ -0,0 +1,97 @@
+package users
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+
+	"realworld-backend/common"
+)
+
+// Every uploaded avatar is stored in these sizes, square JPEGs of size x size pixels.
+var AvatarSizes = []int{64, 128, 256}
+
+// The size ProfileResponse.Image points at
+const DefaultAvatarSize = 256
+
+// The key of one size of an avatar, e.g. "avatars/1/k3j9x2m4/256.jpg"
+func avatarKey(prefix string, size int) string {
+	return fmt.Sprintf("%s/%d.jpg", prefix, size)
+}
+
+// The image of the profile: the uploaded avatar if there is one, the Image URL otherwise.
+func (u UserModel) ImageURL() *string {
+	if u.Avatar == "" {
+		return u.Image
+	}
+	url := common.GetBlobStore().URL(avatarKey(u.Avatar, DefaultAvatarSize))
+	return &url
+}
+
+// The URLs of the uploaded avatar by size, empty if there is none
+func (u UserModel) AvatarURLs() map[string]string {
+	urls := map[string]string{}
+	if u.Avatar == "" {
+		return urls
+	}
+	for _, size := range AvatarSizes {
+		urls[strconv.Itoa(size)] = common.GetBlobStore().URL(avatarKey(u.Avatar, size))
+	}
+	return urls
+}
+
+// You could replace the avatar of an user with an uploaded image, the previous files are deleted.
+//
+// Every upload gets a new random prefix, so that caches never serve the previous avatar.
+//
+//	err := myUserModel.setAvatar(data)
+func (u *UserModel) setAvatar(data []byte) error {
+	img, orientation, err := common.DecodeImage(data)
+	if err != nil {
+		return err
+	}
+	store := common.GetBlobStore()
+	prefix := fmt.Sprintf("avatars/%d/%s", u.ID, common.RandToken(6))
+	var stored []int
+	for _, size := range AvatarSizes {
+		encoded, err := common.EncodeJPEG(common.SquareThumbnail(img, orientation, size))
+		if err == nil {
+			err = store.Put(avatarKey(prefix, size), bytes.NewReader(encoded), "image/jpeg")
+		}
+		if err != nil {
+			deleteAvatarFiles(prefix, stored)
+			return err
+		}
+		stored = append(stored, size)
+	}
+	previous := u.Avatar
+	if err := u.Update(map[string]interface{}{"avatar": prefix}); err != nil {
+		deleteAvatarFiles(prefix, stored)
+		return err
+	}
+	deleteAvatarFiles(previous, AvatarSizes)
+	return nil
+}
+
+// Go back to the Image URL
+func (u *UserModel) removeAvatar() error {
+	previous := u.Avatar
+	if err := u.Update(map[string]interface{}{"avatar": ""}); err != nil {
+		return err
+	}
+	deleteAvatarFiles(previous, AvatarSizes)
+	return nil
+}
+
+// A file which could not be deleted is only wasted space, the error is logged and forgotten.
+func deleteAvatarFiles(prefix string, sizes []int) {
+	if prefix == "" {
+		return
+	}
+	for _, size := range sizes {
+		if err := common.GetBlobStore().Delete(avatarKey(prefix, size)); err != nil {
+			log.Printf("avatar cleanup failed: %v", err)
+		}
+	}
+}
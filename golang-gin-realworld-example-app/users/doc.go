@@ -8,5 +8,23 @@ routers.go: router binding and core logic
 serializers.go: definition the schema of return data
 
 validators.go: definition the validator of form data
+
+tokens.go: refresh, password reset and email verification tokens, revoked access tokens
+
+two_factor.go: TOTP authenticator and recovery codes
+
+lockout.go: brute-force protection of the login
+
+sessions.go: one session per login, listing and revocation
+
+oidc.go: OpenID Connect login and linked identities
+
+access_tokens.go: personal access tokens with scopes
+
+roles.go: roles and permissions
+
+account.go: export and deletion of an account
+
+avatars.go: uploaded avatars resized to a few standard sizes
 */
 package users
@@ -0,0 +1,114 @@
+package users
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+// Failed logins of one account, one client IP or one two-factor challenge, Key is "account:<email>",
+// "ip:<address>" or "mfa:<challenge jti>".
+//
+// LockedUntil is set once Failures reaches the threshold, each further failure doubles the lockout.
+type LoginThrottleModel struct {
+	gorm.Model
+	Key           string     `gorm:"column:throttle_key;unique_index"`
+	Failures      int        `gorm:"column:failures"`
+	LastFailureAt time.Time  `gorm:"column:last_failure_at"`
+	LockedUntil   *time.Time `gorm:"column:locked_until"`
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// The wrong codes sent with one challenge, the challenge is void once the key is locked
+func challengeThrottleKey(jti string) string {
+	return "mfa:" + jti
+}
+
+// You could check whether a login is locked, the longest remaining lockout of the keys is returned.
+//
+//	if retryAfter := loginRetryAfter(accountThrottleKey(email), ipThrottleKey(c.ClientIP())); retryAfter > 0 { ... }
+func loginRetryAfter(keys ...string) time.Duration {
+	db := common.GetDB()
+	var models []LoginThrottleModel
+	db.Where("throttle_key IN (?) AND locked_until > ?", keys, time.Now()).Find(&models)
+	var retryAfter time.Duration
+	for _, model := range models {
+		if remaining := time.Until(*model.LockedUntil); remaining > retryAfter {
+			retryAfter = remaining
+		}
+	}
+	return retryAfter
+}
+
+// The lockout after the given number of failures, 0 while still under the threshold.
+func lockoutDuration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	lockout := common.LoginLockoutBase
+	for i := threshold; i < failures && lockout < common.LoginLockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > common.LoginLockoutMax {
+		lockout = common.LoginLockoutMax
+	}
+	return lockout
+}
+
+// You could count a failed login against a key, the key is locked once threshold is reached.
+func recordLoginFailure(key string, threshold int) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	var model LoginThrottleModel
+	tx.Where(&LoginThrottleModel{Key: key}).First(&model)
+	now := time.Now()
+	// The window starts at the end of the lockout, otherwise a long lockout would clear its own counter
+	// and the backoff could never grow past it.
+	since := model.LastFailureAt
+	if model.LockedUntil != nil && model.LockedUntil.After(since) {
+		since = *model.LockedUntil
+	}
+	if now.Sub(since) > common.LoginFailureWindow {
+		model.Failures = 0
+		model.LockedUntil = nil
+	}
+	model.Key = key
+	model.Failures++
+	model.LastFailureAt = now
+	if lockout := lockoutDuration(model.Failures, threshold); lockout > 0 {
+		lockedUntil := now.Add(lockout)
+		model.LockedUntil = &lockedUntil
+	}
+	if err := tx.Save(&model).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func resetLoginFailures(key string) error {
+	db := common.GetDB()
+	return db.Unscoped().Where(&LoginThrottleModel{Key: key}).Delete(LoginThrottleModel{}).Error
+}
+
+// You could lift the lockout of an account, e.g. from the admin API or the command line.
+//
+//	err := users.UnlockAccount("jake@jake.jake")
+func UnlockAccount(email string) error {
+	return resetLoginFailures(accountThrottleKey(email))
+}
+
+// You could lift the lockout of a client IP.
+func UnlockIP(ip string) error {
+	return resetLoginFailures(ipThrottleKey(ip))
+}
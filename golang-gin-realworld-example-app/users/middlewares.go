@@ -1,6 +1,7 @@
 package users
 
 import (
+	"errors"
 	"net/http"
 	"realworld-backend/common"
 	"strings"
@@ -50,10 +51,21 @@ func UpdateContextUserModel(c *gin.Context, my_user_id uint) {
 func AuthMiddleware(auto401 bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		UpdateContextUserModel(c, 0)
-		token, err := request.ParseFromRequest(c.Request, MyAuth2Extractor, func(token *jwt.Token) (interface{}, error) {
-			b := ([]byte(common.NBSecretPassword))
-			return b, nil
-		}, request.WithClaims(&jwt.MapClaims{}))
+		// Personal access tokens are no JWTs, they are looked up by their hash and carry their scopes.
+		if raw, err := MyAuth2Extractor.ExtractToken(c.Request); err == nil && strings.HasPrefix(raw, PersonalAccessTokenPrefix) {
+			accessToken := FindActivePersonalAccessToken(raw)
+			if accessToken.ID == 0 {
+				if auto401 {
+					c.AbortWithError(http.StatusUnauthorized, errors.New("personal access token is invalid, expired or revoked"))
+				}
+				return
+			}
+			UpdateContextUserModel(c, accessToken.UserModelID)
+			c.Set("my_token_scopes", accessToken.ScopeList())
+			touchPersonalAccessToken(accessToken)
+			return
+		}
+		token, err := request.ParseFromRequest(c.Request, MyAuth2Extractor, common.Keys.Keyfunc, request.WithClaims(&jwt.MapClaims{}))
 		if err != nil {
 			if auto401 {
 				c.AbortWithError(http.StatusUnauthorized, err)
@@ -61,9 +73,96 @@ func AuthMiddleware(auto401 bool) gin.HandlerFunc {
 			return
 		}
 		if claims, ok := token.Claims.(*jwt.MapClaims); ok && token.Valid {
+			jti, _ := (*claims)["jti"].(string)
+			sid, _ := (*claims)["sid"].(float64)
+			// Challenge tokens carry a typ and could not be used as access tokens
+			_, hasType := (*claims)["typ"]
+			if hasType || IsAccessTokenRevoked(jti) || !isSessionActive(uint(sid)) {
+				if auto401 {
+					c.AbortWithError(http.StatusUnauthorized, errors.New("token has been revoked or is not an access token"))
+				}
+				return
+			}
 			my_user_id := uint((*claims)["id"].(float64))
 			//fmt.Println(my_user_id,claims["id"])
 			UpdateContextUserModel(c, my_user_id)
+			// The account could have been deleted while its token is still valid
+			if c.MustGet("my_user_model").(UserModel).ID == 0 {
+				UpdateContextUserModel(c, 0)
+				if auto401 {
+					c.AbortWithError(http.StatusUnauthorized, errors.New("the account of the token does not exist"))
+				}
+				return
+			}
+			c.Set("my_token_claims", *claims)
+			c.Set("my_session_id", uint(sid))
+			touchSession(uint(sid))
+		}
+	}
+}
+
+// Refuse accounts without a verified email when REQUIRE_VERIFIED_EMAIL is on, put it before the write endpoints:
+//
+//	router.POST("/", users.RequireVerifiedEmail(), ArticleCreate)
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !common.RequireVerifiedEmail {
+			return
+		}
+		myUserModel := c.MustGet("my_user_model").(UserModel)
+		if myUserModel.ID != 0 && !myUserModel.IsVerified() {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("email_unverified", errors.New("Verify your email address before writing content")))
+			return
+		}
+	}
+}
+
+// Only users with a role granting the permission could pass, it needs AuthMiddleware before it.
+//
+//	router.DELETE("/:slug", users.RequirePermission("articles:delete:any"), ArticleDelete)
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		myUserModel := c.MustGet("my_user_model").(UserModel)
+		if !myUserModel.HasPermission(permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("permission", errors.New("Missing permission "+permission)))
+			return
+		}
+	}
+}
+
+// Personal access tokens need every scope of the route, logins are not limited by scopes.
+//
+//	router.POST("/", users.RequireScopes(users.ScopeArticlesWrite), ArticleCreate)
+func RequireScopes(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted, isAccessToken := c.Get("my_token_scopes")
+		if !isAccessToken {
+			return
+		}
+		for _, scope := range scopes {
+			if !hasScope(granted.([]string), scope) {
+				c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("scope", errors.New("The token lacks the scope "+scope)))
+				return
+			}
+		}
+	}
+}
+
+func hasScope(granted []string, scope string) bool {
+	for _, s := range granted {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuse personal access tokens, the account itself (password, tokens, sessions...) is only managed after a login.
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, isAccessToken := c.Get("my_token_scopes"); isAccessToken {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("token", errors.New("Personal access tokens could not be used here")))
+			return
 		}
 	}
 }
@@ -2,9 +2,10 @@ package users
 
 import (
 	"errors"
+	"log"
+	"time"
 	"github.com/jinzhu/gorm"
 	"realworld-backend/common"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Models should only be concerned with database schema, more strict checking should be put in validator.
@@ -18,7 +19,11 @@ type UserModel struct {
 	Email        string  `gorm:"column:email;unique_index"`
 	Bio          string  `gorm:"column:bio;size:1024"`
 	Image        *string `gorm:"column:image"`
+	// The blob key prefix of the uploaded avatar, empty when the Image URL is used
+	Avatar       string  `gorm:"column:avatar"`
 	PasswordHash string  `gorm:"column:password;not null"`
+	// Nil until the user clicked the link sent to Email
+	VerifiedAt *time.Time `gorm:"column:verified_at"`
 }
 
 // A hack way to save ManyToMany relationship,
@@ -39,35 +44,96 @@ type FollowModel struct {
 	FollowedByID uint
 }
 
+// BlockedBy blocks Blocked: Blocked could not follow BlockedBy or comment on its articles,
+// and its articles and comments are hidden from BlockedBy.
+//
+// DB schema looks like: id, created_at, updated_at, deleted_at, blocked_id, blocked_by_id.
+type BlockModel struct {
+	gorm.Model
+	Blocked     UserModel
+	BlockedID   uint
+	BlockedBy   UserModel
+	BlockedByID uint
+}
+
+// MutedBy mutes Muted: the articles and comments of Muted are hidden from MutedBy, nothing else changes.
+//
+// DB schema looks like: id, created_at, updated_at, deleted_at, muted_id, muted_by_id.
+type MuteModel struct {
+	gorm.Model
+	Muted     UserModel
+	MutedID   uint
+	MutedBy   UserModel
+	MutedByID uint
+}
+
 // Migrate the schema of database if needed
 func AutoMigrate() {
 	db := common.GetDB()
 
 	db.AutoMigrate(&UserModel{})
 	db.AutoMigrate(&FollowModel{})
+	db.AutoMigrate(&BlockModel{})
+	db.AutoMigrate(&MuteModel{})
+	db.AutoMigrate(&RefreshTokenModel{})
+	db.AutoMigrate(&RevokedTokenModel{})
+	db.AutoMigrate(&PasswordResetModel{})
+	db.AutoMigrate(&EmailVerificationModel{})
+	db.AutoMigrate(&TwoFactorModel{})
+	db.AutoMigrate(&RecoveryCodeModel{})
+	db.AutoMigrate(&LoginThrottleModel{})
+	db.AutoMigrate(&SessionModel{})
+	db.AutoMigrate(&IdentityModel{})
+	db.AutoMigrate(&OIDCStateModel{})
+	db.AutoMigrate(&PersonalAccessTokenModel{})
+	db.AutoMigrate(&RoleModel{})
+	db.AutoMigrate(&RolePermissionModel{})
+	db.AutoMigrate(&UserRoleModel{})
+	SeedRoles()
+	if err := migrateRoleColumn(); err != nil {
+		log.Printf("role column could not be migrated: %v", err)
+	}
 }
 
+// The password is hashed by common.HashPassword, bcrypt or argon2id depending on PASSWORD_HASH.
 // What's bcrypt? https://en.wikipedia.org/wiki/Bcrypt
-// Golang bcrypt doc: https://godoc.org/golang.org/x/crypto/bcrypt
-// You can change the value in bcrypt.DefaultCost to adjust the security index.
+// What's argon2id? https://en.wikipedia.org/wiki/Argon2
 // 	err := userModel.setPassword("password0")
 func (u *UserModel) setPassword(password string) error {
 	if len(password) == 0 {
 		return errors.New("password should not be empty!")
 	}
-	bytePassword := []byte(password)
-	// Make sure the second param `bcrypt generator cost` between [4, 32)
-	passwordHash, _ := bcrypt.GenerateFromPassword(bytePassword, bcrypt.DefaultCost)
-	u.PasswordHash = string(passwordHash)
+	passwordHash, err := common.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = passwordHash
 	return nil
 }
 
 // Database will only save the hashed string, you should check it by util function.
+//
+// A hash made with another algorithm or older parameters than the current ones is replaced once the
+// password matched, so raising the cost needs no password reset.
 // 	if err := serModel.checkPassword("password0"); err != nil { password error }
 func (u *UserModel) checkPassword(password string) error {
-	bytePassword := []byte(password)
-	byteHashedPassword := []byte(u.PasswordHash)
-	return bcrypt.CompareHashAndPassword(byteHashedPassword, bytePassword)
+	rehash, err := common.VerifyPassword(u.PasswordHash, password)
+	if err != nil || !rehash || u.ID == 0 {
+		return err
+	}
+	// The login goes on with the old hash if the new one could not be saved
+	passwordHash, err := common.HashPassword(password)
+	if err == nil {
+		err = u.Update(map[string]interface{}{"password": passwordHash})
+	}
+	if err != nil {
+		log.Printf("password rehash failed: %v", err)
+	}
+	return nil
+}
+
+func (u UserModel) IsVerified() bool {
+	return u.VerifiedAt != nil
 }
 
 // You could input the conditions and it will return an UserModel in database with error info.
@@ -130,21 +196,171 @@ func (u UserModel) unFollowing(v UserModel) error {
 	return err
 }
 
-// You could get a following list of userModel
+// You could get a following list of userModel, in the order they were followed
 // 	followings := userModel.GetFollowings()
 func (u UserModel) GetFollowings() []UserModel {
+	var followings []UserModel
+	u.relatedUsers("follow_models", "following_id", "followed_by_id").Order("follow_models.id").Find(&followings)
+	return followings
+}
+
+// You could get a page of the users following userModel and their total count, the latest follower first.
+// Two queries whatever the size of the page.
+// 	followers, count, err := userModel.FindFollowers(20, 0)
+func (u UserModel) FindFollowers(limit, offset int) ([]UserModel, int, error) {
+	return u.findRelatedUsers("follow_models", "followed_by_id", "following_id", limit, offset)
+}
+
+// Same as FindFollowers, but for the users followed by userModel
+// 	followings, count, err := userModel.FindFollowings(20, 0)
+func (u UserModel) FindFollowings(limit, offset int) ([]UserModel, int, error) {
+	return u.findRelatedUsers("follow_models", "following_id", "followed_by_id", limit, offset)
+}
+
+// Same as FindFollowers, but for the users blocked by userModel, the latest block first
+func (u UserModel) FindBlockedUsers(limit, offset int) ([]UserModel, int, error) {
+	return u.findRelatedUsers("block_models", "blocked_id", "blocked_by_id", limit, offset)
+}
+
+// Same as FindFollowers, but for the users muted by userModel, the latest mute first
+func (u UserModel) FindMutedUsers(limit, offset int) ([]UserModel, int, error) {
+	return u.findRelatedUsers("mute_models", "muted_id", "muted_by_id", limit, offset)
+}
+
+func (u UserModel) findRelatedUsers(table, userColumn, ownerColumn string, limit, offset int) ([]UserModel, int, error) {
+	var count int
+	models := []UserModel{}
+	query := u.relatedUsers(table, userColumn, ownerColumn)
+	if err := query.Count(&count).Error; err != nil {
+		return models, 0, err
+	}
+	err := query.Order(table + ".id desc").Offset(offset).Limit(limit).Find(&models).Error
+	return models, count, err
+}
+
+// The users on the userColumn side of the rows of a relation table (follows, blocks, mutes)
+// whose ownerColumn is userModel
+func (u UserModel) relatedUsers(table, userColumn, ownerColumn string) *gorm.DB {
+	db := common.GetDB()
+	return db.Model(&UserModel{}).
+		Select("user_models.*").
+		Joins("JOIN "+table+" ON "+table+"."+userColumn+" = user_models.id AND "+table+".deleted_at IS NULL").
+		Where(table+"."+ownerColumn+" = ?", u.ID)
+}
+
+type followCount struct {
+	ID    uint
+	Count int
+}
+
+// You could count the followers and the followings of many users with one query each
+// 	followers, followings, err := countFollows([]uint{1, 2, 3})
+func countFollows(ids []uint) (map[uint]int, map[uint]int, error) {
+	followers := map[uint]int{}
+	followings := map[uint]int{}
+	if len(ids) == 0 {
+		return followers, followings, nil
+	}
+	db := common.GetDB()
+	for column, counts := range map[string]map[uint]int{"following_id": followers, "followed_by_id": followings} {
+		var rows []followCount
+		err := db.Model(&FollowModel{}).
+			Select(column+" AS id, count(*) AS count").
+			Where(column+" IN (?)", ids).
+			Group(column).
+			Scan(&rows).Error
+		if err != nil {
+			return followers, followings, err
+		}
+		for _, row := range rows {
+			counts[row.ID] = row.Count
+		}
+	}
+	return followers, followings, nil
+}
+
+// You could check which of the users are followed by userModel with one query
+// 	followed := myUserModel.followingSet([]uint{1, 2, 3})
+func (u UserModel) followingSet(ids []uint) map[uint]bool {
+	return u.relatedSet(&FollowModel{}, "following_id", "followed_by_id", ids)
+}
+
+// Same as followingSet, but for the users blocked by userModel
+func (u UserModel) blockingSet(ids []uint) map[uint]bool {
+	return u.relatedSet(&BlockModel{}, "blocked_id", "blocked_by_id", ids)
+}
+
+// Same as followingSet, but for the users muted by userModel
+func (u UserModel) mutingSet(ids []uint) map[uint]bool {
+	return u.relatedSet(&MuteModel{}, "muted_id", "muted_by_id", ids)
+}
+
+func (u UserModel) relatedSet(model interface{}, userColumn, ownerColumn string, ids []uint) map[uint]bool {
+	related := map[uint]bool{}
+	if u.ID == 0 || len(ids) == 0 {
+		return related
+	}
+	db := common.GetDB()
+	var relatedIDs []uint
+	db.Model(model).
+		Where(ownerColumn+" = ? AND "+userColumn+" IN (?)", u.ID, ids).
+		Pluck(userColumn, &relatedIDs)
+	for _, id := range relatedIDs {
+		related[id] = true
+	}
+	return related
+}
+
+// You could block an user, follows in both directions are removed as well.
+// 	err = myUserModel.block(userModel)
+func (u UserModel) block(v UserModel) error {
 	db := common.GetDB()
 	tx := db.Begin()
-	var follows []FollowModel
-	var followings []UserModel
-	tx.Where(FollowModel{
-		FollowedByID: u.ID,
-	}).Find(&follows)
-	for _, follow := range follows {
-		var userModel UserModel
-		tx.Model(&follow).Related(&userModel, "Following")
-		followings = append(followings, userModel)
+	var block BlockModel
+	if err := tx.FirstOrCreate(&block, &BlockModel{BlockedID: v.ID, BlockedByID: u.ID}).Error; err != nil {
+		tx.Rollback()
+		return err
 	}
-	tx.Commit()
-	return followings
+	err := tx.Where("(following_id = ? AND followed_by_id = ?) OR (following_id = ? AND followed_by_id = ?)", u.ID, v.ID, v.ID, u.ID).
+		Delete(FollowModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (u UserModel) unBlock(v UserModel) error {
+	db := common.GetDB()
+	return db.Where(BlockModel{BlockedID: v.ID, BlockedByID: u.ID}).Delete(BlockModel{}).Error
+}
+
+// You could check whether userModel1 blocks userModel2, e.g. before userModel2 comments on an article of userModel1
+// 	if articleModel.Author.UserModel.IsBlocking(myUserModel) { ... }
+func (u UserModel) IsBlocking(v UserModel) bool {
+	return u.blockingSet([]uint{v.ID})[v.ID]
+}
+
+func (u UserModel) mute(v UserModel) error {
+	db := common.GetDB()
+	var mute MuteModel
+	return db.FirstOrCreate(&mute, &MuteModel{MutedID: v.ID, MutedByID: u.ID}).Error
+}
+
+func (u UserModel) unMute(v UserModel) error {
+	db := common.GetDB()
+	return db.Where(MuteModel{MutedID: v.ID, MutedByID: u.ID}).Delete(MuteModel{}).Error
+}
+
+// You could get the users whose content is hidden from userModel, the users it blocks or mutes
+// 	hidden := myUserModel.HiddenUserIDs()
+func (u UserModel) HiddenUserIDs() []uint {
+	var ids, mutedIDs []uint
+	if u.ID == 0 {
+		return ids
+	}
+	db := common.GetDB()
+	db.Model(&BlockModel{}).Where("blocked_by_id = ?", u.ID).Pluck("blocked_id", &ids)
+	db.Model(&MuteModel{}).Where("muted_by_id = ?", u.ID).Pluck("muted_id", &mutedIDs)
+	return append(ids, mutedIDs...)
 }
@@ -0,0 +1,376 @@
+package users
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/oauth2"
+
+	"realworld-backend/common"
+)
+
+var ErrOIDCProviderUnknown = errors.New("Unknown identity provider")
+var ErrOIDCStateInvalid = errors.New("Invalid or expired login state")
+var ErrOIDCEmailUnverified = errors.New("The identity provider did not verify the email address")
+var ErrOIDCAccountConflict = errors.New("An account with this email exists, log in with the password and link the identity from the account settings")
+var ErrIdentityAlreadyLinked = errors.New("This identity is already linked to another account")
+var ErrIdentityNotFound = errors.New("Invalid id")
+
+// Time between the redirect to the provider and the callback
+const oidcStateTTL = 10 * time.Minute
+
+// The cookie holding the state in the browser which started the flow. A state posted from another
+// browser is refused, so that nobody could log a victim in with the code of their own account.
+const oidcStateCookie = "oidc_state"
+
+// One OpenID Connect provider, e.g. the issuer "https://accounts.google.com".
+//
+// RedirectURL is the page of the frontend receiving `code` and `state`, it posts them
+// to /api/users/oidc/:provider/callback.
+type OIDCProviderConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// The discovery document is only fetched on first use, so the server starts while a provider is down.
+type oidcProvider struct {
+	config   OIDCProviderConfig
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var oidcProvidersMu sync.RWMutex
+var oidcProviders = map[string]*oidcProvider{}
+
+// Discovery, JWKS and token requests to the providers share this client
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// You could add a provider, one with the same name is replaced.
+//
+//	users.RegisterOIDCProvider(users.OIDCProviderConfig{Name: "google", Issuer: "https://accounts.google.com", ...})
+func RegisterOIDCProvider(config OIDCProviderConfig) {
+	oidcProvidersMu.Lock()
+	defer oidcProvidersMu.Unlock()
+	oidcProviders[config.Name] = &oidcProvider{config: config}
+}
+
+// Register the providers from environment variables, every name of OIDC_PROVIDERS has its own settings:
+//
+//	export OIDC_PROVIDERS="google,gitlab"
+//	export OIDC_GOOGLE_ISSUER="https://accounts.google.com"
+//	export OIDC_GOOGLE_CLIENT_ID="..."
+//	export OIDC_GOOGLE_CLIENT_SECRET="..."
+//	export OIDC_GOOGLE_REDIRECT_URL="https://conduit.example.com/oidc/google"   default APP_BASE_URL/oidc/<name>
+func InitOIDCProviders() {
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		config := OIDCProviderConfig{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		}
+		if config.Issuer == "" || config.ClientID == "" {
+			fmt.Printf("WARNING: %sISSUER or %sCLIENT_ID not set, skipping the provider %s\n", prefix, prefix, name)
+			continue
+		}
+		if config.RedirectURL == "" {
+			config.RedirectURL = strings.TrimSuffix(common.AppBaseURL, "/") + "/oidc/" + name
+		}
+		RegisterOIDCProvider(config)
+	}
+}
+
+func getOIDCProvider(name string) (*oidcProvider, error) {
+	oidcProvidersMu.RLock()
+	defer oidcProvidersMu.RUnlock()
+	provider, ok := oidcProviders[name]
+	if !ok {
+		return nil, ErrOIDCProviderUnknown
+	}
+	return provider, nil
+}
+
+func (p *oidcProvider) discover() (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p.oauth2, p.verifier, nil
+	}
+	ctx := oidc.ClientContext(context.Background(), oidcHTTPClient)
+	provider, err := oidc.NewProvider(ctx, p.config.Issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	return p.oauth2, p.verifier, nil
+}
+
+// An external account linked to an user, Subject is the `sub` claim which never changes at the provider.
+type IdentityModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint   `gorm:"index"`
+	Provider    string `gorm:"column:provider;unique_index:idx_identity_provider_subject"`
+	Subject     string `gorm:"column:subject;unique_index:idx_identity_provider_subject"`
+	Email       string `gorm:"column:email"`
+}
+
+// The server side of an authorization request, looked up by the `state` parameter when the user comes back.
+//
+// The PKCE verifier never leaves the server, only its S256 challenge is sent to the provider.
+// LinkUserModelID is set when a logged in user links a new identity instead of logging in.
+type OIDCStateModel struct {
+	gorm.Model
+	StateHash       string     `gorm:"column:state_hash;unique_index"`
+	Provider        string     `gorm:"column:provider"`
+	CodeVerifier    string     `gorm:"column:code_verifier"`
+	Nonce           string     `gorm:"column:nonce"`
+	LinkUserModelID uint       `gorm:"column:link_user_model_id"`
+	ExpiresAt       time.Time  `gorm:"column:expires_at"`
+	UsedAt          *time.Time `gorm:"column:used_at"`
+}
+
+// The claims of an ID token used to find or create the user
+type OIDCClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// You could start the authorization code flow, the user is sent to the returned URL.
+//
+// The state is returned too, for setOIDCStateCookie.
+//
+//	authorizationURL, state, err := StartOIDCAuthorization("google", 0)            log in
+//	authorizationURL, state, err := StartOIDCAuthorization("google", myUserModel.ID) link to an account
+func StartOIDCAuthorization(providerName string, linkUserID uint) (string, string, error) {
+	provider, err := getOIDCProvider(providerName)
+	if err != nil {
+		return "", "", err
+	}
+	config, _, err := provider.discover()
+	if err != nil {
+		return "", "", err
+	}
+	state := common.RandToken(32)
+	model := OIDCStateModel{
+		StateHash:       common.HashToken(state),
+		Provider:        providerName,
+		CodeVerifier:    oauth2.GenerateVerifier(),
+		Nonce:           common.RandToken(16),
+		LinkUserModelID: linkUserID,
+		ExpiresAt:       time.Now().Add(oidcStateTTL),
+	}
+	db := common.GetDB()
+	if err := db.Create(&model).Error; err != nil {
+		return "", "", err
+	}
+	return config.AuthCodeURL(state, oidc.Nonce(model.Nonce), oauth2.S256ChallengeOption(model.CodeVerifier)), state, nil
+}
+
+// Bind the state to the browser, the cookie lives as long as the state. The frontend has to send
+// its requests to the API with credentials for the cookie to come back with the callback.
+func setOIDCStateCookie(c *gin.Context, state string) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(oidcStateTTL.Seconds()), "/", "", oidcCookieSecure(c), true)
+}
+
+// Whether the posted state is the one of the cookie of the browser, the cookie is cleared either way.
+func checkOIDCStateCookie(c *gin.Context, state string) bool {
+	cookie, err := c.Cookie(oidcStateCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, "/", "", oidcCookieSecure(c), true)
+	return err == nil && cookie != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) == 1
+}
+
+// Secure behind TLS, or when the frontend is served over https and the API most likely too
+func oidcCookieSecure(c *gin.Context) bool {
+	return c.Request.TLS != nil || strings.HasPrefix(common.AppBaseURL, "https://")
+}
+
+// A state could only be used once, for the provider it was issued for.
+func consumeOIDCState(providerName, state string) (OIDCStateModel, error) {
+	db := common.GetDB()
+	var model OIDCStateModel
+	if err := db.Where(&OIDCStateModel{StateHash: common.HashToken(state)}).First(&model).Error; err != nil {
+		return model, ErrOIDCStateInvalid
+	}
+	if model.Provider != providerName || model.UsedAt != nil || time.Now().After(model.ExpiresAt) {
+		return model, ErrOIDCStateInvalid
+	}
+	result := db.Model(&OIDCStateModel{}).
+		Where("id = ? AND used_at IS NULL", model.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 0 {
+		return model, ErrOIDCStateInvalid
+	}
+	return model, nil
+}
+
+// You could finish the flow with the code sent back by the provider, the ID token is verified
+// against the JWKS of the issuer and the nonce of the state.
+//
+//	stateModel, claims, err := CompleteOIDCAuthorization(ctx, "google", code, state)
+func CompleteOIDCAuthorization(ctx context.Context, providerName, code, state string) (OIDCStateModel, OIDCClaims, error) {
+	var claims OIDCClaims
+	provider, err := getOIDCProvider(providerName)
+	if err != nil {
+		return OIDCStateModel{}, claims, err
+	}
+	stateModel, err := consumeOIDCState(providerName, state)
+	if err != nil {
+		return stateModel, claims, err
+	}
+	config, verifier, err := provider.discover()
+	if err != nil {
+		return stateModel, claims, err
+	}
+	ctx = oidc.ClientContext(ctx, oidcHTTPClient)
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(stateModel.CodeVerifier))
+	if err != nil {
+		return stateModel, claims, errors.New("The authorization code was refused by the identity provider")
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return stateModel, claims, errors.New("The identity provider did not return an ID token")
+	}
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != stateModel.Nonce {
+		return stateModel, claims, errors.New("Invalid ID token")
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return stateModel, claims, errors.New("Invalid ID token")
+	}
+	claims.Subject = idToken.Subject
+	return stateModel, claims, nil
+}
+
+// You could find the user of an external identity, by the identity itself or else by the verified email.
+//
+// An unknown email creates a new user. An existing user is only linked when both sides verified the email,
+// otherwise someone could register the address first and wait for the owner to sign in.
+func FindOrCreateOIDCUser(providerName string, claims OIDCClaims) (UserModel, error) {
+	db := common.GetDB()
+	var identity IdentityModel
+	db.Where(&IdentityModel{Provider: providerName, Subject: claims.Subject}).First(&identity)
+	if identity.ID != 0 {
+		return FindOneUser(&UserModel{ID: identity.UserModelID})
+	}
+	if !claims.EmailVerified || claims.Email == "" {
+		return UserModel{}, ErrOIDCEmailUnverified
+	}
+	userModel, err := FindOneUser(&UserModel{Email: claims.Email})
+	if err == nil {
+		if !userModel.IsVerified() {
+			return UserModel{}, ErrOIDCAccountConflict
+		}
+	} else {
+		if userModel, err = createOIDCUser(claims); err != nil {
+			return userModel, err
+		}
+	}
+	_, err = LinkIdentity(userModel.ID, providerName, claims)
+	return userModel, err
+}
+
+var nonAlphanum = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// Usernames have to be alphanumeric and unique, a random suffix is added until it is.
+func createOIDCUser(claims OIDCClaims) (UserModel, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.Split(claims.Email, "@")[0]
+	}
+	base = nonAlphanum.ReplaceAllString(base, "")
+	if len(base) > 32 {
+		base = base[:32]
+	}
+	username := base
+	for len(username) < 4 || usernameTaken(username) {
+		username = base + common.RandString(4)
+	}
+	verifiedAt := time.Now()
+	userModel := UserModel{
+		Username:   username,
+		Email:      claims.Email,
+		VerifiedAt: &verifiedAt,
+	}
+	// Nobody knows this password, a password could be set later with the reset flow.
+	if err := userModel.setPassword(common.RandToken(32)); err != nil {
+		return userModel, err
+	}
+	err := SaveOne(&userModel)
+	return userModel, err
+}
+
+func usernameTaken(username string) bool {
+	_, err := FindOneUser(&UserModel{Username: username})
+	return err == nil
+}
+
+// You could link an external identity to an user, an identity belongs to one user only.
+func LinkIdentity(userID uint, providerName string, claims OIDCClaims) (IdentityModel, error) {
+	db := common.GetDB()
+	var identity IdentityModel
+	db.Where(&IdentityModel{Provider: providerName, Subject: claims.Subject}).First(&identity)
+	if identity.ID != 0 {
+		if identity.UserModelID != userID {
+			return identity, ErrIdentityAlreadyLinked
+		}
+		return identity, nil
+	}
+	identity = IdentityModel{
+		UserModelID: userID,
+		Provider:    providerName,
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+	}
+	err := db.Create(&identity).Error
+	return identity, err
+}
+
+func ListUserIdentities(userID uint) ([]IdentityModel, error) {
+	db := common.GetDB()
+	var identities []IdentityModel
+	err := db.Where(&IdentityModel{UserModelID: userID}).Order("id").Find(&identities).Error
+	return identities, err
+}
+
+func UnlinkIdentity(userID, identityID uint) error {
+	db := common.GetDB()
+	var identity IdentityModel
+	db.Where(&IdentityModel{UserModelID: userID}).First(&identity, identityID)
+	if identity.ID == 0 {
+		return ErrIdentityNotFound
+	}
+	return db.Unscoped().Delete(&identity).Error
+}
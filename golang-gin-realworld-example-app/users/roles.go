@@ -0,0 +1,168 @@
+package users
+
+import (
+	"errors"
+	"log"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+// Permissions are plain strings "<resource>:<action>[:<scope>]", "*" grants every permission.
+//
+// Users without a role could still act on what they own, permissions only cover other users' content.
+const (
+	PermissionAll               = "*"
+	PermissionArticlesUpdateAny = "articles:update:any"
+	PermissionArticlesDeleteAny = "articles:delete:any"
+	PermissionCommentsDeleteAny = "comments:delete:any"
+	PermissionUsersUnlock       = "users:unlock"
+	PermissionRolesManage       = "roles:manage"
+	PermissionAuditRead         = "audit:read"
+)
+
+// The roles created by SeedRoles
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+var defaultRolePermissions = map[string][]string{
+	RoleAdmin:     {PermissionAll},
+	RoleModerator: {PermissionArticlesDeleteAny, PermissionCommentsDeleteAny},
+}
+
+var ErrRoleNotFound = errors.New("Unknown role")
+
+// A named set of permissions.
+type RoleModel struct {
+	gorm.Model
+	Name        string `gorm:"column:name;unique_index"`
+	Permissions []RolePermissionModel
+}
+
+type RolePermissionModel struct {
+	gorm.Model
+	RoleModel   RoleModel
+	RoleModelID uint   `gorm:"unique_index:idx_role_permission"`
+	Permission  string `gorm:"column:permission;unique_index:idx_role_permission"`
+}
+
+// The roles granted to an user, an user could have several.
+type UserRoleModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint `gorm:"unique_index:idx_user_role"`
+	RoleModel   RoleModel
+	RoleModelID uint `gorm:"unique_index:idx_user_role"`
+}
+
+// Create the default roles and their permissions if they are missing, permissions added by hand are kept.
+func SeedRoles() error {
+	db := common.GetDB()
+	for name, permissions := range defaultRolePermissions {
+		var role RoleModel
+		if err := db.Where(RoleModel{Name: name}).FirstOrCreate(&role).Error; err != nil {
+			return err
+		}
+		for _, permission := range permissions {
+			var rolePermission RolePermissionModel
+			err := db.Where(RolePermissionModel{RoleModelID: role.ID, Permission: permission}).
+				FirstOrCreate(&rolePermission).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Before the role tables, an user had at most one role in the role column of user_models. The roles found there
+// are granted and the column is dropped, so this runs once. Grants are idempotent, a failed drop is retried on the
+// next start.
+func migrateRoleColumn() error {
+	db := common.GetDB()
+	if !db.Dialect().HasColumn("user_models", "role") {
+		return nil
+	}
+	var legacy []struct {
+		ID   uint
+		Role string
+	}
+	err := db.Table("user_models").Select("id, role").Where("role IS NOT NULL AND role <> ''").
+		Scan(&legacy).Error
+	if err != nil {
+		return err
+	}
+	for _, user := range legacy {
+		err := GrantRole(user.ID, user.Role)
+		if err == ErrRoleNotFound {
+			log.Printf("role %q of user %d has no role model, it is not granted", user.Role, user.ID)
+		} else if err != nil {
+			return err
+		}
+	}
+	return db.Model(&UserModel{}).DropColumn("role").Error
+}
+
+func FindRole(name string) (RoleModel, error) {
+	db := common.GetDB()
+	var role RoleModel
+	if err := db.Where(&RoleModel{Name: name}).First(&role).Error; err != nil {
+		return role, ErrRoleNotFound
+	}
+	return role, nil
+}
+
+// You could grant a role to an user, granting it twice is a no-op.
+//
+//	err := users.GrantRole(userModel.ID, users.RoleModerator)
+func GrantRole(userID uint, roleName string) error {
+	role, err := FindRole(roleName)
+	if err != nil {
+		return err
+	}
+	db := common.GetDB()
+	var userRole UserRoleModel
+	return db.Where(UserRoleModel{UserModelID: userID, RoleModelID: role.ID}).FirstOrCreate(&userRole).Error
+}
+
+func RevokeRole(userID uint, roleName string) error {
+	role, err := FindRole(roleName)
+	if err != nil {
+		return err
+	}
+	db := common.GetDB()
+	return db.Unscoped().Where(&UserRoleModel{UserModelID: userID, RoleModelID: role.ID}).Delete(UserRoleModel{}).Error
+}
+
+// The names of the roles of an user, sorted.
+func (u UserModel) Roles() []string {
+	db := common.GetDB()
+	names := []string{}
+	db.Table("role_models").
+		Joins("JOIN user_role_models ON user_role_models.role_model_id = role_models.id AND user_role_models.deleted_at IS NULL").
+		Where("user_role_models.user_model_id = ? AND role_models.deleted_at IS NULL", u.ID).
+		Pluck("role_models.name", &names)
+	sort.Strings(names)
+	return names
+}
+
+// You could check a permission with one query over the roles of the user.
+//
+//	if myUserModel.HasPermission(users.PermissionArticlesDeleteAny) { ... }
+func (u UserModel) HasPermission(permission string) bool {
+	if u.ID == 0 {
+		return false
+	}
+	db := common.GetDB()
+	var count int
+	db.Table("role_permission_models").
+		Joins("JOIN user_role_models ON user_role_models.role_model_id = role_permission_models.role_model_id AND user_role_models.deleted_at IS NULL").
+		Where("user_role_models.user_model_id = ? AND role_permission_models.permission IN (?) AND role_permission_models.deleted_at IS NULL",
+			u.ID, []string{permission, PermissionAll}).
+		Count(&count)
+	return count > 0
+}
@@ -1,26 +1,79 @@
 package users
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"realworld-backend/audit"
 	"realworld-backend/common"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func UsersRegister(router *gin.RouterGroup) {
 	router.POST("/", UsersRegistration)
 	router.POST("/login", UsersLogin)
+	router.POST("/login/mfa", UsersLoginMFA)
+	router.GET("/oidc/:provider", UsersOIDCAuthorize)
+	router.POST("/oidc/:provider/callback", UsersOIDCCallback)
+	router.POST("/token/refresh", UsersTokenRefresh)
+	router.POST("/logout", AuthMiddleware(true), RequireSession(), UsersLogout)
+	router.POST("/password/reset", UsersPasswordResetRequest)
+	router.POST("/password/reset/confirm", UsersPasswordResetConfirm)
+	router.POST("/verify", UsersEmailVerify)
 }
 
 func UserRegister(router *gin.RouterGroup) {
 	router.GET("/", UserRetrieve)
+	// Everything below changes the account, personal access tokens are refused.
+	router.Use(RequireSession())
 	router.PUT("/", UserUpdate)
+	router.DELETE("/", UserDelete)
+	router.GET("/export", UserExport)
+	router.POST("/avatar", UserAvatarUpload)
+	router.DELETE("/avatar", UserAvatarDelete)
+	router.POST("/verify/resend", UserVerificationResend)
+	router.POST("/2fa", UserTwoFactorEnroll)
+	router.POST("/2fa/confirm", UserTwoFactorConfirm)
+	router.DELETE("/2fa", UserTwoFactorDisable)
+	router.GET("/sessions", UserSessionList)
+	router.DELETE("/sessions", UserSessionRevokeAll)
+	router.DELETE("/sessions/:id", UserSessionRevoke)
+	router.GET("/identities", UserIdentityList)
+	router.POST("/identities/:provider", UserIdentityLink)
+	router.DELETE("/identities/:id", UserIdentityUnlink)
+	router.GET("/tokens", UserAccessTokenList)
+	router.POST("/tokens", UserAccessTokenCreate)
+	router.DELETE("/tokens/:id", UserAccessTokenRevoke)
+	router.GET("/blocks", UserBlockList)
+	router.GET("/mutes", UserMuteList)
 }
 
 func ProfileRegister(router *gin.RouterGroup) {
 	router.GET("/:username", ProfileRetrieve)
-	router.POST("/:username/follow", ProfileFollow)
-	router.DELETE("/:username/follow", ProfileUnfollow)
+	router.GET("/:username/followers", ProfileFollowerList)
+	router.GET("/:username/following", ProfileFollowingList)
+	router.POST("/:username/follow", RequireScopes(ScopeProfilesWrite), ProfileFollow)
+	router.DELETE("/:username/follow", RequireScopes(ScopeProfilesWrite), ProfileUnfollow)
+	router.POST("/:username/block", RequireScopes(ScopeProfilesWrite), ProfileBlock)
+	router.DELETE("/:username/block", RequireScopes(ScopeProfilesWrite), ProfileUnblock)
+	router.POST("/:username/mute", RequireScopes(ScopeProfilesWrite), ProfileMute)
+	router.DELETE("/:username/mute", RequireScopes(ScopeProfilesWrite), ProfileUnmute)
+}
+
+func WellKnownRegister(router *gin.RouterGroup) {
+	router.GET("/jwks.json", JWKSRetrieve)
+}
+
+// Publish the public keys so that other services could verify our tokens.
+func JWKSRetrieve(c *gin.Context) {
+	c.JSON(http.StatusOK, common.Keys.JWKS())
 }
 
 func ProfileRetrieve(c *gin.Context) {
@@ -34,6 +87,84 @@ func ProfileRetrieve(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"profile": profileSerializer.Response()})
 }
 
+// Blocking and muting share everything but the model method, relate stands for block, unBlock, mute or unMute.
+func profileRelate(c *gin.Context, relate func(UserModel, UserModel) error) {
+	userModel, err := FindOneUser(&UserModel{Username: c.Param("username")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if userModel.ID == myUserModel.ID {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("profile", errors.New("You could not block or mute yourself")))
+		return
+	}
+	if err := relate(myUserModel, userModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ProfileSerializer{c, userModel}
+	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
+}
+
+func ProfileBlock(c *gin.Context) {
+	profileRelate(c, UserModel.block)
+}
+
+func ProfileUnblock(c *gin.Context) {
+	profileRelate(c, UserModel.unBlock)
+}
+
+func ProfileMute(c *gin.Context) {
+	profileRelate(c, UserModel.mute)
+}
+
+func ProfileUnmute(c *gin.Context) {
+	profileRelate(c, UserModel.unMute)
+}
+
+func ProfileFollowerList(c *gin.Context) {
+	profileFollowList(c, UserModel.FindFollowers)
+}
+
+func ProfileFollowingList(c *gin.Context) {
+	profileFollowList(c, UserModel.FindFollowings)
+}
+
+func profileFollowList(c *gin.Context, find func(UserModel, int, int) ([]UserModel, int, error)) {
+	userModel, err := FindOneUser(&UserModel{Username: c.Param("username")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	respondWithProfilePage(c, userModel, find)
+}
+
+func UserBlockList(c *gin.Context) {
+	userProfileList(c, UserModel.FindBlockedUsers)
+}
+
+func UserMuteList(c *gin.Context) {
+	userProfileList(c, UserModel.FindMutedUsers)
+}
+
+func userProfileList(c *gin.Context, find func(UserModel, int, int) ([]UserModel, int, error)) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	respondWithProfilePage(c, myUserModel, find)
+}
+
+// A page of the profiles found for userModel as {"profiles": [...], "profilesCount": n}
+func respondWithProfilePage(c *gin.Context, userModel UserModel, find func(UserModel, int, int) ([]UserModel, int, error)) {
+	limit, offset := common.Pagination(c)
+	userModels, count, err := find(userModel, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ProfilesSerializer{c, userModels}
+	c.JSON(http.StatusOK, gin.H{"profiles": serializer.Response(), "profilesCount": count})
+}
+
 func ProfileFollow(c *gin.Context) {
 	username := c.Param("username")
 	userModel, err := FindOneUser(&UserModel{Username: username})
@@ -42,11 +173,20 @@ func ProfileFollow(c *gin.Context) {
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if userModel.IsBlocking(myUserModel) {
+		c.JSON(http.StatusForbidden, common.NewError("profile", errors.New("You are blocked by this user")))
+		return
+	}
+	if myUserModel.IsBlocking(userModel) {
+		c.JSON(http.StatusForbidden, common.NewError("profile", errors.New("Unblock this user before following")))
+		return
+	}
 	err = myUserModel.following(userModel)
 	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	audit.Record(c, audit.Event{Action: audit.ActionProfileFollow, TargetType: audit.TargetUser, TargetID: userModel.ID})
 	serializer := ProfileSerializer{c, userModel}
 	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
 }
@@ -65,6 +205,7 @@ func ProfileUnfollow(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	audit.Record(c, audit.Event{Action: audit.ActionProfileUnfollow, TargetType: audit.TargetUser, TargetID: userModel.ID})
 	serializer := ProfileSerializer{c, userModel}
 	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
 }
@@ -72,6 +213,10 @@ func ProfileUnfollow(c *gin.Context) {
 func UsersRegistration(c *gin.Context) {
 	userModelValidator := NewUserModelValidator()
 	if err := userModelValidator.Bind(c); err != nil {
+		if hashErr := (PasswordHashError{}); errors.As(err, &hashErr) {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("password", err))
+			return
+		}
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
@@ -80,9 +225,40 @@ func UsersRegistration(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
-	c.Set("my_user_model", userModelValidator.userModel)
+	audit.Record(c, audit.Event{Action: audit.ActionUserRegister, ActorID: userModelValidator.userModel.ID,
+		TargetType: audit.TargetUser, TargetID: userModelValidator.userModel.ID})
+	if err := sendVerificationEmail(userModelValidator.userModel); err != nil {
+		log.Printf("verification email failed: %v", err)
+	}
+	respondWithNewLogin(c, userModelValidator.userModel, http.StatusCreated)
+}
+
+// Log the user in: a new session is started and its first refresh token returned along the access token.
+func respondWithNewLogin(c *gin.Context, userModel UserModel, status int) {
+	session, err := StartSession(userModel.ID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	refreshToken, err := IssueRefreshToken(userModel.ID, session.FamilyID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	UpdateContextUserModel(c, userModel.ID)
+	c.Set("my_session_id", session.ID)
 	serializer := UserSerializer{c}
-	c.JSON(http.StatusCreated, gin.H{"user": serializer.Response()})
+	response, err := serializer.Response()
+	if err != nil {
+		// No access token, the session is not left behind with a refresh token nobody got
+		RevokeSession(userModel.ID, session.ID)
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	response.RefreshToken = refreshToken
+	audit.Record(c, audit.Event{Action: audit.ActionUserLogin, ActorID: userModel.ID,
+		TargetType: audit.TargetUser, TargetID: userModel.ID, Details: map[string]interface{}{"sessionId": session.ID}})
+	c.JSON(status, gin.H{"user": response})
 }
 
 func UsersLogin(c *gin.Context) {
@@ -91,41 +267,702 @@ func UsersLogin(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
+	// Locked logins are refused before the password hash is checked, so a brute-force could not burn the CPU either.
+	accountKey := accountThrottleKey(loginValidator.userModel.Email)
+	ipKey := ipThrottleKey(c.ClientIP())
+	if retryAfter := loginRetryAfter(accountKey, ipKey); retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, common.NewError("login", errors.New("Too many failed login attempts, try again later")))
+		return
+	}
 	userModel, err := FindOneUser(&UserModel{Email: loginValidator.userModel.Email})
 
-	if err != nil {
+	if err != nil || userModel.checkPassword(loginValidator.User.Password) != nil {
+		recordLoginFailure(accountKey, common.LoginMaxAccountFailures)
+		recordLoginFailure(ipKey, common.LoginMaxIPFailures)
+		event := audit.Event{Action: audit.ActionUserLoginFailed, Details: map[string]interface{}{"email": loginValidator.userModel.Email, "reason": "password"}}
+		if userModel.ID != 0 {
+			event.TargetType, event.TargetID = audit.TargetUser, userModel.ID
+		}
+		audit.Record(c, event)
 		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
 		return
 	}
+	respondWithFirstFactor(c, userModel)
+}
 
-	if userModel.checkPassword(loginValidator.User.Password) != nil {
-		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
+// With two-factor enabled the first factor only buys a challenge, the token comes with the code.
+//
+// The failures of the account are only cleared by a complete login, the wrong codes sent after a right
+// password are counted against the account as well.
+func respondWithFirstFactor(c *gin.Context, userModel UserModel) {
+	twoFactor := GetTwoFactor(userModel.ID)
+	if twoFactor.IsEnabled() {
+		serializer := MFAChallengeSerializer{c, userModel}
+		response, err := serializer.Response()
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"mfa": response})
+		return
+	}
+	// Only the account is cleared, a valid account of the attacker should not reset the IP counter.
+	resetLoginFailures(accountThrottleKey(userModel.Email))
+	respondWithNewLogin(c, userModel, http.StatusOK)
+}
+
+// Send the user to the identity provider, the frontend redirects to the returned URL.
+func UsersOIDCAuthorize(c *gin.Context) {
+	authorizationURL, state, err := StartOIDCAuthorization(c.Param("provider"), 0)
+	if err == ErrOIDCProviderUnknown {
+		c.JSON(http.StatusNotFound, common.NewError("oidc", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, common.NewError("oidc", errors.New("The identity provider is not available")))
+		return
+	}
+	setOIDCStateCookie(c, state)
+	c.JSON(http.StatusOK, gin.H{"oidc": gin.H{"authorizationUrl": authorizationURL}})
+}
+
+// The frontend posts the `code` and `state` it got back from the provider, the user is logged in,
+// or the identity linked when the flow was started from the account settings.
+func UsersOIDCCallback(c *gin.Context) {
+	callbackValidator := NewOIDCCallbackValidator()
+	if err := callbackValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if !checkOIDCStateCookie(c, callbackValidator.OIDC.State) {
+		c.JSON(http.StatusUnauthorized, common.NewError("oidc", ErrOIDCStateInvalid))
+		return
+	}
+	providerName := c.Param("provider")
+	stateModel, claims, err := CompleteOIDCAuthorization(c.Request.Context(), providerName, callbackValidator.OIDC.Code, callbackValidator.OIDC.State)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, common.NewError("oidc", err))
 		return
 	}
+	if stateModel.LinkUserModelID != 0 {
+		identity, err := LinkIdentity(stateModel.LinkUserModelID, providerName, claims)
+		if err != nil {
+			c.JSON(http.StatusConflict, common.NewError("oidc", err))
+			return
+		}
+		serializer := IdentitySerializer{c, identity}
+		c.JSON(http.StatusCreated, gin.H{"identity": serializer.Response()})
+		return
+	}
+	userModel, err := FindOrCreateOIDCUser(providerName, claims)
+	if err == ErrOIDCEmailUnverified {
+		c.JSON(http.StatusForbidden, common.NewError("oidc", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, common.NewError("oidc", err))
+		return
+	}
+	respondWithFirstFactor(c, userModel)
+}
+
+// Second step of the login for users with two-factor enabled.
+func UsersLoginMFA(c *gin.Context) {
+	mfaLoginValidator := NewMFALoginValidator()
+	if err := mfaLoginValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(mfaLoginValidator.MFA.Challenge, &claims, common.Keys.Keyfunc)
+	jti, _ := claims["jti"].(string)
+	if err != nil || claims["typ"] != common.MFAChallengeTokenType || IsAccessTokenRevoked(jti) {
+		c.JSON(http.StatusUnauthorized, common.NewError("mfa", errors.New("Invalid or expired challenge")))
+		return
+	}
+	expiresAt, _ := claims.GetExpirationTime()
+	id, _ := claims["id"].(float64)
+	userModel, err := FindOneUser(&UserModel{ID: uint(id)})
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, common.NewError("mfa", errors.New("Invalid or expired challenge")))
+		return
+	}
+	challengeKey := challengeThrottleKey(jti)
+	if loginRetryAfter(challengeKey) > 0 {
+		RevokeAccessToken(jti, expiresAt.Time)
+		c.JSON(http.StatusUnauthorized, common.NewError("mfa", errors.New("Too many invalid codes, log in again")))
+		return
+	}
+	accountKey := accountThrottleKey(userModel.Email)
+	if retryAfter := loginRetryAfter(accountKey); retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, common.NewError("login", errors.New("Too many failed login attempts, try again later")))
+		return
+	}
+	if err := userModel.verifyTwoFactorCode(mfaLoginValidator.MFA.Code); err != nil {
+		recordLoginFailure(challengeKey, MaxTwoFactorAttempts)
+		recordLoginFailure(accountKey, common.LoginMaxAccountFailures)
+		audit.Record(c, audit.Event{Action: audit.ActionUserLoginFailed, TargetType: audit.TargetUser, TargetID: userModel.ID,
+			Details: map[string]interface{}{"email": userModel.Email, "reason": "mfa"}})
+		c.JSON(http.StatusUnauthorized, common.NewError("mfa", err))
+		return
+	}
+	// A challenge is single-use
+	RevokeAccessToken(jti, expiresAt.Time)
+	resetLoginFailures(challengeKey)
+	resetLoginFailures(accountKey)
+	respondWithNewLogin(c, userModel, http.StatusOK)
+}
+
+// Exchange a refresh token for a new access token, the refresh token is rotated at the same time.
+func UsersTokenRefresh(c *gin.Context) {
+	refreshTokenValidator := NewRefreshTokenValidator()
+	if err := refreshTokenValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	userModel, refreshToken, err := RotateRefreshToken(refreshTokenValidator.User.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, common.NewError("token", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionTokenRefresh, ActorID: userModel.ID, TargetType: audit.TargetUser, TargetID: userModel.ID})
 	UpdateContextUserModel(c, userModel.ID)
+	if session := FindSessionByRefreshToken(refreshToken); session.ID != 0 {
+		session.extend()
+		c.Set("my_session_id", session.ID)
+	}
 	serializer := UserSerializer{c}
-	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
+	response, err := serializer.Response()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	response.RefreshToken = refreshToken
+	c.JSON(http.StatusOK, gin.H{"user": response})
+}
+
+// Revoke the access token and the session of the request, and the refresh token family if one is posted.
+func UsersLogout(c *gin.Context) {
+	claims := c.MustGet("my_token_claims").(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+	expiresAt, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || expiresAt == nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", errors.New("Token can not be revoked")))
+		return
+	}
+	if err := RevokeAccessToken(jti, expiresAt.Time); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if sessionID := c.GetUint("my_session_id"); sessionID != 0 {
+		RevokeSession(c.GetUint("my_user_id"), sessionID)
+	}
+	refreshTokenValidator := NewRefreshTokenValidator()
+	if err := refreshTokenValidator.Bind(c); err == nil {
+		RevokeRefreshToken(refreshTokenValidator.User.RefreshToken)
+	}
+	c.JSON(http.StatusOK, gin.H{"user": "Logout success"})
 }
 
 func UserRetrieve(c *gin.Context) {
 	serializer := UserSerializer{c}
-	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
+	response, err := serializer.Response()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": response})
 }
 
 func UserUpdate(c *gin.Context) {
 	myUserModel := c.MustGet("my_user_model").(UserModel)
 	userModelValidator := NewUserModelValidatorFillWith(myUserModel)
 	if err := userModelValidator.Bind(c); err != nil {
+		if hashErr := (PasswordHashError{}); errors.As(err, &hashErr) {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("password", err))
+			return
+		}
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
 
 	userModelValidator.userModel.ID = myUserModel.ID
+	previousEmail := myUserModel.Email
 	if err := myUserModel.Update(userModelValidator.userModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	// A new password logs out the other devices, whoever knew the old one is kicked out.
+	if userModelValidator.userModel.PasswordHash != "" {
+		if _, err := RevokeUserSessions(myUserModel.ID, c.GetUint("my_session_id")); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+		audit.Record(c, audit.Event{Action: audit.ActionUserPasswordChange, TargetType: audit.TargetUser, TargetID: myUserModel.ID})
+	}
+	// A new address has to be verified again
+	if myUserModel.Email != previousEmail {
+		audit.Record(c, audit.Event{Action: audit.ActionUserEmailChange, TargetType: audit.TargetUser, TargetID: myUserModel.ID,
+			Details: map[string]interface{}{"from": previousEmail, "to": myUserModel.Email}})
+		if err := myUserModel.Update(map[string]interface{}{"verified_at": nil}); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+		if err := sendVerificationEmail(myUserModel); err != nil {
+			log.Printf("verification email failed: %v", err)
+		}
+	}
 	UpdateContextUserModel(c, myUserModel.ID)
 	serializer := UserSerializer{c}
-	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
+	response, err := serializer.Response()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": response})
+}
+
+// Everything the account owns as JSON, or as a zip archive with one file per section when ?format=zip.
+func UserExport(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	bundle, err := ExportAccount(myUserModel)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if c.Query("format") != "zip" {
+		c.JSON(http.StatusOK, gin.H{"export": bundle})
+		return
+	}
+	// The archive is built before it is sent, so that a failure is still answered with an error
+	var archive bytes.Buffer
+	if err := WriteAccountExportZip(&archive, bundle); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("export", err))
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-export.zip\"", myUserModel.Username))
+	c.Data(http.StatusOK, "application/zip", archive.Bytes())
+}
+
+// The password has to be entered again, a stolen access token alone could not delete the account.
+func UserDelete(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	deleteValidator := NewAccountDeleteValidator()
+	if err := deleteValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if myUserModel.checkPassword(deleteValidator.User.Password) != nil {
+		c.JSON(http.StatusForbidden, common.NewError("user", errors.New("Invalid password")))
+		return
+	}
+	if err := DeleteAccount(myUserModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionUserDelete, TargetType: audit.TargetUser, TargetID: myUserModel.ID,
+		Details: map[string]interface{}{"username": myUserModel.Username}})
+	c.JSON(http.StatusOK, gin.H{"user": "Account deleted"})
+}
+
+// The image is sent as the "avatar" field of a multipart form. It is resized to AvatarSizes and stored
+// as JPEG, which drops the EXIF data, and the profile image points at it from now on.
+func UserAvatarUpload(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	// Leave some room for the multipart headers around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(common.AvatarMaxBytes)+4096)
+	fileHeader, err := c.FormFile("avatar")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, common.NewError("avatar", errors.New("The image is too large")))
+			return
+		}
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("avatar", errors.New("An image is required in the avatar field")))
+		return
+	}
+	if fileHeader.Size > int64(common.AvatarMaxBytes) {
+		c.JSON(http.StatusRequestEntityTooLarge, common.NewError("avatar", errors.New("The image is too large")))
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("avatar", err))
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("avatar", err))
+		return
+	}
+	if err := myUserModel.setAvatar(data); err != nil {
+		if errors.Is(err, common.ErrImageUnsupported) {
+			c.JSON(http.StatusUnsupportedMediaType, common.NewError("avatar", err))
+			return
+		}
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("avatar", err))
+		return
+	}
+	serializer := AvatarSerializer{c, myUserModel}
+	c.JSON(http.StatusOK, gin.H{"avatar": serializer.Response()})
+}
+
+// Remove the uploaded avatar, the profile falls back to the image URL
+func UserAvatarDelete(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if err := myUserModel.removeAvatar(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := AvatarSerializer{c, myUserModel}
+	c.JSON(http.StatusOK, gin.H{"avatar": serializer.Response()})
+}
+
+// The same answer is given whether the email is registered or not, so the endpoint could not be used
+// to find out who has an account.
+func UsersPasswordResetRequest(c *gin.Context) {
+	resetRequestValidator := NewPasswordResetRequestValidator()
+	if err := resetRequestValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	// The email is sent after the response, its time would tell whether the address is registered
+	userModel, err := FindOneUser(&UserModel{Email: resetRequestValidator.User.Email})
+	if err == nil {
+		common.SendInBackground("password reset email", func() error { return sendPasswordResetEmail(userModel) })
+	}
+	c.JSON(http.StatusAccepted, gin.H{"user": "If the email is registered, a password reset link has been sent"})
+}
+
+func sendPasswordResetEmail(userModel UserModel) error {
+	token, err := IssuePasswordResetToken(userModel.ID)
+	if err != nil {
+		return err
+	}
+	return common.GetMailer().Send(common.Message{
+		To:      userModel.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password, it expires in %v.\n\n%s/#/reset-password?token=%s\n\nReset token: %s\n\nIf you did not ask for it, you can ignore this email.\n",
+			userModel.Username, common.PasswordResetTTL, common.AppBaseURL, token, token),
+	})
+}
+
+// Set a new password with a reset token, every session of the user is logged out.
+func UsersPasswordResetConfirm(c *gin.Context) {
+	resetConfirmValidator := NewPasswordResetConfirmValidator()
+	if err := resetConfirmValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	// The password is checked before the token is used up, so that the user could pick another one
+	userModel, err := PeekPasswordResetToken(resetConfirmValidator.User.Token)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	if err := common.ValidatePassword(resetConfirmValidator.User.Password, userModel.Username, userModel.Email); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	userModel, err = ConsumePasswordResetToken(resetConfirmValidator.User.Token)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	if err := userModel.setPassword(resetConfirmValidator.User.Password); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("password", err))
+		return
+	}
+	if err := userModel.Update(UserModel{PasswordHash: userModel.PasswordHash}); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if _, err := RevokeUserSessions(userModel.ID, 0); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionUserPasswordReset, ActorID: userModel.ID, TargetType: audit.TargetUser, TargetID: userModel.ID})
+	c.JSON(http.StatusOK, gin.H{"user": "Password reset success"})
+}
+
+func sendVerificationEmail(userModel UserModel) error {
+	token, err := IssueEmailVerificationToken(userModel)
+	if err != nil {
+		return err
+	}
+	return common.GetMailer().Send(common.Message{
+		To:      userModel.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to verify your email address, it expires in %v.\n\n%s/#/verify-email?token=%s\n\nVerification token: %s\n",
+			userModel.Username, common.EmailVerificationTTL, common.AppBaseURL, token, token),
+	})
+}
+
+func UsersEmailVerify(c *gin.Context) {
+	verifyValidator := NewEmailVerifyValidator()
+	if err := verifyValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if _, err := ConsumeEmailVerificationToken(verifyValidator.User.Token); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("token", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": "Email verified"})
+}
+
+func UserVerificationResend(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if myUserModel.IsVerified() {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("email", errors.New("Email is already verified")))
+		return
+	}
+	if err := sendVerificationEmail(myUserModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("email", err))
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"user": "Verification email sent"})
+}
+
+// Start the enrolment, the secret only becomes active after a code has been confirmed.
+func UserTwoFactorEnroll(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	secret, recoveryCodes, err := myUserModel.enrollTwoFactor()
+	if err == ErrTwoFactorAlreadyEnabled {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("twoFactor", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := TwoFactorEnrollmentSerializer{c, secret, recoveryCodes}
+	c.JSON(http.StatusCreated, gin.H{"twoFactor": serializer.Response()})
+}
+
+func UserTwoFactorConfirm(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	codeValidator := NewTwoFactorCodeValidator()
+	if err := codeValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if err := myUserModel.confirmTwoFactor(codeValidator.TwoFactor.Code); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("twoFactor", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"twoFactor": gin.H{"enabled": true}})
+}
+
+// Disabling needs the password and a current code, a stolen access token is not enough.
+func UserTwoFactorDisable(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	disableValidator := NewTwoFactorDisableValidator()
+	if err := disableValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if myUserModel.checkPassword(disableValidator.TwoFactor.Password) != nil {
+		c.JSON(http.StatusForbidden, common.NewError("twoFactor", errors.New("Invalid password or authentication code")))
+		return
+	}
+	if err := myUserModel.verifyTwoFactorCode(disableValidator.TwoFactor.Code); err != nil {
+		if err == ErrTwoFactorNotEnabled {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("twoFactor", err))
+			return
+		}
+		c.JSON(http.StatusForbidden, common.NewError("twoFactor", errors.New("Invalid password or authentication code")))
+		return
+	}
+	if err := myUserModel.disableTwoFactor(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"twoFactor": gin.H{"enabled": false}})
+}
+
+func UserSessionList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	sessions, err := ListUserSessions(myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("sessions", err))
+		return
+	}
+	serializer := SessionsSerializer{c, sessions}
+	c.JSON(http.StatusOK, gin.H{"sessions": serializer.Response()})
+}
+
+func UserSessionRevoke(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusNotFound, common.NewError("session", ErrSessionNotFound))
+		return
+	}
+	if err := RevokeSession(myUserModel.ID, uint(id)); err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("session", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session": "Session revoked"})
+}
+
+// Log out everywhere, the session of the request included.
+func UserSessionRevokeAll(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if _, err := RevokeUserSessions(myUserModel.ID, 0); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session": "All sessions revoked"})
+}
+
+func UserIdentityList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	identities, err := ListUserIdentities(myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("identities", err))
+		return
+	}
+	serializer := IdentitiesSerializer{c, identities}
+	c.JSON(http.StatusOK, gin.H{"identities": serializer.Response()})
+}
+
+// Start the flow to link another identity, the callback links it instead of logging in.
+func UserIdentityLink(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	authorizationURL, state, err := StartOIDCAuthorization(c.Param("provider"), myUserModel.ID)
+	if err == ErrOIDCProviderUnknown {
+		c.JSON(http.StatusNotFound, common.NewError("oidc", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, common.NewError("oidc", errors.New("The identity provider is not available")))
+		return
+	}
+	setOIDCStateCookie(c, state)
+	c.JSON(http.StatusOK, gin.H{"oidc": gin.H{"authorizationUrl": authorizationURL}})
+}
+
+func UserIdentityUnlink(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusNotFound, common.NewError("identity", ErrIdentityNotFound))
+		return
+	}
+	if err := UnlinkIdentity(myUserModel.ID, uint(id)); err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("identity", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"identity": "Identity unlinked"})
+}
+
+func UserAccessTokenList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	accessTokens, err := ListPersonalAccessTokens(myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("tokens", err))
+		return
+	}
+	serializer := AccessTokensSerializer{c, accessTokens}
+	c.JSON(http.StatusOK, gin.H{"tokens": serializer.Response()})
+}
+
+// The token is only shown in this response, afterwards nobody could read it again.
+func UserAccessTokenCreate(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	accessTokenValidator := NewAccessTokenValidator()
+	if err := accessTokenValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	expiresAt := accessTokenValidator.Token.ExpiresAt
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("expiresAt", errors.New("should be in the future")))
+		return
+	}
+	model, token, err := CreatePersonalAccessToken(myUserModel.ID, accessTokenValidator.Token.Name, accessTokenValidator.Token.Scopes, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionTokenCreate, TargetType: audit.TargetToken, TargetID: model.ID,
+		Details: map[string]interface{}{"name": model.Name, "scopes": model.ScopeList()}})
+	serializer := AccessTokenSerializer{c, model}
+	response := serializer.Response()
+	response.Token = token
+	c.JSON(http.StatusCreated, gin.H{"token": response})
+}
+
+func UserAccessTokenRevoke(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusNotFound, common.NewError("token", ErrAccessTokenNotFound))
+		return
+	}
+	if err := RevokePersonalAccessToken(myUserModel.ID, uint(id)); err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("token", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionTokenRevoke, TargetType: audit.TargetToken, TargetID: id})
+	c.JSON(http.StatusOK, gin.H{"token": "Token revoked"})
+}
+
+func AdminRegister(router *gin.RouterGroup) {
+	router.Use(RequireSession())
+	router.POST("/users/:username/unlock", RequirePermission(PermissionUsersUnlock), AdminUserUnlock)
+	router.PUT("/users/:username/roles/:role", RequirePermission(PermissionRolesManage), AdminRoleGrant)
+	router.DELETE("/users/:username/roles/:role", RequirePermission(PermissionRolesManage), AdminRoleRevoke)
+	router.GET("/audit", RequirePermission(PermissionAuditRead), audit.AuditEventList)
+	router.GET("/audit/export", RequirePermission(PermissionAuditRead), audit.AuditEventExport)
+}
+
+// Lift the login lockout of an account before it expires.
+func AdminUserUnlock(c *gin.Context) {
+	username := c.Param("username")
+	userModel, err := FindOneUser(&UserModel{Username: username})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("user", errors.New("Invalid username")))
+		return
+	}
+	if err := UnlockAccount(userModel.Email); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionUserUnlock, TargetType: audit.TargetUser, TargetID: userModel.ID})
+	c.JSON(http.StatusOK, gin.H{"user": "Account unlocked"})
+}
+
+func AdminRoleGrant(c *gin.Context) {
+	userModel, err := FindOneUser(&UserModel{Username: c.Param("username")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("user", errors.New("Invalid username")))
+		return
+	}
+	if err := GrantRole(userModel.ID, c.Param("role")); err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("role", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionRoleGrant, TargetType: audit.TargetUser, TargetID: userModel.ID,
+		Details: map[string]interface{}{"role": c.Param("role")}})
+	c.JSON(http.StatusOK, gin.H{"roles": userModel.Roles()})
+}
+
+func AdminRoleRevoke(c *gin.Context) {
+	userModel, err := FindOneUser(&UserModel{Username: c.Param("username")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("user", errors.New("Invalid username")))
+		return
+	}
+	if err := RevokeRole(userModel.ID, c.Param("role")); err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("role", err))
+		return
+	}
+	audit.Record(c, audit.Event{Action: audit.ActionRoleRevoke, TargetType: audit.TargetUser, TargetID: userModel.ID,
+		Details: map[string]interface{}{"role": c.Param("role")}})
+	c.JSON(http.StatusOK, gin.H{"roles": userModel.Roles()})
 }
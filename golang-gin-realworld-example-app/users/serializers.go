@@ -1,6 +1,9 @@
 package users
 
 import (
+	"log"
+	"time"
+
 	"github.com/gin-gonic/gin"
 
 	"realworld-backend/common"
@@ -13,24 +16,76 @@ type ProfileSerializer struct {
 
 // Declare your response schema here
 type ProfileResponse struct {
-	ID        uint    `json:"-"`
-	Username  string  `json:"username"`
-	Bio       string  `json:"bio"`
-	Image     *string `json:"image"`
-	Following bool    `json:"following"`
+	ID             uint    `json:"-"`
+	Username       string  `json:"username"`
+	Bio            string  `json:"bio"`
+	Image          *string `json:"image"`
+	Following      bool    `json:"following"`
+	Blocking       bool    `json:"blocking"`
+	Muting         bool    `json:"muting"`
+	FollowersCount int     `json:"followersCount"`
+	FollowingCount int     `json:"followingCount"`
 }
 
 // Put your response logic including wrap the userModel here.
 func (self *ProfileSerializer) Response() ProfileResponse {
+	serializer := ProfilesSerializer{self.C, []UserModel{self.UserModel}}
+	return serializer.Response()[0]
+}
+
+// The following, blocking and muting flags and the counts of all profiles are loaded together,
+// the number of queries does not grow with the number of profiles.
+type ProfilesSerializer struct {
+	C     *gin.Context
+	Users []UserModel
+}
+
+func (self *ProfilesSerializer) Response() []ProfileResponse {
 	myUserModel := self.C.MustGet("my_user_model").(UserModel)
-	profile := ProfileResponse{
-		ID:        self.ID,
-		Username:  self.Username,
-		Bio:       self.Bio,
-		Image:     self.Image,
-		Following: myUserModel.isFollowing(self.UserModel),
+	ids := make([]uint, 0, len(self.Users))
+	for _, user := range self.Users {
+		ids = append(ids, user.ID)
+	}
+	followed := myUserModel.followingSet(ids)
+	blocked := myUserModel.blockingSet(ids)
+	muted := myUserModel.mutingSet(ids)
+	followers, followings, err := countFollows(ids)
+	if err != nil {
+		log.Printf("follow counts could not be loaded: %v", err)
+	}
+	response := []ProfileResponse{}
+	for _, user := range self.Users {
+		response = append(response, ProfileResponse{
+			ID:             user.ID,
+			Username:       user.Username,
+			Bio:            user.Bio,
+			Image:          user.ImageURL(),
+			Following:      followed[user.ID],
+			Blocking:       blocked[user.ID],
+			Muting:         muted[user.ID],
+			FollowersCount: followers[user.ID],
+			FollowingCount: followings[user.ID],
+		})
+	}
+	return response
+}
+
+type AvatarSerializer struct {
+	C *gin.Context
+	UserModel
+}
+
+type AvatarResponse struct {
+	Image *string `json:"image"`
+	// The URL of every stored size, keyed by the size in pixels
+	Sizes map[string]string `json:"sizes"`
+}
+
+func (self *AvatarSerializer) Response() AvatarResponse {
+	return AvatarResponse{
+		Image: self.ImageURL(),
+		Sizes: self.AvatarURLs(),
 	}
-	return profile
 }
 
 type UserSerializer struct {
@@ -43,16 +98,188 @@ type UserResponse struct {
 	Bio      string  `json:"bio"`
 	Image    *string `json:"image"`
 	Token    string  `json:"token"`
+	// Only filled when a new token family is started or rotated, e.g. login and refresh
+	RefreshToken string `json:"refreshToken,omitempty"`
 }
 
-func (self *UserSerializer) Response() UserResponse {
+// It fails when the token could not be signed, see common.GenSessionToken.
+func (self *UserSerializer) Response() (UserResponse, error) {
 	myUserModel := self.c.MustGet("my_user_model").(UserModel)
 	user := UserResponse{
 		Username: myUserModel.Username,
 		Email:    myUserModel.Email,
 		Bio:      myUserModel.Bio,
-		Image:    myUserModel.Image,
-		Token:    common.GenToken(myUserModel.ID),
+		Image:    myUserModel.ImageURL(),
+	}
+	// A personal access token could not be exchanged for a login token
+	if _, isAccessToken := self.c.Get("my_token_scopes"); !isAccessToken {
+		token, err := common.GenSessionToken(myUserModel.ID, self.c.GetUint("my_session_id"))
+		if err != nil {
+			return user, err
+		}
+		user.Token = token
+	}
+	return user, nil
+}
+
+type MFAChallengeSerializer struct {
+	C *gin.Context
+	UserModel
+}
+
+type MFAChallengeResponse struct {
+	Challenge string   `json:"challenge"`
+	Methods   []string `json:"methods"`
+}
+
+func (self *MFAChallengeSerializer) Response() (MFAChallengeResponse, error) {
+	challenge, err := common.GenChallengeToken(self.ID, common.MFAChallengeTokenType, common.MFAChallengeTTL)
+	return MFAChallengeResponse{
+		Challenge: challenge,
+		Methods:   []string{"totp", "recovery_code"},
+	}, err
+}
+
+type TwoFactorEnrollmentSerializer struct {
+	C             *gin.Context
+	Secret        string
+	RecoveryCodes []string
+}
+
+type TwoFactorEnrollmentResponse struct {
+	Secret        string   `json:"secret"`
+	OTPAuthURI    string   `json:"otpauthUri"`
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+func (self *TwoFactorEnrollmentSerializer) Response() TwoFactorEnrollmentResponse {
+	myUserModel := self.C.MustGet("my_user_model").(UserModel)
+	return TwoFactorEnrollmentResponse{
+		Secret:        self.Secret,
+		OTPAuthURI:    common.TOTPURI(TOTPIssuer, myUserModel.Email, self.Secret),
+		RecoveryCodes: self.RecoveryCodes,
+	}
+}
+
+type SessionSerializer struct {
+	C *gin.Context
+	SessionModel
+}
+
+type SessionsSerializer struct {
+	C        *gin.Context
+	Sessions []SessionModel
+}
+
+type SessionResponse struct {
+	ID         uint   `json:"id"`
+	UserAgent  string `json:"userAgent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"createdAt"`
+	LastSeenAt string `json:"lastSeenAt"`
+	Current    bool   `json:"current"`
+}
+
+func (self *SessionSerializer) Response() SessionResponse {
+	return SessionResponse{
+		ID:         self.ID,
+		UserAgent:  self.UserAgent,
+		IP:         self.IP,
+		CreatedAt:  self.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		LastSeenAt: self.LastSeenAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Current:    self.ID == self.C.GetUint("my_session_id"),
+	}
+}
+
+func (self *SessionsSerializer) Response() []SessionResponse {
+	response := []SessionResponse{}
+	for _, session := range self.Sessions {
+		serializer := SessionSerializer{self.C, session}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type IdentitySerializer struct {
+	C *gin.Context
+	IdentityModel
+}
+
+type IdentitiesSerializer struct {
+	C          *gin.Context
+	Identities []IdentityModel
+}
+
+type IdentityResponse struct {
+	ID        uint   `json:"id"`
+	Provider  string `json:"provider"`
+	Email     string `json:"email"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func (self *IdentitySerializer) Response() IdentityResponse {
+	return IdentityResponse{
+		ID:        self.ID,
+		Provider:  self.Provider,
+		Email:     self.Email,
+		CreatedAt: self.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+func (self *IdentitiesSerializer) Response() []IdentityResponse {
+	response := []IdentityResponse{}
+	for _, identity := range self.Identities {
+		serializer := IdentitySerializer{self.C, identity}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type AccessTokenSerializer struct {
+	C *gin.Context
+	PersonalAccessTokenModel
+}
+
+type AccessTokensSerializer struct {
+	C            *gin.Context
+	AccessTokens []PersonalAccessTokenModel
+}
+
+type AccessTokenResponse struct {
+	ID         uint     `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	ExpiresAt  *string  `json:"expiresAt"`
+	LastUsedAt *string  `json:"lastUsedAt"`
+	// Only returned once, when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+func formatOptionalTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	formatted := t.UTC().Format("2006-01-02T15:04:05.999Z")
+	return &formatted
+}
+
+func (self *AccessTokenSerializer) Response() AccessTokenResponse {
+	return AccessTokenResponse{
+		ID:         self.ID,
+		Name:       self.Name,
+		Scopes:     self.ScopeList(),
+		CreatedAt:  self.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		ExpiresAt:  formatOptionalTime(self.ExpiresAt),
+		LastUsedAt: formatOptionalTime(self.LastUsedAt),
+	}
+}
+
+func (self *AccessTokensSerializer) Response() []AccessTokenResponse {
+	response := []AccessTokenResponse{}
+	for _, accessToken := range self.AccessTokens {
+		serializer := AccessTokenSerializer{self.C, accessToken}
+		response = append(response, serializer.Response())
 	}
-	return user
+	return response
 }
@@ -0,0 +1,146 @@
+package users
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+var ErrSessionNotFound = errors.New("Invalid id")
+
+// LastSeenAt is only written when it is older than this, so AuthMiddleware does not write on every request.
+const sessionTouchInterval = time.Minute
+
+// A session is one login on one device, it lives as long as its refresh token family.
+//
+// The access tokens of a session carry its ID in the `sid` claim, AuthMiddleware refuses them
+// as soon as the session is revoked.
+type SessionModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint       `gorm:"index"`
+	FamilyID    string     `gorm:"column:family_id;unique_index"`
+	UserAgent   string     `gorm:"column:user_agent"`
+	IP          string     `gorm:"column:ip"`
+	LastSeenAt  time.Time  `gorm:"column:last_seen_at"`
+	ExpiresAt   time.Time  `gorm:"column:expires_at"`
+	RevokedAt   *time.Time `gorm:"column:revoked_at"`
+}
+
+func (model SessionModel) IsActive() bool {
+	return model.ID != 0 && model.RevokedAt == nil && time.Now().Before(model.ExpiresAt)
+}
+
+// You could start a session for a new login, its FamilyID is used for the refresh tokens.
+//
+//	session, err := StartSession(userModel.ID, c.Request.UserAgent(), c.ClientIP())
+//	refreshToken, err := IssueRefreshToken(userModel.ID, session.FamilyID)
+func StartSession(userID uint, userAgent, ip string) (SessionModel, error) {
+	now := time.Now()
+	session := SessionModel{
+		UserModelID: userID,
+		FamilyID:    common.RandToken(16),
+		UserAgent:   userAgent,
+		IP:          ip,
+		LastSeenAt:  now,
+		ExpiresAt:   now.Add(common.RefreshTokenTTL),
+	}
+	db := common.GetDB()
+	err := db.Create(&session).Error
+	return session, err
+}
+
+// You could find the session a refresh token belongs to, an empty model is returned if there is none.
+func FindSessionByRefreshToken(token string) SessionModel {
+	db := common.GetDB()
+	var refreshTokenModel RefreshTokenModel
+	var session SessionModel
+	if err := db.Where(&RefreshTokenModel{TokenHash: common.HashToken(token)}).First(&refreshTokenModel).Error; err != nil {
+		return session
+	}
+	db.Where(&SessionModel{FamilyID: refreshTokenModel.FamilyID}).First(&session)
+	return session
+}
+
+// A refreshed session lives for another RefreshTokenTTL.
+func (model SessionModel) extend() error {
+	now := time.Now()
+	db := common.GetDB()
+	return db.Model(&model).Updates(map[string]interface{}{
+		"last_seen_at": now,
+		"expires_at":   now.Add(common.RefreshTokenTTL),
+	}).Error
+}
+
+// You could check the `sid` of an access token, tokens without a session are not affected.
+func isSessionActive(sessionID uint) bool {
+	if sessionID == 0 {
+		return true
+	}
+	db := common.GetDB()
+	var session SessionModel
+	db.First(&session, sessionID)
+	return session.IsActive()
+}
+
+func touchSession(sessionID uint) {
+	if sessionID == 0 {
+		return
+	}
+	now := time.Now()
+	db := common.GetDB()
+	db.Model(&SessionModel{}).
+		Where("id = ? AND last_seen_at < ?", sessionID, now.Add(-sessionTouchInterval)).
+		Update("last_seen_at", now)
+}
+
+// The sessions of an user which are neither revoked nor expired, the most recently used first.
+func ListUserSessions(userID uint) ([]SessionModel, error) {
+	db := common.GetDB()
+	var sessions []SessionModel
+	err := db.Where("user_model_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// You could revoke one session of an user, its access and refresh tokens stop working at once.
+//
+//	err := RevokeSession(myUserModel.ID, sessionID)
+func RevokeSession(userID, sessionID uint) error {
+	db := common.GetDB()
+	var session SessionModel
+	db.Where(&SessionModel{UserModelID: userID}).Where("revoked_at IS NULL").First(&session, sessionID)
+	if session.ID == 0 {
+		return ErrSessionNotFound
+	}
+	if err := db.Model(&session).Update("revoked_at", time.Now()).Error; err != nil {
+		return err
+	}
+	return RevokeRefreshTokenFamily(session.FamilyID)
+}
+
+// You could revoke every session of an user but one, exceptID 0 revokes all of them.
+//
+//	count, err := RevokeUserSessions(myUserModel.ID, currentSessionID)
+func RevokeUserSessions(userID, exceptID uint) (int64, error) {
+	db := common.GetDB()
+	var except SessionModel
+	if exceptID != 0 {
+		db.Where(&SessionModel{UserModelID: userID}).First(&except, exceptID)
+	}
+	result := db.Model(&SessionModel{}).
+		Where("user_model_id = ? AND id <> ? AND revoked_at IS NULL", userID, except.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	// Refresh tokens issued before sessions existed have no session row, they go as well.
+	err := db.Model(&RefreshTokenModel{}).
+		Where("user_model_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, except.FamilyID).
+		Update("revoked_at", time.Now()).Error
+	return result.RowsAffected, err
+}
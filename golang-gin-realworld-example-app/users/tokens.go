@@ -0,0 +1,293 @@
+package users
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+var ErrRefreshTokenInvalid = errors.New("Invalid or expired refresh token")
+var ErrRefreshTokenReused = errors.New("Refresh token has already been used")
+var ErrResetTokenInvalid = errors.New("Invalid or expired reset token")
+var ErrVerificationTokenInvalid = errors.New("Invalid or expired verification token")
+
+// A refresh token could be exchanged once for a new pair of tokens.
+//
+// All the refresh tokens descending from one login share the same FamilyID,
+// when a used token shows up again the whole family is revoked because one of them has been stolen.
+//
+// Only the sha256 of the token is saved, look it up by:
+//
+//	db.Where(&RefreshTokenModel{TokenHash: common.HashToken(token)}).First(&model)
+type RefreshTokenModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint       `gorm:"index"`
+	TokenHash   string     `gorm:"column:token_hash;unique_index"`
+	FamilyID    string     `gorm:"column:family_id;index"`
+	ExpiresAt   time.Time  `gorm:"column:expires_at"`
+	UsedAt      *time.Time `gorm:"column:used_at"`
+	RevokedAt   *time.Time `gorm:"column:revoked_at"`
+}
+
+// A single-use token which allows to set a new password without the old one.
+type PasswordResetModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint       `gorm:"index"`
+	TokenHash   string     `gorm:"column:token_hash;unique_index"`
+	ExpiresAt   time.Time  `gorm:"column:expires_at"`
+	UsedAt      *time.Time `gorm:"column:used_at"`
+}
+
+// A single-use token sent to an email address to prove the user owns it.
+//
+// The address is saved as well, a token sent before an email change can't verify the new address.
+type EmailVerificationModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint       `gorm:"index"`
+	Email       string     `gorm:"column:email"`
+	TokenHash   string     `gorm:"column:token_hash;unique_index"`
+	ExpiresAt   time.Time  `gorm:"column:expires_at"`
+	UsedAt      *time.Time `gorm:"column:used_at"`
+}
+
+// Denylist of access tokens by their `jti`, rows could be dropped after ExpiresAt.
+type RevokedTokenModel struct {
+	gorm.Model
+	JTI       string    `gorm:"column:jti;unique_index"`
+	ExpiresAt time.Time `gorm:"column:expires_at"`
+}
+
+// You could issue a refresh token for an user, an empty familyID starts a new family.
+//
+//	refreshToken, err := IssueRefreshToken(userModel.ID, "")
+func IssueRefreshToken(userID uint, familyID string) (string, error) {
+	if familyID == "" {
+		familyID = common.RandToken(16)
+	}
+	token := common.RandToken(32)
+	db := common.GetDB()
+	err := db.Create(&RefreshTokenModel{
+		UserModelID: userID,
+		TokenHash:   common.HashToken(token),
+		FamilyID:    familyID,
+		ExpiresAt:   time.Now().Add(common.RefreshTokenTTL),
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// You could exchange a refresh token for a new one in the same family, the old one can't be used again.
+//
+//	userModel, refreshToken, err := RotateRefreshToken(token)
+func RotateRefreshToken(token string) (UserModel, string, error) {
+	db := common.GetDB()
+	var model RefreshTokenModel
+	var userModel UserModel
+	if err := db.Where(&RefreshTokenModel{TokenHash: common.HashToken(token)}).First(&model).Error; err != nil {
+		return userModel, "", ErrRefreshTokenInvalid
+	}
+	if model.RevokedAt != nil {
+		return userModel, "", ErrRefreshTokenInvalid
+	}
+	if model.UsedAt != nil {
+		RevokeRefreshTokenFamily(model.FamilyID)
+		return userModel, "", ErrRefreshTokenReused
+	}
+	if time.Now().After(model.ExpiresAt) {
+		return userModel, "", ErrRefreshTokenInvalid
+	}
+
+	// Guard on used_at so that two concurrent refreshes could not both win.
+	result := db.Model(&RefreshTokenModel{}).
+		Where("id = ? AND used_at IS NULL", model.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return userModel, "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		RevokeRefreshTokenFamily(model.FamilyID)
+		return userModel, "", ErrRefreshTokenReused
+	}
+
+	if err := db.First(&userModel, model.UserModelID).Error; err != nil {
+		return userModel, "", ErrRefreshTokenInvalid
+	}
+	newToken, err := IssueRefreshToken(model.UserModelID, model.FamilyID)
+	return userModel, newToken, err
+}
+
+// You could revoke every refresh token of the family the token belongs to
+//
+//	err := RevokeRefreshToken(token)
+func RevokeRefreshToken(token string) error {
+	db := common.GetDB()
+	var model RefreshTokenModel
+	if err := db.Where(&RefreshTokenModel{TokenHash: common.HashToken(token)}).First(&model).Error; err != nil {
+		return ErrRefreshTokenInvalid
+	}
+	return RevokeRefreshTokenFamily(model.FamilyID)
+}
+
+func RevokeRefreshTokenFamily(familyID string) error {
+	db := common.GetDB()
+	err := db.Model(&RefreshTokenModel{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+	return err
+}
+
+// You could revoke all the refresh tokens of an user, e.g. after the password has been reset
+func RevokeUserRefreshTokens(userID uint) error {
+	db := common.GetDB()
+	err := db.Model(&RefreshTokenModel{}).
+		Where("user_model_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+	return err
+}
+
+// You could issue a password reset token for an user, only its hash is saved.
+//
+//	resetToken, err := IssuePasswordResetToken(userModel.ID)
+func IssuePasswordResetToken(userID uint) (string, error) {
+	token := common.RandToken(32)
+	db := common.GetDB()
+	err := db.Create(&PasswordResetModel{
+		UserModelID: userID,
+		TokenHash:   common.HashToken(token),
+		ExpiresAt:   time.Now().Add(common.PasswordResetTTL),
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// You could consume a password reset token, it returns the owner and could only succeed once.
+//
+//	userModel, err := ConsumePasswordResetToken(token)
+func ConsumePasswordResetToken(token string) (UserModel, error) {
+	db := common.GetDB()
+	var userModel UserModel
+	model, err := findPasswordResetToken(token)
+	if err != nil {
+		return userModel, err
+	}
+	result := db.Model(&PasswordResetModel{}).
+		Where("id = ? AND used_at IS NULL", model.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 0 {
+		return userModel, ErrResetTokenInvalid
+	}
+	// The other pending tokens of the user are worthless once the password is changed.
+	db.Model(&PasswordResetModel{}).
+		Where("user_model_id = ? AND used_at IS NULL", model.UserModelID).
+		Update("used_at", time.Now())
+	if err := db.First(&userModel, model.UserModelID).Error; err != nil {
+		return userModel, ErrResetTokenInvalid
+	}
+	return userModel, nil
+}
+
+// Same as ConsumePasswordResetToken, but the token is left usable, e.g. to check the new password first.
+//
+//	userModel, err := PeekPasswordResetToken(token)
+func PeekPasswordResetToken(token string) (UserModel, error) {
+	var userModel UserModel
+	model, err := findPasswordResetToken(token)
+	if err != nil {
+		return userModel, err
+	}
+	if err := common.GetDB().First(&userModel, model.UserModelID).Error; err != nil {
+		return userModel, ErrResetTokenInvalid
+	}
+	return userModel, nil
+}
+
+// The unused and unexpired reset token
+func findPasswordResetToken(token string) (PasswordResetModel, error) {
+	var model PasswordResetModel
+	if err := common.GetDB().Where(&PasswordResetModel{TokenHash: common.HashToken(token)}).First(&model).Error; err != nil {
+		return model, ErrResetTokenInvalid
+	}
+	if model.UsedAt != nil || time.Now().After(model.ExpiresAt) {
+		return model, ErrResetTokenInvalid
+	}
+	return model, nil
+}
+
+// You could issue an email verification token for the current email of an user.
+//
+//	verificationToken, err := IssueEmailVerificationToken(userModel)
+func IssueEmailVerificationToken(userModel UserModel) (string, error) {
+	token := common.RandToken(32)
+	db := common.GetDB()
+	err := db.Create(&EmailVerificationModel{
+		UserModelID: userModel.ID,
+		Email:       userModel.Email,
+		TokenHash:   common.HashToken(token),
+		ExpiresAt:   time.Now().Add(common.EmailVerificationTTL),
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// You could mark the email of an user verified with a token, it could only succeed once.
+//
+//	userModel, err := ConsumeEmailVerificationToken(token)
+func ConsumeEmailVerificationToken(token string) (UserModel, error) {
+	db := common.GetDB()
+	var model EmailVerificationModel
+	var userModel UserModel
+	if err := db.Where(&EmailVerificationModel{TokenHash: common.HashToken(token)}).First(&model).Error; err != nil {
+		return userModel, ErrVerificationTokenInvalid
+	}
+	if model.UsedAt != nil || time.Now().After(model.ExpiresAt) {
+		return userModel, ErrVerificationTokenInvalid
+	}
+	if err := db.First(&userModel, model.UserModelID).Error; err != nil || userModel.Email != model.Email {
+		return userModel, ErrVerificationTokenInvalid
+	}
+	now := time.Now()
+	result := db.Model(&EmailVerificationModel{}).
+		Where("id = ? AND used_at IS NULL", model.ID).
+		Update("used_at", now)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return userModel, ErrVerificationTokenInvalid
+	}
+	if err := db.Model(&userModel).Update("verified_at", now).Error; err != nil {
+		return userModel, err
+	}
+	return userModel, nil
+}
+
+// You could revoke an access token by its `jti` until it expires
+//
+//	err := RevokeAccessToken(jti, expiresAt)
+func RevokeAccessToken(jti string, expiresAt time.Time) error {
+	db := common.GetDB()
+	var model RevokedTokenModel
+	err := db.Where(&RevokedTokenModel{JTI: jti}).
+		Attrs(RevokedTokenModel{ExpiresAt: expiresAt}).
+		FirstOrCreate(&model).Error
+	return err
+}
+
+func IsAccessTokenRevoked(jti string) bool {
+	if jti == "" {
+		return false
+	}
+	db := common.GetDB()
+	var model RevokedTokenModel
+	db.Where(&RevokedTokenModel{JTI: jti}).First(&model)
+	return model.ID != 0
+}
@@ -0,0 +1,174 @@
+package users
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"realworld-backend/common"
+)
+
+const TOTPIssuer = "Conduit"
+const RecoveryCodeCount = 10
+
+// Wrong codes accepted for one login challenge before the password has to be entered again
+const MaxTwoFactorAttempts = 5
+
+var ErrTwoFactorCodeInvalid = errors.New("Invalid authentication code")
+var ErrTwoFactorNotEnabled = errors.New("Two-factor authentication is not enabled")
+var ErrTwoFactorAlreadyEnabled = errors.New("Two-factor authentication is already enabled")
+
+// The TOTP authenticator of an user, it only counts once EnabledAt is set by a confirmed code.
+//
+// LastCounter is the time step of the last accepted code, a code could not be used twice. Wrong codes are
+// counted by the login throttle, per challenge and per account.
+type TwoFactorModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint       `gorm:"unique_index"`
+	Secret      string     `gorm:"column:secret"`
+	EnabledAt   *time.Time `gorm:"column:enabled_at"`
+	LastCounter int64      `gorm:"column:last_counter"`
+}
+
+// Single-use codes to log in when the authenticator is lost, only the hash is saved.
+type RecoveryCodeModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint       `gorm:"index"`
+	CodeHash    string     `gorm:"column:code_hash"`
+	UsedAt      *time.Time `gorm:"column:used_at"`
+}
+
+func (model TwoFactorModel) IsEnabled() bool {
+	return model.ID != 0 && model.EnabledAt != nil
+}
+
+// You could get the authenticator of an user, an empty model is returned if there is none.
+func GetTwoFactor(userID uint) TwoFactorModel {
+	db := common.GetDB()
+	var model TwoFactorModel
+	db.Where(&TwoFactorModel{UserModelID: userID}).First(&model)
+	return model
+}
+
+func (u UserModel) IsTwoFactorEnabled() bool {
+	return GetTwoFactor(u.ID).IsEnabled()
+}
+
+// You could start the enrolment of an user, a new secret and new recovery codes replace any pending ones.
+//
+//	secret, recoveryCodes, err := userModel.enrollTwoFactor()
+func (u UserModel) enrollTwoFactor() (string, []string, error) {
+	model := GetTwoFactor(u.ID)
+	if model.IsEnabled() {
+		return "", nil, ErrTwoFactorAlreadyEnabled
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	model.UserModelID = u.ID
+	model.Secret = common.GenerateTOTPSecret()
+	model.LastCounter = 0
+	if err := tx.Save(&model).Error; err != nil {
+		tx.Rollback()
+		return "", nil, err
+	}
+	if err := tx.Unscoped().Where(&RecoveryCodeModel{UserModelID: u.ID}).Delete(RecoveryCodeModel{}).Error; err != nil {
+		tx.Rollback()
+		return "", nil, err
+	}
+	var codes []string
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code := newRecoveryCode()
+		codes = append(codes, code)
+		if err := tx.Create(&RecoveryCodeModel{UserModelID: u.ID, CodeHash: common.HashToken(code)}).Error; err != nil {
+			tx.Rollback()
+			return "", nil, err
+		}
+	}
+	err := tx.Commit().Error
+	return model.Secret, codes, err
+}
+
+// Recovery codes look like "k3j9-x2m4q", easy enough to type from a printed sheet
+func newRecoveryCode() string {
+	code := strings.ToLower(common.GenerateTOTPSecret()[:10])
+	return code[:4] + "-" + code[4:]
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == 10 {
+		code = code[:4] + "-" + code[4:]
+	}
+	return code
+}
+
+// You could finish the enrolment with the first code shown by the authenticator
+func (u UserModel) confirmTwoFactor(code string) error {
+	model := GetTwoFactor(u.ID)
+	if model.ID == 0 {
+		return ErrTwoFactorNotEnabled
+	}
+	if model.IsEnabled() {
+		return ErrTwoFactorAlreadyEnabled
+	}
+	counter, ok := common.ValidateTOTP(model.Secret, code, time.Now())
+	if !ok {
+		return ErrTwoFactorCodeInvalid
+	}
+	db := common.GetDB()
+	return db.Model(&model).Updates(map[string]interface{}{
+		"enabled_at":   time.Now(),
+		"last_counter": counter,
+	}).Error
+}
+
+// You could check a TOTP or a recovery code of an enrolled user, both could only be used once.
+//
+//	if err := userModel.verifyTwoFactorCode("287082"); err != nil { ... }
+func (u UserModel) verifyTwoFactorCode(code string) error {
+	model := GetTwoFactor(u.ID)
+	if !model.IsEnabled() {
+		return ErrTwoFactorNotEnabled
+	}
+	db := common.GetDB()
+	code = strings.TrimSpace(code)
+	if counter, ok := common.ValidateTOTP(model.Secret, code, time.Now()); ok {
+		// The guard on last_counter keeps a code from being replayed, even by concurrent requests.
+		result := db.Model(&TwoFactorModel{}).
+			Where("id = ? AND last_counter < ?", model.ID, counter).
+			Update("last_counter", counter)
+		if result.Error == nil && result.RowsAffected == 1 {
+			return nil
+		}
+	} else if u.useRecoveryCode(code) {
+		return nil
+	}
+	return ErrTwoFactorCodeInvalid
+}
+
+func (u UserModel) useRecoveryCode(code string) bool {
+	db := common.GetDB()
+	result := db.Model(&RecoveryCodeModel{}).
+		Where("user_model_id = ? AND code_hash = ? AND used_at IS NULL", u.ID, common.HashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+func (u UserModel) disableTwoFactor() error {
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Unscoped().Where(&TwoFactorModel{UserModelID: u.ID}).Delete(TwoFactorModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Unscoped().Where(&RecoveryCodeModel{UserModelID: u.ID}).Delete(RecoveryCodeModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
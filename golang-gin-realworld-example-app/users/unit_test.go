@@ -5,14 +5,29 @@ import (
 	"testing"
 
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"image"
+	"image/png"
+	"mime/multipart"
 	"github.com/jinzhu/gorm"
+	"realworld-backend/audit"
 	"realworld-backend/common"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
-	_ "regexp"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 var image_url = "https://golang.org/doc/gopher/frontpage.png"
@@ -96,6 +111,7 @@ func resetDBWithMock() {
 	common.TestDBFree(test_db)
 	test_db = common.TestDBInit()
 	AutoMigrate()
+	audit.AutoMigrate()
 	userModelMocker(3)
 }
 
@@ -125,7 +141,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
 		http.StatusCreated,
-		`{"user":{"username":"wangzitian0","email":"wzt@gg.cn","bio":"","image":null,"token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"wangzitian0","email":"wzt@gg.cn","bio":"","image":null,"token":"([a-zA-Z0-9-_.]{201,})","refreshToken":"([a-zA-Z0-9-_]{43})"}}`,
 		"valid data and should return StatusCreated",
 	},
 	{
@@ -174,7 +190,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"email": "user1@linkedin.com","password": "password123"}}`,
 		http.StatusOK,
-		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{201,})","refreshToken":"([a-zA-Z0-9-_]{43})"}}`,
 		"right info login should return user",
 	},
 	{
@@ -245,7 +261,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{201})"}}`,
 		"request should return current user with token",
 	},
 
@@ -259,7 +275,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false,"blocking":false,"muting":false,"followersCount":0,"followingCount":0}}`,
 		"request should return self profile",
 	},
 	{
@@ -270,7 +286,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false,"blocking":false,"muting":false,"followersCount":0,"followingCount":0}}`,
 		"request should return correct other's profile",
 	},
 
@@ -295,7 +311,7 @@ var unauthRequestTests = []struct {
 		"PUT",
 		`{"user":{"username":"user123","password": "password126","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg"}}`,
 		http.StatusOK,
-		`{"user":{"username":"user123","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"user123","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{201})"}}`,
 		"current user profile should be changed",
 	},
 	{
@@ -306,7 +322,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user123","bio":"bio123","image":"http://hehe/123.jpg","following":false}}`,
+		`{"profile":{"username":"user123","bio":"bio123","image":"http://hehe/123.jpg","following":false,"blocking":false,"muting":false,"followersCount":0,"followingCount":0}}`,
 		"request should return self profile after changed",
 	},
 	{
@@ -315,7 +331,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"email": "user123@linkedin.com","password": "password126"}}`,
 		http.StatusOK,
-		`{"user":{"username":"user123","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"user123","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{201,})","refreshToken":"([a-zA-Z0-9-_]{43})"}}`,
 		"user should login using new password after changed",
 	},
 	{
@@ -339,9 +355,9 @@ var unauthRequestTests = []struct {
 		"/user/",
 		"PUT",
 		`{"password": "password321"}}`,
-		http.StatusUnprocessableEntity,
-		`{"errors":{"Email":"{key: email}","Username":"{key: alphanum}"}}`,
-		"test database pk error for user update",
+		http.StatusUnauthorized,
+		``,
+		"token of a not existing (e.g. deleted) user should be refused",
 	},
 	{
 		func(req *http.Request) {
@@ -350,9 +366,9 @@ var unauthRequestTests = []struct {
 		"/user/",
 		"PUT",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
-		http.StatusUnprocessableEntity,
-		`{"errors":{"database":"UNIQUE constraint failed: user_models.email"}}`,
-		"cheat validator and test database connecting error for user update",
+		http.StatusUnauthorized,
+		``,
+		"token of user id 0 should be refused instead of creating an user on update",
 	},
 	{
 		func(req *http.Request) {
@@ -415,7 +431,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":true}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":true,"blocking":false,"muting":false,"followersCount":1,"followingCount":0}}`,
 		"user follow another should work",
 	},
 	{
@@ -426,7 +442,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":true}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":true,"blocking":false,"muting":false,"followersCount":1,"followingCount":0}}`,
 		"user follow another should make sure database changed",
 	},
 	{
@@ -437,7 +453,7 @@ var unauthRequestTests = []struct {
 		"DELETE",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false,"blocking":false,"muting":false,"followersCount":0,"followingCount":0}}`,
 		"user cancel follow another should work",
 	},
 	{
@@ -448,7 +464,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false,"blocking":false,"muting":false,"followersCount":0,"followingCount":0}}`,
 		"user cancel follow another should make sure database changed",
 	},
 }
@@ -479,11 +495,1205 @@ func TestWithoutAuth(t *testing.T) {
 	}
 }
 
+// A router with the same layout as hello.go for the token lifecycle tests
+func newTestRouter() *gin.Engine {
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	ProfileRegister(r.Group("/profiles"))
+	AdminRegister(r.Group("/admin"))
+	return r
+}
+
+func performJSONRequest(r *gin.Engine, method, url, token, bodyData string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(bodyData))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func loginTokens(t *testing.T, r *gin.Engine, email string) (string, string) {
+	w := performJSONRequest(r, "POST", "/users/login", "", fmt.Sprintf(`{"user":{"email": "%v","password": "password123"}}`, email))
+	var response struct {
+		User UserResponse `json:"user"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK || response.User.RefreshToken == "" {
+		t.Fatalf("login failed: %d %s", w.Code, w.Body.String())
+	}
+	return response.User.Token, response.User.RefreshToken
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+
+	_, refreshToken := loginTokens(t, r, "user1@linkedin.com")
+
+	w := performJSONRequest(r, "POST", "/users/token/refresh", "", fmt.Sprintf(`{"user":{"refreshToken": "%v"}}`, refreshToken))
+	asserts.Equal(http.StatusOK, w.Code, "refresh token should be exchanged")
+	var response struct {
+		User UserResponse `json:"user"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.NotEmpty(response.User.Token, "refresh should return a new access token")
+	asserts.NotEqual(refreshToken, response.User.RefreshToken, "refresh token should be rotated")
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "GET", "/user/", response.User.Token, "").Code, "new access token should work")
+
+	w = performJSONRequest(r, "POST", "/users/token/refresh", "", fmt.Sprintf(`{"user":{"refreshToken": "%v"}}`, refreshToken))
+	asserts.Equal(http.StatusUnauthorized, w.Code, "used refresh token should be rejected")
+	asserts.Equal(`{"errors":{"token":"Refresh token has already been used"}}`, w.Body.String())
+
+	w = performJSONRequest(r, "POST", "/users/token/refresh", "", fmt.Sprintf(`{"user":{"refreshToken": "%v"}}`, response.User.RefreshToken))
+	asserts.Equal(http.StatusUnauthorized, w.Code, "reuse should revoke the whole family")
+
+	w = performJSONRequest(r, "POST", "/users/token/refresh", "", `{"user":{"refreshToken": "not-a-token"}}`)
+	asserts.Equal(http.StatusUnauthorized, w.Code, "unknown refresh token should be rejected")
+	asserts.Equal(`{"errors":{"token":"Invalid or expired refresh token"}}`, w.Body.String())
+
+	_, otherRefreshToken := loginTokens(t, r, "user1@linkedin.com")
+	w = performJSONRequest(r, "POST", "/users/token/refresh", "", fmt.Sprintf(`{"user":{"refreshToken": "%v"}}`, otherRefreshToken))
+	asserts.Equal(http.StatusOK, w.Code, "other login should not be affected by the revoked family")
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+
+	accessToken, refreshToken := loginTokens(t, r, "user2@linkedin.com")
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "GET", "/user/", accessToken, "").Code, "token should work before logout")
+
+	w := performJSONRequest(r, "POST", "/users/logout", "", "")
+	asserts.Equal(http.StatusUnauthorized, w.Code, "logout should require a token")
+
+	w = performJSONRequest(r, "POST", "/users/logout", accessToken, fmt.Sprintf(`{"user":{"refreshToken": "%v"}}`, refreshToken))
+	asserts.Equal(http.StatusOK, w.Code, "logout should work")
+	asserts.Equal(`{"user":"Logout success"}`, w.Body.String())
+
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", accessToken, "").Code, "revoked token should be rejected")
+	w = performJSONRequest(r, "POST", "/users/token/refresh", "", fmt.Sprintf(`{"user":{"refreshToken": "%v"}}`, refreshToken))
+	asserts.Equal(http.StatusUnauthorized, w.Code, "refresh token should be revoked by logout")
+}
+
+func TestAuthMiddlewareKeyring(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := gin.New()
+	WellKnownRegister(r.Group("/.well-known"))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+
+	w := performJSONRequest(r, "GET", "/.well-known/jwks.json", "", "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(`{"keys":[]}`, w.Body.String(), "HMAC secrets should never be published")
+
+	unknown := common.NewKeyring()
+	unknown.Add(common.NewHMACKey("unknown", []byte(common.NBSecretPassword)), true)
+	token, _ := unknown.Sign(jwt.MapClaims{"id": 1})
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", token, "").Code, "unknown kid should be refused")
+
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": 1}).SignedString([]byte(common.NBSecretPassword))
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "GET", "/user/", legacy, "").Code, "token without kid should use the legacy key")
+}
+
+var resetTokenPattern = regexp.MustCompile(`Reset token: ([a-zA-Z0-9-_]+)`)
+
+func TestPasswordResetFlow(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	outbox := &common.MemoryOutbox{}
+	common.SetMailer(outbox)
+	r := newTestRouter()
+
+	w := performJSONRequest(r, "POST", "/users/password/reset", "", `{"user":{"email": "nobody@linkedin.com"}}`)
+	asserts.Equal(http.StatusAccepted, w.Code, "unknown email should look like a success")
+	unknownBody := w.Body.String()
+	asserts.Len(outbox.Messages(), 0, "no email should be sent to an unknown address")
+
+	w = performJSONRequest(r, "POST", "/users/password/reset", "", `{"user":{"email": "user1@linkedin.com"}}`)
+	asserts.Equal(http.StatusAccepted, w.Code)
+	asserts.Equal(unknownBody, w.Body.String(), "response should not reveal whether the email is registered")
+	common.WaitForBackgroundMail()
+	message, ok := outbox.Last("user1@linkedin.com")
+	asserts.True(ok, "reset email should be sent")
+	token := resetTokenPattern.FindStringSubmatch(message.Body)[1]
+
+	var resetModel PasswordResetModel
+	test_db.Where(&PasswordResetModel{TokenHash: common.HashToken(token)}).First(&resetModel)
+	asserts.NotZero(resetModel.ID, "only the hash of the token should be stored")
+
+	w = performJSONRequest(r, "POST", "/users/password/reset/confirm", "", fmt.Sprintf(`{"user":{"token": "%v","password": "short"}}`, token))
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "new password should be validated")
+	w = performJSONRequest(r, "POST", "/users/password/reset/confirm", "", fmt.Sprintf(`{"user":{"token": "%v","password": "user1@linkedin"}}`, token))
+	asserts.Equal(`{"errors":{"Password":"{key: similar}"}}`, w.Body.String(), "new password should not look like the email")
+
+	w = performJSONRequest(r, "POST", "/users/password/reset/confirm", "", fmt.Sprintf(`{"user":{"token": "%v","password": "newpassword123"}}`, token))
+	asserts.Equal(http.StatusOK, w.Code, "reset token should set the new password")
+
+	w = performJSONRequest(r, "POST", "/users/login", "", `{"user":{"email": "user1@linkedin.com","password": "newpassword123"}}`)
+	asserts.Equal(http.StatusOK, w.Code, "user should login with the new password")
+
+	w = performJSONRequest(r, "POST", "/users/password/reset/confirm", "", fmt.Sprintf(`{"user":{"token": "%v","password": "otherpassword123"}}`, token))
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "reset token should be single-use")
+	asserts.Equal(`{"errors":{"token":"Invalid or expired reset token"}}`, w.Body.String())
+
+	performJSONRequest(r, "POST", "/users/password/reset", "", `{"user":{"email": "user2@linkedin.com"}}`)
+	common.WaitForBackgroundMail()
+	message, _ = outbox.Last("user2@linkedin.com")
+	token = resetTokenPattern.FindStringSubmatch(message.Body)[1]
+	test_db.Model(&PasswordResetModel{}).Where("token_hash = ?", common.HashToken(token)).Update("expires_at", time.Now().Add(-time.Minute))
+	w = performJSONRequest(r, "POST", "/users/password/reset/confirm", "", fmt.Sprintf(`{"user":{"token": "%v","password": "newpassword123"}}`, token))
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "expired reset token should be refused")
+
+	// A slow mailer does not hold the response of a registered address
+	slow := &blockingMailer{release: make(chan struct{})}
+	common.SetMailer(slow)
+	defer common.SetMailer(outbox)
+	w = performJSONRequest(r, "POST", "/users/password/reset", "", `{"user":{"email": "user2@linkedin.com"}}`)
+	asserts.Equal(http.StatusAccepted, w.Code, "the response should not wait for the email")
+	close(slow.release)
+	common.WaitForBackgroundMail()
+}
+
+// A mailer which does not send until it is released
+type blockingMailer struct {
+	release chan struct{}
+}
+
+func (m *blockingMailer) Send(msg common.Message) error {
+	<-m.release
+	return nil
+}
+
+func TestPasswordPolicyOnRegistration(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	previous := common.GetPasswordPolicy()
+	defer common.SetPasswordPolicy(previous)
+	common.SetPasswordPolicy(common.PasswordPolicy{
+		common.MinLengthRule{Min: 8},
+		common.CharacterClassesRule{Min: 3},
+		common.SimilarityRule{},
+	})
+
+	register := `{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "%v"}}`
+	w := performJSONRequest(r, "POST", "/users/", "", fmt.Sprintf(register, "Short1!"))
+	asserts.Equal(`{"errors":{"Password":"{min: 8}"}}`, w.Body.String())
+	w = performJSONRequest(r, "POST", "/users/", "", fmt.Sprintf(register, "jakejxke"))
+	asserts.Equal(`{"errors":{"Password":"{classes: 3}"}}`, w.Body.String())
+	w = performJSONRequest(r, "POST", "/users/", "", fmt.Sprintf(register, "Wangzitian0!"))
+	asserts.Equal(`{"errors":{"Password":"{key: similar}"}}`, w.Body.String())
+	w = performJSONRequest(r, "POST", "/users/", "", fmt.Sprintf(register, "Jake-jxke-9"))
+	asserts.Equal(http.StatusCreated, w.Code)
+
+	token := common.GenToken(1)
+	w = performJSONRequest(r, "PUT", "/user/", token, `{"user":{"bio": "a new bio"}}`)
+	asserts.Equal(http.StatusOK, w.Code, "the policy should only apply when the password is changed")
+	w = performJSONRequest(r, "PUT", "/user/", token, `{"user":{"password": "user1-user1"}}`)
+	asserts.Equal(`{"errors":{"Password":"{key: similar}"}}`, w.Body.String())
+}
+
+// A hasher which refuses every password
+type failingHasher struct {
+	common.PasswordHasher
+}
+
+func (failingHasher) Hash(password string) (string, error) {
+	return "", errors.New("hasher is down")
+}
+
+func TestPasswordHashFailure(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	previous := common.GetPasswordHasher()
+	defer common.SetPasswordHasher(previous)
+	common.SetPasswordHasher(failingHasher{previous})
+
+	w := performJSONRequest(r, "POST", "/users/", "", `{"user":{"username": "hashless","email": "hashless@linkedin.com","password": "a-long-passphrase"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"password":"hasher is down"}}`, w.Body.String())
+	w = performJSONRequest(r, "PUT", "/user/", common.GenToken(1), `{"user":{"password": "a-long-passphrase"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"password":"hasher is down"}}`, w.Body.String())
+}
+
+func TestPasswordRehashOnLogin(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	previous := common.GetPasswordHasher()
+	defer common.SetPasswordHasher(previous)
+	common.SetPasswordHasher(common.Argon2idHasher{Memory: 1024, Time: 1, Threads: 1, KeyLength: 32, SaltLength: 16})
+
+	user1, _ := FindOneUser(&UserModel{ID: 1})
+	oldHash := user1.PasswordHash
+	w := performJSONRequest(r, "POST", "/users/login", "", `{"user":{"email": "user1@linkedin.com","password": "wrongpassword"}}`)
+	asserts.Equal(http.StatusForbidden, w.Code)
+	user1, _ = FindOneUser(&UserModel{ID: 1})
+	asserts.Equal(oldHash, user1.PasswordHash, "a failed login should not touch the hash")
+
+	w = performJSONRequest(r, "POST", "/users/login", "", `{"user":{"email": "user1@linkedin.com","password": "password123"}}`)
+	asserts.Equal(http.StatusOK, w.Code)
+	user1, _ = FindOneUser(&UserModel{ID: 1})
+	asserts.True(strings.HasPrefix(user1.PasswordHash, "$argon2id$"), "the bcrypt hash should be upgraded at login")
+
+	w = performJSONRequest(r, "POST", "/users/login", "", `{"user":{"email": "user1@linkedin.com","password": "password123"}}`)
+	asserts.Equal(http.StatusOK, w.Code, "the upgraded hash should verify")
+	upgraded, _ := FindOneUser(&UserModel{ID: 1})
+	asserts.Equal(user1.PasswordHash, upgraded.PasswordHash, "an up to date hash should be kept")
+}
+
+func TestAuditLog(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := gin.New()
+	r.Use(audit.RequestIDMiddleware())
+	UsersRegister(r.Group("/users"))
+	r.Use(AuthMiddleware(true))
+	ProfileRegister(r.Group("/profiles"))
+	AdminRegister(r.Group("/admin"))
+
+	w := performJSONRequest(r, "POST", "/users/login", "", `{"user":{"email": "user1@linkedin.com","password": "wrongpassword"}}`)
+	failedRequestID := w.Header().Get(audit.RequestIDHeader)
+	asserts.NotEmpty(failedRequestID, "every response should carry a request id")
+	performJSONRequest(r, "POST", "/users/login", "", `{"user":{"email": "nobody@linkedin.com","password": "wrongpassword"}}`)
+	performJSONRequest(r, "POST", "/users/login", "", `{"user":{"email": "user1@linkedin.com","password": "password123"}}`)
+	performJSONRequest(r, "POST", "/profiles/user2/follow", common.GenToken(1), "")
+	performJSONRequest(r, "DELETE", "/profiles/user2/follow", common.GenToken(1), "")
+
+	w = performJSONRequest(r, "GET", "/admin/audit", common.GenToken(1), "")
+	asserts.Equal(`{"errors":{"permission":"Missing permission audit:read"}}`, w.Body.String())
+	asserts.NoError(GrantRole(3, RoleAdmin))
+	admin := common.GenToken(3)
+
+	var response struct {
+		Events      []audit.EventResponse `json:"events"`
+		EventsCount int                   `json:"eventsCount"`
+	}
+	w = performJSONRequest(r, "GET", "/admin/audit?action=user.login_failed", admin, "")
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(2, response.EventsCount)
+	asserts.Equal("", response.Events[0].TargetID, "an unknown email has no target")
+	asserts.Equal(`{"email":"nobody@linkedin.com","reason":"password"}`, string(response.Events[0].Details))
+	asserts.Equal("1", response.Events[1].TargetID)
+	asserts.Equal(failedRequestID, response.Events[1].RequestID)
+	asserts.Equal(uint(0), response.Events[1].ActorID)
+
+	w = performJSONRequest(r, "GET", "/admin/audit?actor=1&limit=2", admin, "")
+	response.Events = nil
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Equal(3, response.EventsCount, "login, follow and unfollow of user1")
+	asserts.Len(response.Events, 2)
+	asserts.Equal(audit.ActionProfileUnfollow, response.Events[0].Action, "the latest event should come first")
+	asserts.Equal(audit.ActionProfileFollow, response.Events[1].Action)
+	asserts.Equal("2", response.Events[1].TargetID)
+
+	w = performJSONRequest(r, "GET", "/admin/audit?actor=jake", admin, "")
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+
+	w = performJSONRequest(r, "GET", "/admin/audit/export?targetType=user&targetId=2", admin, "")
+	asserts.Equal("application/x-ndjson", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	asserts.Len(lines, 2)
+	var first audit.EventResponse
+	asserts.NoError(json.Unmarshal([]byte(lines[0]), &first))
+	asserts.Equal(audit.ActionProfileFollow, first.Action, "the export should be oldest first")
+}
+
+var verificationTokenPattern = regexp.MustCompile(`Verification token: ([a-zA-Z0-9-_]+)`)
+
+func TestEmailVerificationFlow(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	outbox := &common.MemoryOutbox{}
+	common.SetMailer(outbox)
+	r := newTestRouter()
+
+	w := performJSONRequest(r, "POST", "/users/", "", `{"user":{"username": "verifyme","email": "verifyme@linkedin.com","password": "password123"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	userModel, _ := FindOneUser(&UserModel{Email: "verifyme@linkedin.com"})
+	asserts.False(userModel.IsVerified(), "new user should not be verified")
+	message, ok := outbox.Last("verifyme@linkedin.com")
+	asserts.True(ok, "verification email should be sent on registration")
+	token := verificationTokenPattern.FindStringSubmatch(message.Body)[1]
+
+	w = performJSONRequest(r, "POST", "/users/verify", "", `{"user":{"token": "wrong"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "unknown token should be refused")
+	asserts.Equal(`{"errors":{"token":"Invalid or expired verification token"}}`, w.Body.String())
+
+	w = performJSONRequest(r, "POST", "/users/verify", "", fmt.Sprintf(`{"user":{"token": "%v"}}`, token))
+	asserts.Equal(http.StatusOK, w.Code, "verification token should verify the email")
+	userModel, _ = FindOneUser(&UserModel{Email: "verifyme@linkedin.com"})
+	asserts.True(userModel.IsVerified(), "user should be verified")
+
+	w = performJSONRequest(r, "POST", "/users/verify", "", fmt.Sprintf(`{"user":{"token": "%v"}}`, token))
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "verification token should be single-use")
+
+	accessToken := common.GenToken(userModel.ID)
+	w = performJSONRequest(r, "POST", "/user/verify/resend", accessToken, "")
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "verified user should not get another email")
+
+	w = performJSONRequest(r, "PUT", "/user/", accessToken, `{"user":{"email": "verifyme2@linkedin.com"}}`)
+	asserts.Equal(http.StatusOK, w.Code)
+	userModel, _ = FindOneUser(&UserModel{ID: userModel.ID})
+	asserts.False(userModel.IsVerified(), "changed email should be verified again")
+	_, ok = outbox.Last("verifyme2@linkedin.com")
+	asserts.True(ok, "verification email should be sent to the new address")
+
+	w = performJSONRequest(r, "POST", "/user/verify/resend", accessToken, "")
+	asserts.Equal(http.StatusAccepted, w.Code, "unverified user could ask for another email")
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := gin.New()
+	r.Use(AuthMiddleware(true))
+	r.POST("/write", RequireVerifiedEmail(), func(c *gin.Context) {
+		c.JSON(http.StatusCreated, gin.H{"status": "written"})
+	})
+	defer func() { common.RequireVerifiedEmail = false }()
+
+	common.RequireVerifiedEmail = false
+	asserts.Equal(http.StatusCreated, performJSONRequest(r, "POST", "/write", common.GenToken(1), "").Code, "switch off should let everyone write")
+
+	common.RequireVerifiedEmail = true
+	w := performJSONRequest(r, "POST", "/write", common.GenToken(1), "")
+	asserts.Equal(http.StatusForbidden, w.Code, "unverified user should be refused")
+	asserts.Equal(`{"errors":{"email_unverified":"Verify your email address before writing content"}}`, w.Body.String())
+
+	test_db.Model(&UserModel{}).Where("id = ?", 1).Update("verified_at", time.Now())
+	asserts.Equal(http.StatusCreated, performJSONRequest(r, "POST", "/write", common.GenToken(1), "").Code, "verified user should write")
+}
+
+func mfaChallenge(t *testing.T, r *gin.Engine, email string) string {
+	w := performJSONRequest(r, "POST", "/users/login", "", fmt.Sprintf(`{"user":{"email": "%v","password": "password123"}}`, email))
+	var response struct {
+		MFA MFAChallengeResponse `json:"mfa"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusAccepted || response.MFA.Challenge == "" {
+		t.Fatalf("login should ask for a second factor: %d %s", w.Code, w.Body.String())
+	}
+	return response.MFA.Challenge
+}
+
+func TestTwoFactorFlow(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	accessToken := common.GenToken(3)
+
+	w := performJSONRequest(r, "POST", "/user/2fa", accessToken, "")
+	asserts.Equal(http.StatusCreated, w.Code, "enrolment should start")
+	var enrollment struct {
+		TwoFactor TwoFactorEnrollmentResponse `json:"twoFactor"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	asserts.Len(enrollment.TwoFactor.RecoveryCodes, RecoveryCodeCount)
+	asserts.Contains(enrollment.TwoFactor.OTPAuthURI, "otpauth://totp/Conduit:user3@linkedin.com?")
+	secret := enrollment.TwoFactor.Secret
+
+	loginTokens(t, r, "user3@linkedin.com")
+
+	w = performJSONRequest(r, "POST", "/user/2fa/confirm", accessToken, `{"twoFactor":{"code": "000000"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "wrong code should not enable two-factor")
+	code, _ := common.TOTPCode(secret, time.Now())
+	w = performJSONRequest(r, "POST", "/user/2fa/confirm", accessToken, fmt.Sprintf(`{"twoFactor":{"code": "%v"}}`, code))
+	asserts.Equal(http.StatusOK, w.Code, "current code should enable two-factor")
+	asserts.Equal(http.StatusUnprocessableEntity, performJSONRequest(r, "POST", "/user/2fa", accessToken, "").Code, "enabled two-factor should not be enrolled again")
+
+	challenge := mfaChallenge(t, r, "user3@linkedin.com")
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", challenge, "").Code, "challenge should not be an access token")
+
+	w = performJSONRequest(r, "POST", "/users/login/mfa", "", fmt.Sprintf(`{"mfa":{"challenge": "%v","code": "%v"}}`, challenge, code))
+	asserts.Equal(http.StatusUnauthorized, w.Code, "code should not be replayed")
+	nextCode, _ := common.TOTPCode(secret, time.Now().Add(common.TOTPPeriod*time.Second))
+	w = performJSONRequest(r, "POST", "/users/login/mfa", "", fmt.Sprintf(`{"mfa":{"challenge": "%v","code": "%v"}}`, challenge, nextCode))
+	asserts.Equal(http.StatusOK, w.Code, "valid code should finish the login")
+	asserts.Regexp(`"refreshToken":"[a-zA-Z0-9-_]{43}"`, w.Body.String())
+	w = performJSONRequest(r, "POST", "/users/login/mfa", "", fmt.Sprintf(`{"mfa":{"challenge": "%v","code": "%v"}}`, challenge, enrollment.TwoFactor.RecoveryCodes[0]))
+	asserts.Equal(http.StatusUnauthorized, w.Code, "challenge should be single-use")
+
+	challenge = mfaChallenge(t, r, "user3@linkedin.com")
+	w = performJSONRequest(r, "POST", "/users/login/mfa", "", fmt.Sprintf(`{"mfa":{"challenge": "%v","code": "%v"}}`, challenge, enrollment.TwoFactor.RecoveryCodes[0]))
+	asserts.Equal(http.StatusOK, w.Code, "recovery code should finish the login")
+	challenge = mfaChallenge(t, r, "user3@linkedin.com")
+	w = performJSONRequest(r, "POST", "/users/login/mfa", "", fmt.Sprintf(`{"mfa":{"challenge": "%v","code": "%v"}}`, challenge, enrollment.TwoFactor.RecoveryCodes[0]))
+	asserts.Equal(http.StatusUnauthorized, w.Code, "recovery code should be single-use")
+
+	// One wrong code was already sent since the last login, the account locks with the last one of the challenge
+	defer func(account int) { common.LoginMaxAccountFailures = account }(common.LoginMaxAccountFailures)
+	common.LoginMaxAccountFailures = MaxTwoFactorAttempts + 1
+	challenge = mfaChallenge(t, r, "user3@linkedin.com")
+	for i := 0; i < MaxTwoFactorAttempts; i++ {
+		performJSONRequest(r, "POST", "/users/login/mfa", "", fmt.Sprintf(`{"mfa":{"challenge": "%v","code": "000000"}}`, challenge))
+	}
+	w = performJSONRequest(r, "POST", "/users/login/mfa", "", fmt.Sprintf(`{"mfa":{"challenge": "%v","code": "%v"}}`, challenge, enrollment.TwoFactor.RecoveryCodes[1]))
+	asserts.Equal(http.StatusUnauthorized, w.Code, "too many wrong codes should void the challenge")
+	asserts.Equal(`{"errors":{"mfa":"Too many invalid codes, log in again"}}`, w.Body.String())
+	w = performJSONRequest(r, "POST", "/users/login", "", `{"user":{"email": "user3@linkedin.com","password": "password123"}}`)
+	asserts.Equal(http.StatusTooManyRequests, w.Code, "wrong codes should lock the account like wrong passwords")
+	UnlockAccount("user3@linkedin.com")
+
+	w = performJSONRequest(r, "DELETE", "/user/2fa", accessToken, fmt.Sprintf(`{"twoFactor":{"password": "wrong","code": "%v"}}`, enrollment.TwoFactor.RecoveryCodes[1]))
+	asserts.Equal(http.StatusForbidden, w.Code, "disabling should need the password")
+	w = performJSONRequest(r, "DELETE", "/user/2fa", accessToken, fmt.Sprintf(`{"twoFactor":{"password": "password123","code": "%v"}}`, enrollment.TwoFactor.RecoveryCodes[1]))
+	asserts.Equal(http.StatusOK, w.Code, "password and code should disable two-factor")
+	loginTokens(t, r, "user3@linkedin.com")
+}
+
+func loginFrom(r *gin.Engine, ip, email, password string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/users/login", bytes.NewBufferString(fmt.Sprintf(`{"user":{"email": "%v","password": "%v"}}`, email, password)))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestLockoutDuration(t *testing.T) {
+	asserts := assert.New(t)
+	asserts.Equal(time.Duration(0), lockoutDuration(2, 3), "no lockout under the threshold")
+	asserts.Equal(common.LoginLockoutBase, lockoutDuration(3, 3))
+	asserts.Equal(2*common.LoginLockoutBase, lockoutDuration(4, 3), "every failure should double the lockout")
+	asserts.Equal(4*common.LoginLockoutBase, lockoutDuration(5, 3))
+	asserts.Equal(common.LoginLockoutMax, lockoutDuration(100, 3), "lockout should be capped")
+}
+
+func TestLockoutBackoffOutlivesFailureWindow(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	key := accountThrottleKey("backoff@linkedin.com")
+	for i := 0; i < 3; i++ {
+		asserts.NoError(recordLoginFailure(key, 3))
+	}
+	// A lockout longer than the window has just ended
+	lastFailureAt := time.Now().Add(-2 * common.LoginFailureWindow)
+	lockedUntil := time.Now().Add(-time.Second)
+	test_db.Model(&LoginThrottleModel{}).Where("throttle_key = ?", key).
+		Updates(map[string]interface{}{"last_failure_at": lastFailureAt, "locked_until": lockedUntil})
+	asserts.NoError(recordLoginFailure(key, 3))
+
+	var model LoginThrottleModel
+	test_db.Where("throttle_key = ?", key).First(&model)
+	asserts.Equal(4, model.Failures, "the failures should be kept after a lockout")
+	asserts.InDelta(float64(2*common.LoginLockoutBase), float64(time.Until(*model.LockedUntil)), float64(time.Second), "the lockout should keep doubling")
+
+	test_db.Model(&LoginThrottleModel{}).Where("throttle_key = ?", key).
+		Updates(map[string]interface{}{"last_failure_at": lastFailureAt, "locked_until": lastFailureAt})
+	asserts.NoError(recordLoginFailure(key, 3))
+	test_db.Where("throttle_key = ?", key).First(&model)
+	asserts.Equal(1, model.Failures, "the failures should be forgotten a window after the lockout")
+}
+
+func TestLoginLockout(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	defer func(account, ip int) {
+		common.LoginMaxAccountFailures, common.LoginMaxIPFailures = account, ip
+	}(common.LoginMaxAccountFailures, common.LoginMaxIPFailures)
+	common.LoginMaxAccountFailures = 3
+	common.LoginMaxIPFailures = 5
+
+	for i := 0; i < 3; i++ {
+		w := loginFrom(r, fmt.Sprintf("198.51.100.%d", i), "user1@linkedin.com", "wrongpassword")
+		asserts.Equal(http.StatusForbidden, w.Code, "wrong password should be refused")
+	}
+	w := loginFrom(r, "198.51.100.10", "USER1@linkedin.com", "password123")
+	asserts.Equal(http.StatusTooManyRequests, w.Code, "locked account should be refused even with the right password")
+	asserts.Equal(fmt.Sprint(int(common.LoginLockoutBase.Seconds())), w.Header().Get("Retry-After"))
+	asserts.Equal(`{"errors":{"login":"Too many failed login attempts, try again later"}}`, w.Body.String())
+
+	asserts.NoError(UnlockAccount("user1@linkedin.com"))
+	asserts.Equal(http.StatusOK, loginFrom(r, "198.51.100.10", "user1@linkedin.com", "password123").Code, "unlocked account should login")
+
+	for i := 0; i < 5; i++ {
+		loginFrom(r, "203.0.113.7", fmt.Sprintf("nobody%d@linkedin.com", i), "password123")
+	}
+	asserts.Equal(http.StatusTooManyRequests, loginFrom(r, "203.0.113.7", "user2@linkedin.com", "password123").Code, "locked IP should be refused")
+	asserts.Equal(http.StatusOK, loginFrom(r, "203.0.113.8", "user2@linkedin.com", "password123").Code, "other IPs should not be affected")
+	r.SetTrustedProxies(nil)
+	req, _ := http.NewRequest("POST", "/users/login", bytes.NewBufferString(`{"user":{"email": "user2@linkedin.com","password": "password123"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.RemoteAddr = "203.0.113.7:40000"
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusTooManyRequests, w.Code, "a forged X-Forwarded-For should not get around the lockout")
+	asserts.NoError(UnlockIP("203.0.113.7"))
+	asserts.Equal(http.StatusOK, loginFrom(r, "203.0.113.7", "user2@linkedin.com", "password123").Code, "unlocked IP should login")
+
+	for i := 0; i < 3; i++ {
+		loginFrom(r, "198.51.100.20", "user1@linkedin.com", "wrongpassword")
+	}
+	w = performJSONRequest(r, "POST", "/admin/users/user1/unlock", common.GenToken(3), "")
+	asserts.Equal(http.StatusForbidden, w.Code, "only admins should unlock accounts")
+	GrantRole(3, RoleAdmin)
+	w = performJSONRequest(r, "POST", "/admin/users/user1/unlock", common.GenToken(3), "")
+	asserts.Equal(http.StatusOK, w.Code, "admin should unlock accounts")
+	asserts.Equal(http.StatusOK, loginFrom(r, "198.51.100.21", "user1@linkedin.com", "password123").Code)
+	_, count, _ := audit.FindEvents(audit.Filter{Action: audit.ActionUserUnlock, ActorID: 3, TargetID: "1"}, 20, 0)
+	asserts.Equal(1, count, "unlocks should be audited")
+}
+
+func TestLoginWithoutSigningKey(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	active, err := common.Keys.Active()
+	asserts.NoError(err)
+	common.Keys.Remove(active.ID)
+	defer common.Keys.Add(active, true)
+
+	w := loginFrom(r, "198.51.100.30", "user1@linkedin.com", "password123")
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"token":"keyring has no active signing key"}}`, w.Body.String())
+	sessions, _ := ListUserSessions(1)
+	asserts.Len(sessions, 0, "the session of a failed login should be revoked")
+}
+
+func loginWithUserAgent(t *testing.T, r *gin.Engine, email, userAgent string) (string, string) {
+	req, _ := http.NewRequest("POST", "/users/login", bytes.NewBufferString(fmt.Sprintf(`{"user":{"email": "%v","password": "password123"}}`, email)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var response struct {
+		User UserResponse `json:"user"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login failed: %d %s", w.Code, w.Body.String())
+	}
+	return response.User.Token, response.User.RefreshToken
+}
+
+func listSessions(r *gin.Engine, token string) []SessionResponse {
+	w := performJSONRequest(r, "GET", "/user/sessions", token, "")
+	var response struct {
+		Sessions []SessionResponse `json:"sessions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response.Sessions
+}
+
+func TestSessions(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+
+	laptopToken, laptopRefresh := loginWithUserAgent(t, r, "user1@linkedin.com", "laptop")
+	phoneToken, phoneRefresh := loginWithUserAgent(t, r, "user1@linkedin.com", "phone")
+
+	sessions := listSessions(r, laptopToken)
+	asserts.Len(sessions, 2, "every login should be a session")
+	var phoneSession SessionResponse
+	for _, session := range sessions {
+		asserts.Equal(session.UserAgent == "laptop", session.Current, "only the session of the request should be current")
+		if session.UserAgent == "phone" {
+			phoneSession = session
+		}
+	}
+	asserts.NotZero(phoneSession.ID)
+
+	w := performJSONRequest(r, "DELETE", fmt.Sprintf("/user/sessions/%d", phoneSession.ID), common.GenToken(2), "")
+	asserts.Equal(http.StatusNotFound, w.Code, "sessions of other users could not be revoked")
+	w = performJSONRequest(r, "DELETE", fmt.Sprintf("/user/sessions/%d", phoneSession.ID), laptopToken, "")
+	asserts.Equal(http.StatusOK, w.Code, "own session should be revoked")
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", phoneToken, "").Code, "access token of a revoked session should be refused")
+	w = performJSONRequest(r, "POST", "/users/token/refresh", "", fmt.Sprintf(`{"user":{"refreshToken": "%v"}}`, phoneRefresh))
+	asserts.Equal(http.StatusUnauthorized, w.Code, "refresh token of a revoked session should be refused")
+
+	w = performJSONRequest(r, "POST", "/users/token/refresh", "", fmt.Sprintf(`{"user":{"refreshToken": "%v"}}`, laptopRefresh))
+	asserts.Equal(http.StatusOK, w.Code)
+	var refreshed struct {
+		User UserResponse `json:"user"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &refreshed)
+	laptopToken = refreshed.User.Token
+	sessions = listSessions(r, laptopToken)
+	asserts.Len(sessions, 1, "refresh should keep the same session")
+	asserts.True(sessions[0].Current)
+
+	tabletToken, _ := loginWithUserAgent(t, r, "user1@linkedin.com", "tablet")
+	w = performJSONRequest(r, "PUT", "/user/", laptopToken, `{"user":{"password": "newpassword123"}}`)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", tabletToken, "").Code, "password change should revoke the other sessions")
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "GET", "/user/", laptopToken, "").Code, "password change should keep the current session")
+
+	w = performJSONRequest(r, "PUT", "/user/", laptopToken, `{"user":{"bio": "no password change"}}`)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Len(listSessions(r, laptopToken), 1)
+
+	w = performJSONRequest(r, "DELETE", "/user/sessions", laptopToken, "")
+	asserts.Equal(http.StatusOK, w.Code, "all sessions should be revoked")
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", laptopToken, "").Code, "log out everywhere should include the current session")
+}
+
+// An in-process OpenID Connect provider, it signs the ID tokens with its own keyring and checks PKCE.
+type mockOIDCProvider struct {
+	server *httptest.Server
+	keys   *common.Keyring
+	mu     sync.Mutex
+	grants map[string]mockOIDCGrant
+}
+
+type mockOIDCGrant struct {
+	challenge string
+	nonce     string
+	claims    OIDCClaims
+}
+
+const mockOIDCClientID = "conduit-test"
+const mockOIDCClientSecret = "conduit-test-secret"
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := &mockOIDCProvider{keys: common.NewKeyring(), grants: map[string]mockOIDCGrant{}}
+	mock.keys.Add(&common.SigningKey{ID: "mock", Method: jwt.SigningMethodRS256, Private: private, Public: &private.PublicKey}, true)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                mock.server.URL,
+			"authorization_endpoint":                mock.server.URL + "/authorize",
+			"token_endpoint":                        mock.server.URL + "/token",
+			"jwks_uri":                              mock.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(mock.keys.JWKS())
+	})
+	mux.HandleFunc("/token", mock.token)
+	mock.server = httptest.NewServer(mux)
+	t.Cleanup(mock.server.Close)
+	return mock
+}
+
+// What the browser does at the provider: the user logs in as claims and is sent back with a code.
+func (mock *mockOIDCProvider) authorize(t *testing.T, authorizationURL string, claims OIDCClaims) (string, string) {
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil || !strings.HasPrefix(authorizationURL, mock.server.URL+"/authorize") {
+		t.Fatalf("unexpected authorization url %v", authorizationURL)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != mockOIDCClientID || query.Get("code_challenge_method") != "S256" || query.Get("nonce") == "" {
+		t.Fatalf("authorization request should use PKCE and a nonce: %v", authorizationURL)
+	}
+	code := common.RandToken(16)
+	mock.mu.Lock()
+	mock.grants[code] = mockOIDCGrant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: claims}
+	mock.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (mock *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	mock.mu.Lock()
+	grant, found := mock.grants[r.PostForm.Get("code")]
+	delete(mock.grants, r.PostForm.Get("code"))
+	mock.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if clientID != mockOIDCClientID || clientSecret != mockOIDCClientSecret || !found ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	now := time.Now()
+	idToken, _ := mock.keys.Sign(jwt.MapClaims{
+		"iss":                mock.server.URL,
+		"sub":                grant.claims.Subject,
+		"aud":                mockOIDCClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Minute).Unix(),
+		"nonce":              grant.nonce,
+		"email":              grant.claims.Email,
+		"email_verified":     grant.claims.EmailVerified,
+		"preferred_username": grant.claims.PreferredUsername,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func oidcAuthorizationURL(t *testing.T, r *gin.Engine, url, token string) string {
+	w := performJSONRequest(r, "GET", url, token, "")
+	if token != "" {
+		w = performJSONRequest(r, "POST", url, token, "")
+	}
+	var response struct {
+		OIDC struct {
+			AuthorizationURL string `json:"authorizationUrl"`
+		} `json:"oidc"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK {
+		t.Fatalf("authorization should start: %d %s", w.Code, w.Body.String())
+	}
+	return response.OIDC.AuthorizationURL
+}
+
+// The callback from the browser which started the flow, its cookie holds the state
+func oidcCallback(r *gin.Engine, code, state string) *httptest.ResponseRecorder {
+	return oidcCallbackWithCookie(r, code, state, state)
+}
+
+func oidcCallbackWithCookie(r *gin.Engine, code, state, cookie string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/users/oidc/mock/callback", bytes.NewBufferString(fmt.Sprintf(`{"oidc":{"code": "%v","state": "%v"}}`, code, state)))
+	req.Header.Set("Content-Type", "application/json")
+	if cookie != "" {
+		req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: cookie})
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	mock := newMockOIDCProvider(t)
+	RegisterOIDCProvider(OIDCProviderConfig{
+		Name:         "mock",
+		Issuer:       mock.server.URL,
+		ClientID:     mockOIDCClientID,
+		ClientSecret: mockOIDCClientSecret,
+		RedirectURL:  "http://localhost:4100/oidc/mock",
+	})
+
+	asserts.Equal(http.StatusNotFound, performJSONRequest(r, "GET", "/users/oidc/unknown", "", "").Code, "unknown provider should be refused")
+
+	// The state is bound to the browser which started the flow
+	w := performJSONRequest(r, "GET", "/users/oidc/mock", "", "")
+	cookies := w.Result().Cookies()
+	asserts.Len(cookies, 1)
+	asserts.Equal(oidcStateCookie, cookies[0].Name)
+	asserts.True(cookies[0].HttpOnly)
+	asserts.Regexp("state="+cookies[0].Value+`(\\u0026|")`, w.Body.String(), "the cookie should hold the state of the authorization URL")
+	attacker := OIDCClaims{Subject: "sub-attacker", Email: "attacker@example.com", EmailVerified: true}
+	code, state := mock.authorize(t, oidcAuthorizationURL(t, r, "/users/oidc/mock", ""), attacker)
+	asserts.Equal(http.StatusUnauthorized, oidcCallbackWithCookie(r, code, state, "").Code, "a state without its cookie should be refused")
+	asserts.Equal(http.StatusUnauthorized, oidcCallbackWithCookie(r, code, state, cookies[0].Value).Code, "a state from another browser should be refused")
+
+	newcomer := OIDCClaims{Subject: "sub-newcomer", Email: "newcomer@example.com", EmailVerified: true, PreferredUsername: "new.comer"}
+	code, state = mock.authorize(t, oidcAuthorizationURL(t, r, "/users/oidc/mock", ""), newcomer)
+	w = oidcCallback(r, code, state)
+	asserts.Equal(http.StatusOK, w.Code, "new identity should create an user")
+	asserts.Regexp(`"username":"newcomer","email":"newcomer@example.com"`, w.Body.String())
+	userModel, _ := FindOneUser(&UserModel{Email: "newcomer@example.com"})
+	asserts.True(userModel.IsVerified(), "email verified by the provider should be verified")
+	asserts.Equal(http.StatusUnauthorized, oidcCallback(r, code, state).Code, "state should be single-use")
+
+	code, state = mock.authorize(t, oidcAuthorizationURL(t, r, "/users/oidc/mock", ""), newcomer)
+	w = oidcCallback(r, code, state)
+	asserts.Equal(http.StatusOK, w.Code, "known identity should log in")
+	var count int
+	test_db.Model(&UserModel{}).Where("email = ?", "newcomer@example.com").Count(&count)
+	asserts.Equal(1, count, "known identity should not create another user")
+
+	code, state = mock.authorize(t, oidcAuthorizationURL(t, r, "/users/oidc/mock", ""), newcomer)
+	test_db.Model(&OIDCStateModel{}).Where("state_hash = ?", common.HashToken(state)).Update("code_verifier", "tampered")
+	asserts.Equal(http.StatusUnauthorized, oidcCallback(r, code, state).Code, "wrong PKCE verifier should be refused by the provider")
+
+	existing := OIDCClaims{Subject: "sub-user1", Email: "user1@linkedin.com", EmailVerified: true}
+	code, state = mock.authorize(t, oidcAuthorizationURL(t, r, "/users/oidc/mock", ""), existing)
+	w = oidcCallback(r, code, state)
+	asserts.Equal(http.StatusConflict, w.Code, "unverified local account should not be taken over")
+	test_db.Model(&UserModel{}).Where("email = ?", "user1@linkedin.com").Update("verified_at", time.Now())
+	code, state = mock.authorize(t, oidcAuthorizationURL(t, r, "/users/oidc/mock", ""), existing)
+	w = oidcCallback(r, code, state)
+	asserts.Equal(http.StatusOK, w.Code, "verified email should link the existing user")
+	asserts.Regexp(`"username":"user1"`, w.Body.String())
+
+	unverified := OIDCClaims{Subject: "sub-unverified", Email: "user2@linkedin.com", EmailVerified: false}
+	code, state = mock.authorize(t, oidcAuthorizationURL(t, r, "/users/oidc/mock", ""), unverified)
+	asserts.Equal(http.StatusForbidden, oidcCallback(r, code, state).Code, "unverified email at the provider should not log in")
+}
+
+func TestOIDCLinkIdentity(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	mock := newMockOIDCProvider(t)
+	RegisterOIDCProvider(OIDCProviderConfig{Name: "mock", Issuer: mock.server.URL, ClientID: mockOIDCClientID, ClientSecret: mockOIDCClientSecret})
+	accessToken := common.GenToken(2)
+
+	claims := OIDCClaims{Subject: "sub-work", Email: "someone@work.example", EmailVerified: false}
+	code, state := mock.authorize(t, oidcAuthorizationURL(t, r, "/user/identities/mock", accessToken), claims)
+	w := oidcCallback(r, code, state)
+	asserts.Equal(http.StatusCreated, w.Code, "identity should be linked from the account settings")
+
+	w = performJSONRequest(r, "GET", "/user/identities", accessToken, "")
+	var response struct {
+		Identities []IdentityResponse `json:"identities"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Len(response.Identities, 1)
+	asserts.Equal("mock", response.Identities[0].Provider)
+
+	code, state = mock.authorize(t, oidcAuthorizationURL(t, r, "/users/oidc/mock", ""), claims)
+	w = oidcCallback(r, code, state)
+	asserts.Equal(http.StatusOK, w.Code, "linked identity should log in")
+	asserts.Regexp(`"username":"user2"`, w.Body.String())
+
+	code, state = mock.authorize(t, oidcAuthorizationURL(t, r, "/user/identities/mock", common.GenToken(3)), claims)
+	asserts.Equal(http.StatusConflict, oidcCallback(r, code, state).Code, "identity should belong to one user only")
+
+	path := fmt.Sprintf("/user/identities/%d", response.Identities[0].ID)
+	asserts.Equal(http.StatusNotFound, performJSONRequest(r, "DELETE", path, common.GenToken(3), "").Code, "identities of other users could not be unlinked")
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "DELETE", path, accessToken, "").Code)
+	w = performJSONRequest(r, "GET", "/user/identities", accessToken, "")
+	asserts.Equal(`{"identities":[]}`, w.Body.String())
+}
+
+func createAccessToken(t *testing.T, r *gin.Engine, token, body string) AccessTokenResponse {
+	w := performJSONRequest(r, "POST", "/user/tokens", token, body)
+	var response struct {
+		Token AccessTokenResponse `json:"token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("access token should be created: %d %s", w.Code, w.Body.String())
+	}
+	return response.Token
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	loginToken := common.GenToken(1)
+
+	w := performJSONRequest(r, "POST", "/user/tokens", loginToken, `{"token":{"name": "deploy","scopes": ["admin:everything"]}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "unknown scope should be refused")
+	w = performJSONRequest(r, "POST", "/user/tokens", loginToken, `{"token":{"name": "deploy","scopes": ["profiles:write"],"expiresAt": "2001-01-01T00:00:00Z"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "expiry in the past should be refused")
+
+	followToken := createAccessToken(t, r, loginToken, `{"token":{"name": "follow bot","scopes": ["profiles:write"]}}`)
+	asserts.Regexp(`^pat_[a-zA-Z0-9-_]{43}$`, followToken.Token)
+	asserts.Nil(followToken.ExpiresAt)
+	var model PersonalAccessTokenModel
+	test_db.First(&model, followToken.ID)
+	asserts.Equal(common.HashToken(followToken.Token), model.TokenHash, "only the hash should be stored")
+	commentToken := createAccessToken(t, r, loginToken, `{"token":{"name": "comments","scopes": ["comments:write"],"expiresAt": "2999-01-01T00:00:00Z"}}`)
+
+	w = performJSONRequest(r, "GET", "/user/", followToken.Token, "")
+	asserts.Equal(http.StatusOK, w.Code, "access token should authenticate")
+	asserts.Contains(w.Body.String(), `"username":"user1"`)
+	asserts.Contains(w.Body.String(), `"token":""`, "access token should not be exchanged for a login token")
+
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "POST", "/profiles/user2/follow", followToken.Token, "").Code, "scope should allow the route")
+	w = performJSONRequest(r, "POST", "/profiles/user2/follow", commentToken.Token, "")
+	asserts.Equal(http.StatusForbidden, w.Code, "missing scope should be refused")
+	asserts.Equal(`{"errors":{"scope":"The token lacks the scope profiles:write"}}`, w.Body.String())
+	w = performJSONRequest(r, "POST", "/user/tokens", followToken.Token, `{"token":{"name": "escalate","scopes": ["articles:write"]}}`)
+	asserts.Equal(http.StatusForbidden, w.Code, "access token should not manage the account")
+
+	w = performJSONRequest(r, "GET", "/user/tokens", loginToken, "")
+	var list struct {
+		Tokens []AccessTokenResponse `json:"tokens"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	asserts.Len(list.Tokens, 2)
+	asserts.NotNil(list.Tokens[0].LastUsedAt, "last use should be recorded")
+	asserts.Empty(list.Tokens[0].Token, "token should never be listed")
+
+	asserts.Equal(http.StatusNotFound, performJSONRequest(r, "DELETE", fmt.Sprintf("/user/tokens/%d", followToken.ID), common.GenToken(2), "").Code, "tokens of other users could not be revoked")
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "DELETE", fmt.Sprintf("/user/tokens/%d", followToken.ID), loginToken, "").Code)
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", followToken.Token, "").Code, "revoked token should be refused")
+
+	test_db.Model(&PersonalAccessTokenModel{}).Where("id = ?", commentToken.ID).Update("expires_at", time.Now().Add(-time.Minute))
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", commentToken.Token, "").Code, "expired token should be refused")
+}
+
+func TestRolesAndPermissions(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	user1, _ := FindOneUser(&UserModel{ID: 1})
+
+	asserts.False(user1.HasPermission(PermissionArticlesDeleteAny), "users without a role should have no permission")
+	asserts.Equal(ErrRoleNotFound, GrantRole(1, "superhero"))
+	asserts.NoError(GrantRole(1, RoleModerator))
+	asserts.NoError(GrantRole(1, RoleModerator), "granting twice should be a no-op")
+	asserts.Equal([]string{RoleModerator}, user1.Roles())
+	asserts.True(user1.HasPermission(PermissionCommentsDeleteAny))
+	asserts.False(user1.HasPermission(PermissionRolesManage), "moderator should not manage roles")
+
+	w := performJSONRequest(r, "PUT", "/admin/users/user2/roles/moderator", common.GenToken(1), "")
+	asserts.Equal(http.StatusForbidden, w.Code)
+	asserts.Equal(`{"errors":{"permission":"Missing permission roles:manage"}}`, w.Body.String())
+
+	asserts.NoError(GrantRole(3, RoleAdmin))
+	w = performJSONRequest(r, "PUT", "/admin/users/user2/roles/moderator", common.GenToken(3), "")
+	asserts.Equal(http.StatusOK, w.Code, "admin should have every permission")
+	asserts.Equal(`{"roles":["moderator"]}`, w.Body.String())
+	w = performJSONRequest(r, "DELETE", "/admin/users/user2/roles/moderator", common.GenToken(3), "")
+	asserts.Equal(`{"roles":[]}`, w.Body.String())
+	events, _, _ := audit.FindEvents(audit.Filter{ActorID: 3, TargetType: audit.TargetUser, TargetID: "2"}, 20, 0)
+	asserts.Len(events, 2, "grants and revokes should be audited")
+	asserts.Equal(audit.ActionRoleRevoke, events[0].Action)
+	asserts.Equal(audit.ActionRoleGrant, events[1].Action)
+	asserts.Equal(`{"role":"moderator"}`, events[1].Details)
+
+	asserts.NoError(RevokeRole(1, RoleModerator))
+	asserts.False(user1.HasPermission(PermissionCommentsDeleteAny), "revoked role should not grant permissions")
+	asserts.NoError(SeedRoles(), "seeding should be idempotent")
+}
+
+func TestMigrateRoleColumn(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	asserts.NoError(test_db.Exec("ALTER TABLE user_models ADD COLUMN role varchar(255)").Error)
+	test_db.Exec("UPDATE user_models SET role = 'admin' WHERE id = 2")
+	test_db.Exec("UPDATE user_models SET role = 'superhero' WHERE id = 3")
+
+	AutoMigrate()
+	user2, _ := FindOneUser(&UserModel{ID: 2})
+	asserts.Equal([]string{RoleAdmin}, user2.Roles(), "the role of the column should be granted")
+	user3, _ := FindOneUser(&UserModel{ID: 3})
+	asserts.Empty(user3.Roles(), "an unknown role should be skipped")
+	asserts.False(test_db.Dialect().HasColumn("user_models", "role"), "the column should be dropped")
+
+	AutoMigrate()
+	asserts.Equal([]string{RoleAdmin}, user2.Roles())
+}
+
+func TestAccountExportAndDeletion(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	user1, _ := FindOneUser(&UserModel{ID: 1})
+	user3, _ := FindOneUser(&UserModel{ID: 3})
+	user3.following(user1)
+	user1.following(user3)
+	asserts.NoError(GrantRole(3, RoleModerator))
+	accessToken := createAccessToken(t, r, common.GenToken(3), `{"token":{"name": "bot","scopes": ["profiles:write"]}}`)
+	token, _ := loginTokens(t, r, "user3@linkedin.com")
+
+	w := performJSONRequest(r, "GET", "/user/export", token, "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `"profile":{"username":"user3","email":"user3@linkedin.com"`)
+	asserts.Contains(w.Body.String(), `"follows":{"following":["user1"],"followers":["user1"]}`)
+	asserts.Contains(w.Body.String(), `"roles":["moderator"]`)
+	asserts.Equal(http.StatusForbidden, performJSONRequest(r, "GET", "/user/export", accessToken.Token, "").Code, "access token should not export the account")
+
+	w = performJSONRequest(r, "DELETE", "/user/", token, `{"user":{"password": "password000"}}`)
+	asserts.Equal(http.StatusForbidden, w.Code)
+	asserts.Equal(`{"errors":{"user":"Invalid password"}}`, w.Body.String())
+	w = performJSONRequest(r, "DELETE", "/user/", token, `{"user":{"password": "password123"}}`)
+	asserts.Equal(http.StatusOK, w.Code)
+
+	_, err := FindOneUser(&UserModel{ID: 3})
+	asserts.Error(err, "user should be deleted")
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", token, "").Code, "token of a deleted account should be refused")
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", common.GenToken(3), "").Code, "token without session should be refused too")
+	asserts.Equal(http.StatusUnauthorized, performJSONRequest(r, "GET", "/user/", accessToken.Token, "").Code, "access tokens should be deleted")
+	var count int
+	test_db.Unscoped().Model(&FollowModel{}).Where("following_id = 3 OR followed_by_id = 3").Count(&count)
+	asserts.Equal(0, count, "follows should be deleted")
+	test_db.Unscoped().Model(&SessionModel{}).Where("user_model_id = 3").Count(&count)
+	asserts.Equal(0, count, "sessions should be deleted")
+	test_db.Unscoped().Model(&UserRoleModel{}).Where("user_model_id = 3").Count(&count)
+	asserts.Equal(0, count, "roles should be deleted")
+	w = performJSONRequest(r, "POST", "/users/login", "", `{"user":{"email": "user3@linkedin.com","password": "password123"}}`)
+	asserts.Equal(http.StatusForbidden, w.Code, "deleted account should not log in")
+
+	placeholder, err := FindOneUser(&UserModel{Email: DeletedUserEmail})
+	asserts.NoError(err, "placeholder should be created for the kept content")
+	asserts.Error(placeholder.checkPassword(""), "nobody should log in as the placeholder")
+}
+
+// Counts the queries sent through gorm while f runs
+func countQueries(f func()) int {
+	count := 0
+	counter := func(scope *gorm.Scope) { count++ }
+	test_db.Callback().Query().After("gorm:query").Register("test:count_queries", counter)
+	test_db.Callback().RowQuery().After("gorm:row_query").Register("test:count_row_queries", counter)
+	f()
+	test_db.Callback().Query().Remove("test:count_queries")
+	test_db.Callback().RowQuery().Remove("test:count_row_queries")
+	return count
+}
+
+func TestFollowLists(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	more := userModelMocker(2)
+	user1, _ := FindOneUser(&UserModel{ID: 1})
+	user2, _ := FindOneUser(&UserModel{ID: 2})
+	user3, _ := FindOneUser(&UserModel{ID: 3})
+	user2.following(user1)
+	user3.following(user1)
+	user1.following(user2)
+	user2.following(user3)
+
+	w := performJSONRequest(r, "GET", "/profiles/user1/followers", common.GenToken(2), "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(`{"profiles":[`+
+		`{"username":"user3","bio":"bio3","image":"http://image/3.jpg","following":true,"blocking":false,"muting":false,"followersCount":1,"followingCount":1},`+
+		`{"username":"user2","bio":"bio2","image":"http://image/2.jpg","following":false,"blocking":false,"muting":false,"followersCount":1,"followingCount":2}`+
+		`],"profilesCount":2}`, w.Body.String(), "latest follower should come first")
+
+	w = performJSONRequest(r, "GET", "/profiles/user1/followers?limit=1&offset=1", common.GenToken(2), "")
+	asserts.Equal(`{"profiles":[{"username":"user2","bio":"bio2","image":"http://image/2.jpg","following":false,"blocking":false,"muting":false,"followersCount":1,"followingCount":2}],"profilesCount":2}`, w.Body.String())
+
+	w = performJSONRequest(r, "GET", "/profiles/user2/following", common.GenToken(1), "")
+	asserts.Contains(w.Body.String(), `"profilesCount":2`)
+	asserts.Contains(w.Body.String(), `{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false,"blocking":false,"muting":false,"followersCount":2,"followingCount":1}`)
+
+	w = performJSONRequest(r, "GET", "/profiles/user1", common.GenToken(2), "")
+	asserts.Equal(`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":true,"blocking":false,"muting":false,"followersCount":2,"followingCount":1}}`, w.Body.String())
+
+	user1.unFollowing(user2)
+	w = performJSONRequest(r, "GET", "/profiles/user1/following", common.GenToken(2), "")
+	asserts.Equal(`{"profiles":[],"profilesCount":0}`, w.Body.String(), "unfollowed users should not be listed")
+	asserts.Equal(http.StatusNotFound, performJSONRequest(r, "GET", "/profiles/nobody/followers", common.GenToken(2), "").Code)
+
+	small := countQueries(func() { performJSONRequest(r, "GET", "/profiles/user1/followers", common.GenToken(2), "") })
+	for _, user := range more {
+		user.following(user1)
+	}
+	large := countQueries(func() { performJSONRequest(r, "GET", "/profiles/user1/followers", common.GenToken(2), "") })
+	asserts.NotZero(small)
+	asserts.Equal(small, large, "the number of queries should not grow with the number of followers")
+}
+
+func TestBlocksAndMutes(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	r := newTestRouter()
+	token := common.GenToken(1)
+
+	w := performJSONRequest(r, "POST", "/profiles/user1/block", token, "")
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"profile":"You could not block or mute yourself"}}`, w.Body.String())
+
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "POST", "/profiles/user2/block", token, "").Code)
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "POST", "/profiles/user2/block", token, "").Code, "blocking twice should be a no-op")
+	w = performJSONRequest(r, "POST", "/profiles/user2/follow", token, "")
+	asserts.Equal(http.StatusForbidden, w.Code)
+	asserts.Equal(`{"errors":{"profile":"Unblock this user before following"}}`, w.Body.String())
+	asserts.Equal(http.StatusOK, performJSONRequest(r, "POST", "/profiles/user3/mute", token, "").Code)
+
+	w = performJSONRequest(r, "GET", "/user/blocks", token, "")
+	asserts.Equal(`{"profiles":[{"username":"user2","bio":"bio2","image":"http://image/2.jpg","following":false,"blocking":true,"muting":false,"followersCount":0,"followingCount":0}],"profilesCount":1}`, w.Body.String())
+	w = performJSONRequest(r, "GET", "/user/mutes", token, "")
+	asserts.Contains(w.Body.String(), `"username":"user3"`)
+	asserts.Contains(w.Body.String(), `"profilesCount":1`)
+	user1, _ := FindOneUser(&UserModel{ID: 1})
+	asserts.ElementsMatch([]uint{2, 3}, user1.HiddenUserIDs())
+
+	performJSONRequest(r, "DELETE", "/profiles/user2/block", token, "")
+	performJSONRequest(r, "DELETE", "/profiles/user3/mute", token, "")
+	asserts.Contains(performJSONRequest(r, "GET", "/user/blocks", token, "").Body.String(), `"profilesCount":0`)
+	asserts.Empty(user1.HiddenUserIDs())
+}
+
+func performAvatarUpload(r *gin.Engine, token, field string, data []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile(field, "avatar.png")
+	part.Write(data)
+	form.Close()
+	req, _ := http.NewRequest("POST", "/user/avatar", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAvatarUpload(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	store := common.NewMemoryBlobStore()
+	common.SetBlobStore(store)
+	r := newTestRouter()
+	token := common.GenToken(1)
+
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	var encoded bytes.Buffer
+	png.Encode(&encoded, img)
+
+	w := performAvatarUpload(r, token, "avatar", []byte("%PDF-1.4 not an image"))
+	asserts.Equal(http.StatusUnsupportedMediaType, w.Code)
+	w = performAvatarUpload(r, token, "avatar", []byte("<html><script>alert(1)</script></html>"))
+	asserts.Equal(http.StatusUnsupportedMediaType, w.Code)
+	w = performAvatarUpload(r, token, "picture", encoded.Bytes())
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Empty(store.Keys(), "nothing should be stored for a refused upload")
+
+	w = performAvatarUpload(r, token, "avatar", encoded.Bytes())
+	asserts.Equal(http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Avatar AvatarResponse `json:"avatar"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	asserts.Len(response.Avatar.Sizes, len(AvatarSizes))
+	asserts.Equal(response.Avatar.Sizes["256"], *response.Avatar.Image)
+	asserts.Len(store.Keys(), len(AvatarSizes))
+	user1, _ := FindOneUser(&UserModel{ID: 1})
+	stored, ok := store.Get(avatarKey(user1.Avatar, 64))
+	asserts.True(ok)
+	thumbnail, format, err := image.Decode(bytes.NewReader(stored))
+	asserts.NoError(err)
+	asserts.Equal("jpeg", format)
+	asserts.Equal(image.Rect(0, 0, 64, 64), thumbnail.Bounds())
+
+	w = performJSONRequest(r, "GET", "/profiles/user1", token, "")
+	asserts.Contains(w.Body.String(), `"image":"`+*response.Avatar.Image+`"`)
+
+	// A new upload replaces the files of the previous one
+	previous := user1.Avatar
+	asserts.Equal(http.StatusOK, performAvatarUpload(r, token, "avatar", encoded.Bytes()).Code)
+	asserts.Len(store.Keys(), len(AvatarSizes))
+	_, ok = store.Get(avatarKey(previous, 64))
+	asserts.False(ok, "the previous avatar should be deleted")
+
+	w = performJSONRequest(r, "DELETE", "/user/avatar", token, "")
+	asserts.Equal(`{"avatar":{"image":"http://image/1.jpg","sizes":{}}}`, w.Body.String())
+	asserts.Empty(store.Keys())
+
+	previousMax := common.AvatarMaxBytes
+	common.AvatarMaxBytes = 16
+	defer func() { common.AvatarMaxBytes = previousMax }()
+	w = performAvatarUpload(r, token, "avatar", encoded.Bytes())
+	asserts.Equal(http.StatusRequestEntityTooLarge, w.Code)
+}
+
 //This is a hack way to add test database for each case, as whole test will just share one database.
 //You can read TestWithoutAuth's comment to know how to not share database each case.
 func TestMain(m *testing.M) {
 	test_db = common.TestDBInit()
 	AutoMigrate()
+	audit.AutoMigrate()
 	exitVal := m.Run()
 	common.TestDBFree(test_db)
 	os.Exit(exitVal)
@@ -3,8 +3,23 @@ package users
 import (
 	"realworld-backend/common"
 	"github.com/gin-gonic/gin"
+	"time"
 )
 
+// The password passed the validation but could not be hashed. It is not a validator.ValidationErrors,
+// answer it with common.NewError("password", err).
+type PasswordHashError struct {
+	Err error
+}
+
+func (e PasswordHashError) Error() string {
+	return e.Err.Error()
+}
+
+func (e PasswordHashError) Unwrap() error {
+	return e.Err
+}
+
 // *ModelValidator containing two parts:
 // - Validator: write the form/json checking rule according to the doc https://github.com/go-playground/validator
 // - DataModel: fill with data from Validator after invoking common.Bind(c, self)
@@ -13,7 +28,8 @@ type UserModelValidator struct {
 	User struct {
 		Username string `form:"username" json:"username" binding:"required,alphanum,min=4,max=255"`
 		Email    string `form:"email" json:"email" binding:"required,email"`
-		Password string `form:"password" json:"password" binding:"required,min=8,max=255"`
+		// The length and the other rules are checked by the password policy, see common.ValidatePassword
+		Password string `form:"password" json:"password" binding:"required,max=255"`
 		Bio      string `form:"bio" json:"bio" binding:"max=1024"`
 		Image    string `form:"image" json:"image" binding:"omitempty,url"`
 	} `json:"user"`
@@ -28,12 +44,19 @@ func (self *UserModelValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
+	if self.User.Password != common.NBRandomPassword {
+		if err := common.ValidatePassword(self.User.Password, self.User.Username, self.User.Email); err != nil {
+			return err
+		}
+	}
 	self.userModel.Username = self.User.Username
 	self.userModel.Email = self.User.Email
 	self.userModel.Bio = self.User.Bio
 
 	if self.User.Password != common.NBRandomPassword {
-		self.userModel.setPassword(self.User.Password)
+		if err := self.userModel.setPassword(self.User.Password); err != nil {
+			return PasswordHashError{err}
+		}
 	}
 	if self.User.Image != "" {
 		self.userModel.Image = &self.User.Image
@@ -84,3 +107,151 @@ func NewLoginValidator() LoginValidator {
 	loginValidator := LoginValidator{}
 	return loginValidator
 }
+
+type RefreshTokenValidator struct {
+	User struct {
+		RefreshToken string `form:"refreshToken" json:"refreshToken" binding:"required"`
+	} `json:"user"`
+}
+
+func (self *RefreshTokenValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+// You can put the default value of a Validator here
+func NewRefreshTokenValidator() RefreshTokenValidator {
+	refreshTokenValidator := RefreshTokenValidator{}
+	return refreshTokenValidator
+}
+
+type PasswordResetRequestValidator struct {
+	User struct {
+		Email string `form:"email" json:"email" binding:"required,email"`
+	} `json:"user"`
+}
+
+func (self *PasswordResetRequestValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewPasswordResetRequestValidator() PasswordResetRequestValidator {
+	return PasswordResetRequestValidator{}
+}
+
+type PasswordResetConfirmValidator struct {
+	User struct {
+		Token    string `form:"token" json:"token" binding:"required"`
+		Password string `form:"password" json:"password" binding:"required,max=255"`
+	} `json:"user"`
+}
+
+func (self *PasswordResetConfirmValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewPasswordResetConfirmValidator() PasswordResetConfirmValidator {
+	return PasswordResetConfirmValidator{}
+}
+
+type EmailVerifyValidator struct {
+	User struct {
+		Token string `form:"token" json:"token" binding:"required"`
+	} `json:"user"`
+}
+
+func (self *EmailVerifyValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewEmailVerifyValidator() EmailVerifyValidator {
+	return EmailVerifyValidator{}
+}
+
+type MFALoginValidator struct {
+	MFA struct {
+		Challenge string `form:"challenge" json:"challenge" binding:"required"`
+		Code      string `form:"code" json:"code" binding:"required,max=32"`
+	} `json:"mfa"`
+}
+
+func (self *MFALoginValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewMFALoginValidator() MFALoginValidator {
+	return MFALoginValidator{}
+}
+
+type TwoFactorCodeValidator struct {
+	TwoFactor struct {
+		Code string `form:"code" json:"code" binding:"required,max=32"`
+	} `json:"twoFactor"`
+}
+
+func (self *TwoFactorCodeValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewTwoFactorCodeValidator() TwoFactorCodeValidator {
+	return TwoFactorCodeValidator{}
+}
+
+type TwoFactorDisableValidator struct {
+	TwoFactor struct {
+		Password string `form:"password" json:"password" binding:"required,max=255"`
+		Code     string `form:"code" json:"code" binding:"required,max=32"`
+	} `json:"twoFactor"`
+}
+
+func (self *TwoFactorDisableValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewTwoFactorDisableValidator() TwoFactorDisableValidator {
+	return TwoFactorDisableValidator{}
+}
+
+type AccountDeleteValidator struct {
+	User struct {
+		Password string `form:"password" json:"password" binding:"required,max=255"`
+	} `json:"user"`
+}
+
+func (self *AccountDeleteValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewAccountDeleteValidator() AccountDeleteValidator {
+	return AccountDeleteValidator{}
+}
+
+type OIDCCallbackValidator struct {
+	OIDC struct {
+		Code  string `form:"code" json:"code" binding:"required,max=2048"`
+		State string `form:"state" json:"state" binding:"required,max=255"`
+	} `json:"oidc"`
+}
+
+func (self *OIDCCallbackValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewOIDCCallbackValidator() OIDCCallbackValidator {
+	return OIDCCallbackValidator{}
+}
+
+type AccessTokenValidator struct {
+	Token struct {
+		Name      string     `form:"name" json:"name" binding:"required,max=100"`
+		Scopes    []string   `form:"scopes" json:"scopes" binding:"required,min=1,dive,oneof=articles:write comments:write profiles:write"`
+		ExpiresAt *time.Time `form:"expiresAt" json:"expiresAt"`
+	} `json:"token"`
+}
+
+func (self *AccessTokenValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewAccessTokenValidator() AccessTokenValidator {
+	return AccessTokenValidator{}
+}